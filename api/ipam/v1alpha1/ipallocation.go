@@ -0,0 +1,291 @@
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// AllocationPoolIndex is the field index of IPAllocations by spec.pool, an IndexedReader lists IPAllocations of a
+// pool from the index instead of filtering all IPAllocations in the namespace
+const AllocationPoolIndex = "spec.pool"
+
+// indexers are the field indexers AllocationPoolIndex has been registered to
+var indexers sync.Map
+
+// IndexAllocations registers AllocationPoolIndex to indexer, e.g. the field indexer of a manager, it is a no-op when
+// the index has been registered to indexer
+func IndexAllocations(ctx context.Context, indexer client.FieldIndexer) error {
+	if _, ok := indexers.LoadOrStore(indexer, struct{}{}); ok {
+		return nil
+	}
+	err := indexer.IndexField(ctx, &IPAllocation{}, AllocationPoolIndex, AllocationPool)
+	if err != nil {
+		indexers.Delete(indexer)
+	}
+	return err
+}
+
+// AllocationPool is the index function of AllocationPoolIndex
+func AllocationPool(obj client.Object) []string {
+	a, ok := obj.(*IPAllocation)
+	if !ok {
+		return nil
+	}
+	return []string{a.Spec.Pool}
+}
+
+// IndexedReader is a reader whose IPAllocations are indexed by AllocationPoolIndex, e.g. the cached client of a
+// manager after IndexAllocations, LoadAllocations lists IPAllocations of the pool by the index
+type IndexedReader struct {
+	client.Reader
+}
+
+// AllocationSnapshot is IPAllocations of an IPPool keyed by ip and the status of the IPPool when they are loaded
+type AllocationSnapshot struct {
+	Allocations map[string]IPAllocation
+	Status      IPPoolStatus
+}
+
+// AllocationClaimedError is returned by SyncAllocations when the ip has been claimed by others, Holder is the
+// allocate info of the IPAllocation which claims the ip
+type AllocationClaimedError struct {
+	IP     string
+	Holder AllocateInfo
+}
+
+func (e *AllocationClaimedError) Error() string {
+	return fmt.Sprintf("ip %s has been allocated to %+v", e.IP, e.Holder)
+}
+
+// GetIPPool gets the IPPool of key and loads its IPAllocations into status.allocatedIPs
+func GetIPPool(ctx context.Context, reader client.Reader, key client.ObjectKey, pool *IPPool) (AllocationSnapshot, error) {
+	if err := reader.Get(ctx, key, pool); err != nil {
+		return AllocationSnapshot{}, err
+	}
+	return LoadAllocations(ctx, reader, pool)
+}
+
+// LoadAllocations fills status.allocatedIPs of pool with its IPAllocations and returns them as the snapshot of
+// SyncAllocations. Allocations left in status.allocatedIPs by old versions are kept, they are migrated to IPAllocations
+// by the next SyncAllocations. The pool must be just got from k8s, load twice keeps ips released between them.
+// IPAllocations are listed by AllocationPoolIndex for an IndexedReader, and by LabelPool for others, the label value
+// of a long pool name is bounded and may be shared by other pools, IPAllocations of them are skipped
+func LoadAllocations(ctx context.Context, reader client.Reader, pool *IPPool) (AllocationSnapshot, error) {
+	selector := client.ListOption(client.MatchingLabels{LabelPool: utils.GenLabelValue(pool.Name)})
+	if _, ok := reader.(IndexedReader); ok {
+		selector = client.MatchingFields{AllocationPoolIndex: pool.Name}
+	}
+	list := IPAllocationList{}
+	if err := reader.List(ctx, &list, client.InNamespace(pool.Namespace), selector); err != nil {
+		return AllocationSnapshot{}, fmt.Errorf("list ipallocations of ippool %s/%s error, err: %s", pool.Namespace, pool.Name, err)
+	}
+	return loadAllocationsIn(list.Items, pool), nil
+}
+
+// LoadAllocationsForList loads IPAllocations into all pools of list with a single list request, opts filter the
+// listed IPAllocations, e.g. client.InNamespace, the snapshots are keyed by pool namespace and name
+func LoadAllocationsForList(ctx context.Context, reader client.Reader, list *IPPoolList,
+	opts ...client.ListOption) (map[client.ObjectKey]AllocationSnapshot, error) {
+	allocations := IPAllocationList{}
+	if err := reader.List(ctx, &allocations, opts...); err != nil {
+		return nil, fmt.Errorf("list ipallocations error, err: %s", err)
+	}
+	byPool := make(map[client.ObjectKey][]IPAllocation)
+	for i := range allocations.Items {
+		a := &allocations.Items[i]
+		key := client.ObjectKey{Namespace: a.Namespace, Name: a.Spec.Pool}
+		byPool[key] = append(byPool[key], *a)
+	}
+	res := make(map[client.ObjectKey]AllocationSnapshot, len(list.Items))
+	for i := range list.Items {
+		pool := &list.Items[i]
+		key := client.ObjectKeyFromObject(pool)
+		res[key] = loadAllocationsIn(byPool[key], pool)
+	}
+	return res, nil
+}
+
+func loadAllocationsIn(allocations []IPAllocation, pool *IPPool) AllocationSnapshot {
+	snapshot := AllocationSnapshot{
+		Allocations: make(map[string]IPAllocation, len(allocations)),
+		Status:      *pool.Status.DeepCopy(),
+	}
+	for i := range allocations {
+		a := &allocations[i]
+		if a.Spec.Pool != pool.Name {
+			continue
+		}
+		if pool.Status.AllocatedIPs == nil {
+			pool.Status.AllocatedIPs = make(map[string]AllocateInfo, len(allocations))
+		}
+		snapshot.Allocations[a.Spec.IP] = *a
+		pool.Status.AllocatedIPs[a.Spec.IP] = a.Spec.AllocateInfo
+	}
+	snapshot.Status.Offset = nextOffset(snapshot.Allocations, pool)
+	pool.Status.Offset = snapshot.Status.Offset
+	return snapshot
+}
+
+// nextOffset returns the offset in AnnotationOffset of the newest IPAllocation of pool, the larger offset is used
+// for IPAllocations created in the same second. status.offset is kept when it is negative, e.g. the pool is full, or
+// no IPAllocation has a valid offset
+func nextOffset(allocations map[string]IPAllocation, pool *IPPool) int64 {
+	if pool.Status.Offset < 0 || len(allocations) == 0 {
+		return pool.Status.Offset
+	}
+	var newest *IPAllocation
+	next := int64(-1)
+	for ip := range allocations {
+		a := allocations[ip]
+		off, err := strconv.ParseInt(a.Annotations[AnnotationOffset], 10, 64)
+		if err != nil || off < 0 {
+			continue
+		}
+		if newest != nil {
+			if a.CreationTimestamp.Before(&newest.CreationTimestamp) {
+				continue
+			}
+			if a.CreationTimestamp.Equal(&newest.CreationTimestamp) && off < next {
+				continue
+			}
+		}
+		newest, next = &a, off
+	}
+	if newest == nil {
+		return pool.Status.Offset
+	}
+	return next
+}
+
+// SyncAllocations creates, updates and deletes IPAllocations of pool by the difference between status.allocatedIPs
+// and snapshot, create the IPAllocation is the claim of the ip, it returns *AllocationClaimedError when the ip has
+// been claimed by others. Created IPAllocations keep status.offset in AnnotationOffset. Then the fields of the pool
+// status changed since the snapshot, e.g. the counters, are merge patched without status.allocatedIPs on the
+// resourceVersion of pool, status.offset is only patched when the pool becomes full or isn't full any more, the
+// patch is skipped when nothing changes. It returns a conflict error when the pool has been changed since the snapshot is loaded.
+// IPAllocations created, updated and deleted in the sync are restored to the snapshot on any failure, so the caller
+// can retry with a new snapshot. owners are set to the created IPAllocations of their ips as non-controller owner
+// references, so that kubernetes gc releases the ips with their owners. Kubernetes gc only allows owners in the
+// namespace of the pool, ips of owners in other namespaces are released by the cron jobs and controllers instead
+func SyncAllocations(ctx context.Context, c client.Client, pool *IPPool, snapshot AllocationSnapshot,
+	owners map[string]metav1.OwnerReference) error {
+	var created, updated, deleted []*IPAllocation
+	rollback := func() {
+		for _, a := range created {
+			if err := c.Delete(ctx, a, client.Preconditions{UID: &a.UID}); err != nil && !errors.IsNotFound(err) {
+				klog.Errorf("Failed to release ipallocation %s/%s, err: %s", a.Namespace, a.Name, err)
+			}
+		}
+		for _, a := range updated {
+			old := snapshot.Allocations[a.Spec.IP]
+			// the update is based on resourceVersion, it fails when others have changed the ipallocation
+			a.Spec.AllocateInfo = old.Spec.AllocateInfo
+			if err := c.Update(ctx, a); err != nil && !errors.IsNotFound(err) {
+				klog.Errorf("Failed to restore ipallocation %s/%s, err: %s", a.Namespace, a.Name, err)
+			}
+		}
+		for _, a := range deleted {
+			// the ip may have been claimed by others after it is released
+			if err := c.Create(ctx, a); err != nil && !errors.IsAlreadyExists(err) {
+				klog.Errorf("Failed to restore ipallocation %s/%s, err: %s", a.Namespace, a.Name, err)
+			}
+		}
+	}
+
+	for ip, info := range pool.Status.AllocatedIPs {
+		if old, ok := snapshot.Allocations[ip]; ok {
+			if old.Spec.AllocateInfo == info {
+				continue
+			}
+			a := old.DeepCopy()
+			a.Spec.AllocateInfo = info
+			if err := c.Update(ctx, a); err != nil {
+				rollback()
+				return fmt.Errorf("update ipallocation %s/%s error, err: %w", a.Namespace, a.Name, err)
+			}
+			updated = append(updated, a)
+			continue
+		}
+		a := NewIPAllocation(pool, ip, info)
+		if pool.Status.Offset >= 0 {
+			a.Annotations = map[string]string{AnnotationOffset: strconv.FormatInt(pool.Status.Offset, 10)}
+		}
+		if ref, ok := owners[ip]; ok {
+			a.OwnerReferences = []metav1.OwnerReference{ref}
+		}
+		err := c.Create(ctx, a)
+		if err == nil {
+			created = append(created, a)
+			continue
+		}
+		if errors.IsAlreadyExists(err) {
+			cur := IPAllocation{}
+			if err = c.Get(ctx, client.ObjectKeyFromObject(a), &cur); err == nil {
+				if cur.Spec.AllocateInfo == info {
+					continue
+				}
+				err = &AllocationClaimedError{IP: ip, Holder: cur.Spec.AllocateInfo}
+			}
+		}
+		rollback()
+		return fmt.Errorf("claim ip %s in ippool %s/%s error, err: %w", ip, pool.Namespace, pool.Name, err)
+	}
+
+	for ip := range snapshot.Allocations {
+		if _, ok := pool.Status.AllocatedIPs[ip]; ok {
+			continue
+		}
+		a := snapshot.Allocations[ip]
+		// the ip may have been released and claimed by others since the snapshot is loaded
+		err := c.Delete(ctx, &a, client.Preconditions{UID: &a.UID})
+		if err == nil {
+			deleted = append(deleted, restorable(&a))
+			continue
+		}
+		if !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			rollback()
+			return fmt.Errorf("release ipallocation %s/%s error, err: %w", a.Namespace, a.Name, err)
+		}
+	}
+
+	base := pool.DeepCopy()
+	base.Status = *snapshot.Status.DeepCopy()
+	modified := pool.DeepCopy()
+	modified.Status.AllocatedIPs = nil
+	// the offset is kept in the created IPAllocations, it is only patched when the pool becomes full or isn't full
+	if base.Status.Offset >= 0 && modified.Status.Offset >= 0 {
+		modified.Status.Offset = base.Status.Offset
+	}
+	if equality.Semantic.DeepEqual(base.Status, modified.Status) {
+		return nil
+	}
+	if err := c.Status().Patch(ctx, modified, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})); err != nil {
+		rollback()
+		return err
+	}
+	pool.ResourceVersion = modified.ResourceVersion
+	return nil
+}
+
+// restorable returns the copy of deleted IPAllocation a which can be created again
+func restorable(a *IPAllocation) *IPAllocation {
+	res := a.DeepCopy()
+	res.ObjectMeta = metav1.ObjectMeta{
+		Namespace:       a.Namespace,
+		Name:            a.Name,
+		Labels:          a.Labels,
+		Annotations:     a.Annotations,
+		OwnerReferences: a.OwnerReferences,
+	}
+	return res
+}
@@ -0,0 +1,357 @@
+package v1alpha1
+
+import (
+	"context"
+	stderrors "errors"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewIPAllocation(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "", "")
+	info := AllocateInfo{ID: "ns/pod", Type: AllocateTypePod, CID: "cid"}
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{ip: "10.10.0.5", name: "pool-10-10-0-5"},
+		{ip: "fd00::5", name: "pool-fd000000000000000000000000000005"},
+	}
+	for _, item := range tests {
+		a := NewIPAllocation(pool, item.ip, info)
+		if a.Name != item.name || a.Namespace != pool.Namespace {
+			t.Errorf("ip %s expect name %s/%s, real is %s/%s", item.ip, pool.Namespace, item.name, a.Namespace, a.Name)
+		}
+		if a.Labels[LabelPool] != pool.Name || a.Spec.Pool != pool.Name || a.Spec.IP != item.ip || a.Spec.AllocateInfo != info {
+			t.Errorf("unexpected ipallocation %+v", a)
+		}
+	}
+}
+
+func TestNewIPAllocationLongPoolName(t *testing.T) {
+	pool := newIPPool("fd00::/64", "fd00::1", "", "", "")
+	pool.Name = strings.Repeat("p", 250)
+	other := pool.DeepCopy()
+	other.Name = strings.Repeat("p", 249) + "q"
+	info := AllocateInfo{ID: "ns/pod", Type: AllocateTypePod}
+
+	a := NewIPAllocation(pool, "fd00::5", info)
+	b := NewIPAllocation(other, "fd00::5", info)
+	if len(a.Name) > 253 || len(b.Name) > 253 {
+		t.Errorf("ipallocation name should be at most 253 characters, real is %d and %d", len(a.Name), len(b.Name))
+	}
+	if a.Name == b.Name {
+		t.Errorf("ipallocations of different pools should have different names, real is %s", a.Name)
+	}
+	if !strings.HasSuffix(a.Name, "-fd000000000000000000000000000005") {
+		t.Errorf("ipallocation name %s should end with the ip", a.Name)
+	}
+	for _, item := range []*IPAllocation{a, b} {
+		if errs := validation.IsValidLabelValue(item.Labels[LabelPool]); len(errs) != 0 {
+			t.Errorf("ipallocation pool label %s should be a valid label value, real errs: %v", item.Labels[LabelPool], errs)
+		}
+	}
+	if a.Labels[LabelPool] == b.Labels[LabelPool] {
+		t.Errorf("ipallocations of different pools should have different pool labels, real is %s", a.Labels[LabelPool])
+	}
+
+	// the suffix alone exceeds the max length
+	long := NewIPAllocation(pool, strings.Repeat("x", 260), info)
+	otherLong := NewIPAllocation(pool, strings.Repeat("x", 259)+"y", info)
+	if len(long.Name) > 253 || long.Name == otherLong.Name {
+		t.Errorf("ipallocation names with long suffixes should be bounded and different, real is %s and %s", long.Name, otherLong.Name)
+	}
+}
+
+// failStatusClient fails all status patches with a conflict error
+type failStatusClient struct {
+	client.Client
+}
+
+func (c failStatusClient) Status() client.SubResourceWriter {
+	return failStatusWriter{c.Client.Status()}
+}
+
+type failStatusWriter struct {
+	client.SubResourceWriter
+}
+
+func (w failStatusWriter) Patch(_ context.Context, obj client.Object, _ client.Patch, _ ...client.SubResourcePatchOption) error {
+	return errors.NewConflict(Resource("ippools"), obj.GetName(), nil)
+}
+
+func TestSyncAllocationsRollback(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/24")
+	updated := NewIPAllocation(pool, "10.10.0.2", AllocateInfo{ID: "ns/pod2", Type: AllocateTypePod})
+	deleted := NewIPAllocation(pool, "10.10.0.3", AllocateInfo{ID: "ns/pod3", Type: AllocateTypePod})
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool, updated, deleted).Build()
+	ctx := context.Background()
+
+	cur := IPPool{}
+	snapshot, err := GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(pool), &cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur.Status.AllocatedIPs["10.10.0.2"] = AllocateInfo{ID: "ns/new2", Type: AllocateTypePod}
+	delete(cur.Status.AllocatedIPs, "10.10.0.3")
+	cur.Status.AllocatedIPs["10.10.0.4"] = AllocateInfo{ID: "ns/pod4", Type: AllocateTypePod}
+	cur.UpdateIPUsageCounter()
+	if err := SyncAllocations(ctx, failStatusClient{k8sClient}, &cur, snapshot, nil); !errors.IsConflict(err) {
+		t.Fatalf("expect conflict error, real is %v", err)
+	}
+
+	res := IPPool{}
+	if _, err := GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(pool), &res); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{"10.10.0.2": "ns/pod2", "10.10.0.3": "ns/pod3"}
+	if len(res.Status.AllocatedIPs) != len(exp) {
+		t.Errorf("expect allocated ips %v after rollback, real is %v", exp, res.Status.AllocatedIPs)
+	}
+	for ip, id := range exp {
+		if res.Status.AllocatedIPs[ip].ID != id {
+			t.Errorf("expect ip %s restored to %s, real is %+v", ip, id, res.Status.AllocatedIPs[ip])
+		}
+	}
+}
+
+func TestLoadAllocationsIn(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "", "")
+	pool.Status.AllocatedIPs = map[string]AllocateInfo{
+		"10.10.0.2": {ID: "ns/legacy", Type: AllocateTypePod},
+		"10.10.0.3": {ID: "ns/stale", Type: AllocateTypePod},
+	}
+	other := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "", "")
+	other.Name = "other"
+	allocations := []IPAllocation{
+		*NewIPAllocation(pool, "10.10.0.3", AllocateInfo{ID: "ns/pod3", Type: AllocateTypePod}),
+		*NewIPAllocation(pool, "10.10.0.4", AllocateInfo{ID: "ns/pod4", Type: AllocateTypePod}),
+		*NewIPAllocation(other, "10.10.0.5", AllocateInfo{ID: "ns/pod5", Type: AllocateTypePod}),
+	}
+
+	snapshot := loadAllocationsIn(allocations, pool)
+	if len(snapshot.Allocations) != 2 || len(snapshot.Status.AllocatedIPs) != 2 {
+		t.Errorf("expect 2 ipallocations in snapshot, real is %v", snapshot)
+	}
+	exp := map[string]string{"10.10.0.2": "ns/legacy", "10.10.0.3": "ns/pod3", "10.10.0.4": "ns/pod4"}
+	if len(pool.Status.AllocatedIPs) != len(exp) {
+		t.Errorf("expect allocated ips %v, real is %v", exp, pool.Status.AllocatedIPs)
+	}
+	for ip, id := range exp {
+		if pool.Status.AllocatedIPs[ip].ID != id {
+			t.Errorf("expect ip %s allocated to %s, real is %+v", ip, id, pool.Status.AllocatedIPs[ip])
+		}
+	}
+
+	empty := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "", "")
+	if snapshot = loadAllocationsIn(nil, empty); len(snapshot.Allocations) != 0 || empty.Status.AllocatedIPs != nil {
+		t.Errorf("pool without ipallocations should be unchanged, real is %v", empty.Status.AllocatedIPs)
+	}
+}
+
+func TestNextOffset(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/29")
+	now := time.Now()
+	newAllocation := func(ip, offset string, created time.Time) IPAllocation {
+		a := NewIPAllocation(pool, ip, AllocateInfo{ID: "ns/pod", Type: AllocateTypePod})
+		a.CreationTimestamp = metav1.NewTime(created)
+		if offset != "" {
+			a.Annotations = map[string]string{AnnotationOffset: offset}
+		}
+		return *a
+	}
+	tests := []struct {
+		name        string
+		offset      int64
+		allocations []IPAllocation
+		exp         int64
+	}{
+		{name: "no ipallocation", offset: 3, exp: 3},
+		{name: "newest ipallocation", allocations: []IPAllocation{newAllocation("10.10.0.5", "6", now.Add(-time.Minute)),
+			newAllocation("10.10.0.3", "4", now)}, exp: 4},
+		{name: "created in the same second", allocations: []IPAllocation{newAllocation("10.10.0.5", "6", now),
+			newAllocation("10.10.0.3", "4", now)}, exp: 6},
+		{name: "without offset", offset: 2, allocations: []IPAllocation{newAllocation("10.10.0.5", "", now),
+			newAllocation("10.10.0.3", "invalid", now)}, exp: 2},
+		{name: "full", offset: -1, allocations: []IPAllocation{newAllocation("10.10.0.3", "4", now)}, exp: -1},
+	}
+	for _, item := range tests {
+		p := pool.DeepCopy()
+		p.Status.Offset = item.offset
+		snapshot := loadAllocationsIn(item.allocations, p)
+		if p.Status.Offset != item.exp || snapshot.Status.Offset != item.exp {
+			t.Errorf("test %s expect offset %d, real is %d, snapshot %d", item.name, item.exp, p.Status.Offset, snapshot.Status.Offset)
+		}
+	}
+}
+
+// recordPatchClient records the data of all status patches
+type recordPatchClient struct {
+	client.Client
+	patches *[]string
+}
+
+func (c recordPatchClient) Status() client.SubResourceWriter {
+	return recordPatchWriter{c.Client.Status(), c.patches}
+}
+
+type recordPatchWriter struct {
+	client.SubResourceWriter
+	patches *[]string
+}
+
+func (w recordPatchWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	*w.patches = append(*w.patches, string(data))
+	return w.SubResourceWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func newFakeClient(t *testing.T, objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).WithStatusSubresource(&IPPool{}).
+		WithIndex(&IPAllocation{}, AllocationPoolIndex, AllocationPool).Build()
+}
+
+func TestSyncAllocationsClaimed(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/24")
+	holder := AllocateInfo{ID: "ns/other", Type: AllocateTypePod}
+	k8sClient := newFakeClient(t, pool, NewIPAllocation(pool, "10.10.0.2", holder))
+	ctx := context.Background()
+
+	// the ipallocation isn't in the snapshot, e.g. the snapshot is loaded from a stale cache
+	cur := IPPool{}
+	if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(pool), &cur); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := loadAllocationsIn(nil, &cur)
+	cur.Status.AllocatedIPs = map[string]AllocateInfo{
+		"10.10.0.2": {ID: "ns/pod2", Type: AllocateTypePod},
+		"10.10.0.3": {ID: "ns/pod3", Type: AllocateTypePod},
+	}
+	cur.UpdateIPUsageCounter()
+	var claimed *AllocationClaimedError
+	err := SyncAllocations(ctx, k8sClient, &cur, snapshot, nil)
+	if !stderrors.As(err, &claimed) || claimed.IP != "10.10.0.2" || claimed.Holder != holder {
+		t.Fatalf("expect ip 10.10.0.2 claimed by %+v, real is %v", holder, err)
+	}
+
+	res := IPPool{}
+	if _, err := GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(pool), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Status.AllocatedIPs) != 1 || res.Status.AllocatedIPs["10.10.0.2"] != holder || res.Status.AllocatedCount != 0 {
+		t.Errorf("expect ippool unchanged after the claim fails, real is %+v", res.Status)
+	}
+}
+
+func TestSyncAllocationsPatch(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/24")
+	pool.Status.TotalCount = 253
+	pool.Status.AvailableCount = 253
+	quota := pool.DeepCopy()
+	quota.Name = "quota"
+	quota.Spec.NamespaceQuotas = []NamespaceQuota{{Namespaces: []string{"ns"}, Max: 10}}
+	ctx := context.Background()
+
+	for _, item := range []*IPPool{pool, quota} {
+		var patches []string
+		k8sClient := recordPatchClient{newFakeClient(t, item), &patches}
+
+		// nothing changes
+		cur := IPPool{}
+		snapshot, err := GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(item), &cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur.UpdateIPUsageCounter()
+		if err := SyncAllocations(ctx, k8sClient, &cur, snapshot, nil); err != nil || len(patches) != 0 {
+			t.Fatalf("ippool %s expect no status patch, real is %v, err: %v", item.Name, patches, err)
+		}
+
+		// only the counters change
+		snapshot, err = GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(item), &cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur.Status.AllocatedIPs = map[string]AllocateInfo{"10.10.0.2": {ID: "ns/pod2", Type: AllocateTypePod}}
+		cur.UpdateIPUsageCounter()
+		version := cur.ResourceVersion
+		if err := SyncAllocations(ctx, k8sClient, &cur, snapshot, nil); err != nil {
+			t.Fatal(err)
+		}
+		exp := `{"metadata":{"resourceVersion":"` + version + `"},"status":{"allocated_count":1,"available_count":252}}`
+		if item.Spec.NamespaceQuotas != nil {
+			exp = `{"metadata":{"resourceVersion":"` + version + `"},"status":{"allocated_count":1,"available_count":252,"namespaceusage":{"ns":1}}}`
+		}
+		if len(patches) != 1 || patches[0] != exp {
+			t.Errorf("ippool %s expect status patch %s, real is %v", item.Name, exp, patches)
+		}
+
+		// the offset is kept in the created ipallocation
+		patches = nil
+		snapshot, err = GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(item), &cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur.Status.AllocatedIPs["10.10.0.3"] = AllocateInfo{ID: "ns/pod3", Type: AllocateTypeCNIUsed}
+		cur.Status.Offset = 4
+		if err := SyncAllocations(ctx, k8sClient, &cur, snapshot, nil); err != nil || len(patches) != 0 {
+			t.Fatalf("ippool %s expect no status patch, real is %v, err: %v", item.Name, patches, err)
+		}
+		if _, err := GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(item), &cur); err != nil || cur.Status.Offset != 4 {
+			t.Errorf("ippool %s expect offset 4 loaded from ipallocations, real is %d, err: %v", item.Name, cur.Status.Offset, err)
+		}
+
+		// the full pool is patched
+		snapshot, err = GetIPPool(ctx, k8sClient, client.ObjectKeyFromObject(item), &cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur.Status.Offset = -1
+		version = cur.ResourceVersion
+		if err := SyncAllocations(ctx, k8sClient, &cur, snapshot, nil); err != nil {
+			t.Fatal(err)
+		}
+		exp = `{"metadata":{"resourceVersion":"` + version + `"},"status":{"offset":-1}}`
+		if len(patches) != 1 || patches[0] != exp {
+			t.Errorf("ippool %s expect status patch %s, real is %v", item.Name, exp, patches)
+		}
+	}
+}
+
+func TestLoadAllocationsIndexed(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/24")
+	other := pool.DeepCopy()
+	other.Name = "other"
+	a := NewIPAllocation(pool, "10.10.0.2", AllocateInfo{ID: "ns/pod2", Type: AllocateTypePod})
+	// the label is dropped, ipallocations are listed by the index
+	a.Labels = nil
+	k8sClient := newFakeClient(t, pool, other, a, NewIPAllocation(other, "10.10.0.3", AllocateInfo{ID: "ns/pod3", Type: AllocateTypePod}))
+
+	cur := IPPool{}
+	snapshot, err := GetIPPool(context.Background(), IndexedReader{k8sClient}, client.ObjectKeyFromObject(pool), &cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Allocations) != 1 || len(cur.Status.AllocatedIPs) != 1 || cur.Status.AllocatedIPs["10.10.0.2"].ID != "ns/pod2" {
+		t.Errorf("expect only ip 10.10.0.2 loaded by the index, real is %v", cur.Status.AllocatedIPs)
+	}
+}
@@ -0,0 +1,62 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// AnnotationOffset is set on IPAllocation to the status.offset of the IPPool after the ip is allocated, the offset
+// of the IPPool follows its newest IPAllocation, so that allocations don't update the IPPool status
+const AnnotationOffset = "ipam.everoute.io/offset"
+
+// +genclient
+// +k8s:openapi-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Pool",type="string",JSONPath=".spec.pool"
+// +kubebuilder:printcolumn:name="IP",type="string",JSONPath=".spec.ip"
+// +kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.type"
+// +kubebuilder:printcolumn:name="ID",type="string",JSONPath=".spec.id"
+
+// IPAllocation is an ip allocated from an IPPool, it is named by the pool and the ip, so that create the
+// IPAllocation is the claim of the ip
+type IPAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPAllocationSpec `json:"spec"`
+}
+
+type IPAllocationSpec struct {
+	// Pool is the IPPool name the ip belongs to
+	Pool string `json:"pool"`
+	// IP is the allocated ip
+	IP           string `json:"ip"`
+	AllocateInfo `json:",inline"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPAllocationList contains a list of IPAllocation
+type IPAllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPAllocation `json:"items"`
+}
+
+// NewIPAllocation returns the IPAllocation of ip allocated from pool with allocate info a
+func NewIPAllocation(pool *IPPool, ip string, a AllocateInfo) *IPAllocation {
+	return &IPAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pool.Namespace,
+			Name:      utils.GenAllocationName(pool.Name, ip),
+			Labels:    map[string]string{LabelPool: utils.GenLabelValue(pool.Name)},
+		},
+		Spec: IPAllocationSpec{
+			Pool:         pool.Name,
+			IP:           ip,
+			AllocateInfo: a,
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package v1alpha1
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+const (
+	// LabelPool and LabelNode are set on IPBlock to list blocks of a pool or a node, values of long names are
+	// bounded by utils.GenLabelValue
+	LabelPool = "ipam.everoute.io/pool"
+	LabelNode = "ipam.everoute.io/node"
+)
+
+// +genclient
+// +k8s:openapi-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Pool",type="string",JSONPath=".spec.pool"
+// +kubebuilder:printcolumn:name="Node",type="string",JSONPath=".spec.node"
+// +kubebuilder:printcolumn:name="CIDR",type="string",JSONPath=".spec.cidr"
+
+// IPBlock is a part of an IPPool claimed by a node, pods on the node allocate ip from it
+// without contending the IPPool status with other nodes
+type IPBlock struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPBlockSpec `json:"spec"`
+
+	Status IPBlockStatus `json:"status,omitempty"`
+}
+
+type IPBlockSpec struct {
+	// Pool is the IPPool name the block belongs to
+	Pool string `json:"pool"`
+	// Node is the name of node which claims the block
+	Node string `json:"node"`
+	// CIDR is the ip range of the block, its prefix length is the IPPool spec.blockSize
+	CIDR string `json:"cidr"`
+}
+
+type IPBlockStatus struct {
+	// AllocatedIPs is ip and allocated infos
+	AllocatedIPs map[string]AllocateInfo `json:"allocatedips,omitempty"`
+	// Offset stores the current read pointer
+	Offset int64 `json:"offset,omitempty"`
+	// QuarantinedIPs is released ip and the release time, it follows spec.releaseCooldownSeconds of the IPPool
+	QuarantinedIPs map[string]metav1.Time `json:"quarantinedips,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPBlockList contains a list of IPBlock
+type IPBlockList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPBlock `json:"items"`
+}
+
+// ToIPPool returns an IPPool which has the block range and the subnet, gateway, except, release cooldown and
+// allocation strategy of the IPPool pool, ips used by pool itself are regarded as allocated, so allocate on it
+// never conflicts with pool
+func (r *IPBlock) ToIPPool(pool *IPPool) *IPPool {
+	res := &IPPool{
+		ObjectMeta: *pool.ObjectMeta.DeepCopy(),
+		Spec: IPPoolSpec{
+			CIDR:                   r.Spec.CIDR,
+			Except:                 pool.Spec.Except,
+			Subnet:                 pool.Spec.Subnet,
+			Gateway:                pool.Spec.Gateway,
+			ReleaseCooldownSeconds: pool.Spec.ReleaseCooldownSeconds,
+			AllocationStrategy:     pool.Spec.AllocationStrategy,
+		},
+		Status: IPPoolStatus{
+			Offset:       r.Status.Offset,
+			AllocatedIPs: make(map[string]AllocateInfo, len(r.Status.AllocatedIPs)),
+		},
+	}
+	for ip, a := range r.Status.AllocatedIPs {
+		res.Status.AllocatedIPs[ip] = a
+	}
+	if len(r.Status.QuarantinedIPs) != 0 {
+		res.Status.QuarantinedIPs = make(map[string]metav1.Time, len(r.Status.QuarantinedIPs))
+		for ip, t := range r.Status.QuarantinedIPs {
+			res.Status.QuarantinedIPs[ip] = t
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(r.Spec.CIDR)
+	if err != nil {
+		return res
+	}
+	for ip, a := range pool.Status.AllocatedIPs {
+		if ipNet.Contains(net.ParseIP(ip)) {
+			res.Status.AllocatedIPs[ip] = a
+		}
+	}
+	for ip := range pool.Status.UsedIps {
+		if ipNet.Contains(net.ParseIP(ip)) {
+			res.Status.AllocatedIPs[ip] = AllocateInfo{Type: AllocateTypeCNIUsed, ID: pool.Status.UsedIps[ip]}
+		}
+	}
+	return res
+}
+
+// Quarantine puts the released ip into quarantine by spec.releaseCooldownSeconds of pool,
+// ips whose cooldown has passed are removed
+func (r *IPBlock) Quarantine(pool *IPPool, ip string, now time.Time) {
+	view := &IPPool{
+		Spec:   IPPoolSpec{ReleaseCooldownSeconds: pool.Spec.ReleaseCooldownSeconds},
+		Status: IPPoolStatus{QuarantinedIPs: r.Status.QuarantinedIPs},
+	}
+	view.Quarantine(ip, now)
+	view.CleanQuarantine(now)
+	r.Status.QuarantinedIPs = view.Status.QuarantinedIPs
+}
+
+// BlockLabels returns labels of the IPBlock of pool claimed by node
+func BlockLabels(pool, node string) map[string]string {
+	return map[string]string{
+		LabelPool: utils.GenLabelValue(pool),
+		LabelNode: utils.GenLabelValue(node),
+	}
+}
+
+// ListBlocks lists IPBlocks of pool in namespace sorted by name, only blocks of node are listed if node isn't empty.
+// The label values of long names are bounded and may be shared by other pools or nodes, blocks of them are skipped
+func ListBlocks(ctx context.Context, reader client.Reader, namespace, pool, node string) ([]IPBlock, error) {
+	labels := client.MatchingLabels{LabelPool: utils.GenLabelValue(pool)}
+	if node != "" {
+		labels[LabelNode] = utils.GenLabelValue(node)
+	}
+	list := IPBlockList{}
+	if err := reader.List(ctx, &list, client.InNamespace(namespace), labels); err != nil {
+		return nil, err
+	}
+	blocks := list.Items[:0]
+	for i := range list.Items {
+		if list.Items[i].Spec.Pool == pool && (node == "" || list.Items[i].Spec.Node == node) {
+			blocks = append(blocks, list.Items[i])
+		}
+	}
+	sort.Slice(blocks, func(a, b int) bool {
+		return blocks[a].Name < blocks[b].Name
+	})
+	return blocks, nil
+}
@@ -0,0 +1,83 @@
+package v1alpha1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestToIPPool(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20", "10.10.0.20/31")
+	pool.Spec.BlockSize = 28
+	pool.Status.AllocatedIPs = map[string]AllocateInfo{
+		"10.10.0.17": {ID: "ns/sts-0", Type: AllocateTypeStatefulSet, Owner: "ns/sts"},
+		"10.10.0.33": {ID: "ns/sts-1", Type: AllocateTypeStatefulSet, Owner: "ns/sts"},
+	}
+	pool.Status.UsedIps = map[string]string{"10.10.0.18": "xxxx"}
+
+	block := IPBlock{
+		Spec: IPBlockSpec{Pool: "pool", Node: "node1", CIDR: "10.10.0.16/28"},
+		Status: IPBlockStatus{
+			AllocatedIPs: map[string]AllocateInfo{"10.10.0.19": {ID: "ns/pod", Type: AllocateTypePod}},
+			Offset:       4,
+		},
+	}
+
+	res := block.ToIPPool(pool)
+	if res.Spec.CIDR != "10.10.0.16/28" || res.Spec.Subnet != pool.Spec.Subnet || res.Spec.Gateway != pool.Spec.Gateway {
+		t.Errorf("unexpected virtual ippool spec %+v", res.Spec)
+	}
+	if res.Length() != 16 || res.Status.Offset != 4 {
+		t.Errorf("expect length 16 and offset 4, real is %d and %d", res.Length(), res.Status.Offset)
+	}
+	for _, ip := range []string{"10.10.0.17", "10.10.0.18", "10.10.0.19"} {
+		if _, ok := res.Status.AllocatedIPs[ip]; !ok {
+			t.Errorf("ip %s should be allocated in virtual ippool", ip)
+		}
+	}
+	if _, ok := res.Status.AllocatedIPs["10.10.0.33"]; ok {
+		t.Errorf("ip 10.10.0.33 out of block shouldn't be in virtual ippool")
+	}
+	if _, ok := block.Status.AllocatedIPs["10.10.0.17"]; ok {
+		t.Errorf("ToIPPool shouldn't modify ipblock status")
+	}
+}
+
+func TestListBlocksLongName(t *testing.T) {
+	pool := strings.Repeat("p", 100)
+	node := strings.Repeat("n", 100)
+	newBlock := func(name, pool, node string) *IPBlock {
+		return &IPBlock{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Labels: BlockLabels(pool, node)},
+			Spec:       IPBlockSpec{Pool: pool, Node: node},
+		}
+	}
+	for _, value := range BlockLabels(pool, node) {
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			t.Errorf("ipblock label %s should be a valid label value, real errs: %v", value, errs)
+		}
+	}
+	k8sClient := newFakeClient(t,
+		newBlock("b2", pool, node),
+		newBlock("b1", pool, node+"2"),
+		newBlock("b3", pool+"2", node),
+	)
+
+	blocks, err := ListBlocks(context.Background(), k8sClient, "ns", pool, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Name != "b1" || blocks[1].Name != "b2" {
+		t.Errorf("expect ipblocks b1 and b2 of the pool, real is %v", blocks)
+	}
+	blocks, err = ListBlocks(context.Background(), k8sClient, "ns", pool, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Name != "b2" {
+		t.Errorf("expect ipblock b2 of the pool and the node, real is %v", blocks)
+	}
+}
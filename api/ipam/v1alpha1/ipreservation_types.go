@@ -0,0 +1,105 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mikioh/ipaddr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// +genclient
+// +k8s:openapi-gen=true
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Pool",type="string",JSONPath=".spec.pool"
+// +kubebuilder:printcolumn:name="Owner",type="string",JSONPath=".spec.owner"
+// +kubebuilder:printcolumn:name="Expire",type="string",JSONPath=".spec.expireTime"
+
+// IPReservation holds ips of an IPPool, the ips won't be allocated dynamically,
+// and can only be allocated as static ip by the owner of the reservation
+type IPReservation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPReservationSpec `json:"spec"`
+}
+
+type IPReservationSpec struct {
+	// Pool is the IPPool name in the same namespace
+	Pool string `json:"pool"`
+	// IPs are reserved ip, cidr or ip range, e.g. 10.0.0.1, 10.0.0.0/30 or 10.0.0.10-10.0.0.20
+	IPs []string `json:"ips"`
+	// Owner is the allocate id which can allocate the reserved ips as static ip, e.g. podns/podname for pod
+	// or statefulsetns/name for statefulset, reserved ips can't be allocated to anyone when empty
+	// +optional
+	Owner string `json:"owner,omitempty"`
+	// ExpireTime is the time when the reservation is invalid and deleted, it never expires when empty
+	// +optional
+	ExpireTime *metav1.Time `json:"expireTime,omitempty"`
+	// Reason describes why the ips are reserved
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IPReservationList contains a list of IPReservation
+type IPReservationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPReservation `json:"items"`
+}
+
+// Expired returns true when the reservation has expired at now
+func (r *IPReservation) Expired(now time.Time) bool {
+	return r.Spec.ExpireTime != nil && !now.Before(r.Spec.ExpireTime.Time)
+}
+
+// MatchOwner returns true when allocate id or owner of a request is the owner of the reservation
+func (r *IPReservation) MatchOwner(id, owner string) bool {
+	if r.Spec.Owner == "" {
+		return false
+	}
+	return r.Spec.Owner == id || r.Spec.Owner == owner
+}
+
+// CIDRs converts spec.ips to cidrs, an ip range is split to the minimal cidrs covering it
+func (r *IPReservation) CIDRs() ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, item := range r.Spec.IPs {
+		switch {
+		case strings.Contains(item, "-"):
+			ips := strings.SplitN(item, "-", 2)
+			start, end := net.ParseIP(strings.TrimSpace(ips[0])), net.ParseIP(strings.TrimSpace(ips[1]))
+			if start == nil || end == nil || utils.IsIPv4(start) != utils.IsIPv4(end) || utils.IPBiggerThan(start, end) {
+				return nil, fmt.Errorf("invalid ip range %s", item)
+			}
+			for _, p := range ipaddr.Summarize(start, end) {
+				ipNet := p.IPNet
+				res = append(res, &ipNet)
+			}
+		case strings.Contains(item, "/"):
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %s, err: %s", item, err)
+			}
+			res = append(res, ipNet)
+		default:
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if utils.IsIPv4(ip) {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return res, nil
+}
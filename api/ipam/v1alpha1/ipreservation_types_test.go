@@ -0,0 +1,98 @@
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPReservationCIDRs(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		exp  []string
+		err  bool
+	}{
+		{
+			name: "single ip",
+			ips:  []string{"10.0.0.1", "fd00::1"},
+			exp:  []string{"10.0.0.1/32", "fd00::1/128"},
+		},
+		{
+			name: "cidr",
+			ips:  []string{"10.0.0.0/30"},
+			exp:  []string{"10.0.0.0/30"},
+		},
+		{
+			name: "ip range",
+			ips:  []string{"10.0.0.3-10.0.0.8"},
+			exp:  []string{"10.0.0.3/32", "10.0.0.4/30", "10.0.0.8/32"},
+		},
+		{
+			name: "reversed ip range",
+			ips:  []string{"10.0.0.8-10.0.0.3"},
+			err:  true,
+		},
+		{
+			name: "mixed family ip range",
+			ips:  []string{"10.0.0.3-fd00::1"},
+			err:  true,
+		},
+		{
+			name: "invalid ip",
+			ips:  []string{"10.0.0.256"},
+			err:  true,
+		},
+	}
+	for _, item := range tests {
+		r := IPReservation{Spec: IPReservationSpec{Pool: "pool", IPs: item.ips}}
+		res, err := r.CIDRs()
+		if (err != nil) != item.err {
+			t.Errorf("test %s expect err %v, real err is %v", item.name, item.err, err)
+			continue
+		}
+		if len(res) != len(item.exp) {
+			t.Errorf("test %s expect %v, real is %v", item.name, item.exp, res)
+			continue
+		}
+		for i := range res {
+			if res[i].String() != item.exp[i] {
+				t.Errorf("test %s expect %v, real is %v", item.name, item.exp, res)
+			}
+		}
+	}
+}
+
+func TestIPReservationExpired(t *testing.T) {
+	now := time.Now()
+	r := IPReservation{}
+	if r.Expired(now) {
+		t.Errorf("reservation without expire time should never expire")
+	}
+	r.Spec.ExpireTime = &metav1.Time{Time: now.Add(time.Minute)}
+	if r.Expired(now) {
+		t.Errorf("reservation shouldn't expire before expire time")
+	}
+	if !r.Expired(now.Add(time.Minute)) {
+		t.Errorf("reservation should expire at expire time")
+	}
+}
+
+func TestIPReservationMatchOwner(t *testing.T) {
+	r := IPReservation{}
+	if r.MatchOwner("ns/pod", "") {
+		t.Errorf("reservation without owner shouldn't match any request")
+	}
+	r.Spec.Owner = "ns/sts"
+	if !r.MatchOwner("ns/sts-0", "ns/sts") {
+		t.Errorf("reservation should match request owner")
+	}
+	r.Spec.Owner = "ns/pod"
+	if !r.MatchOwner("ns/pod", "") {
+		t.Errorf("reservation should match request allocate id")
+	}
+	if r.MatchOwner("ns/pod1", "ns/sts") {
+		t.Errorf("reservation shouldn't match other request")
+	}
+}
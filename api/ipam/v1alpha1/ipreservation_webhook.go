@@ -0,0 +1,76 @@
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+func (r *IPReservation) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	poolsReader = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+var _ admission.Validator = &IPReservation{}
+
+func (r *IPReservation) ValidateCreate() (admission.Warnings, error) {
+	klog.Infof("validate create ipreservation name is %s", client.ObjectKeyFromObject(r))
+	return nil, r.validate()
+}
+
+func (r *IPReservation) ValidateUpdate(_ runtime.Object) (admission.Warnings, error) {
+	klog.Infof("validate update ipreservation name is %s", client.ObjectKeyFromObject(r))
+	return nil, r.validate()
+}
+
+func (r *IPReservation) ValidateDelete() (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (r *IPReservation) validate() error {
+	if err := r.ValidateSpec(); err != nil {
+		klog.Errorf("Invalid ipreservation %s, err: %s", client.ObjectKeyFromObject(r), err)
+		return err
+	}
+
+	pool := IPPool{}
+	if err := poolsReader.Get(context.Background(), types.NamespacedName{Namespace: r.Namespace, Name: r.Spec.Pool}, &pool); err != nil {
+		return fmt.Errorf("err in get ippool %s: %s", r.Spec.Pool, err)
+	}
+	return r.validateInPool(&pool)
+}
+
+// validateInPool checks all reserved ips are in pool
+func (r *IPReservation) validateInPool(pool *IPPool) error {
+	cidrs, _ := r.CIDRs()
+	for _, cidr := range cidrs {
+		if !pool.Contains(cidr.IP) || !pool.Contains(utils.LastIP(cidr)) {
+			return fmt.Errorf("reserved ip %s doesn't in ippool %s", cidr, r.Spec.Pool)
+		}
+	}
+	return nil
+}
+
+// ValidateSpec checks the format of spec, it doesn't check the ippool
+func (r *IPReservation) ValidateSpec() error {
+	if r.Spec.Pool == "" {
+		return fmt.Errorf("must set spec.pool")
+	}
+	if len(r.Spec.IPs) == 0 {
+		return fmt.Errorf("must set spec.ips")
+	}
+	if _, err := r.CIDRs(); err != nil {
+		return fmt.Errorf("invalid spec.ips, err: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package v1alpha1
+
+import (
+	"testing"
+)
+
+func TestIPReservationValidateInPool(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		err  bool
+	}{
+		{
+			name: "single ip",
+			ips:  []string{"10.10.1.130"},
+		},
+		{
+			name: "cidr in pool",
+			ips:  []string{"10.10.1.128/26"},
+		},
+		{
+			name: "ip range in pool",
+			ips:  []string{"10.10.1.130-10.10.1.140"},
+		},
+		{
+			name: "ip out of pool",
+			ips:  []string{"10.10.1.10"},
+			err:  true,
+		},
+		{
+			name: "cidr extends past pool end",
+			ips:  []string{"10.10.1.192/24"},
+			err:  true,
+		},
+		{
+			name: "cidr contains pool",
+			ips:  []string{"10.0.0.0/8"},
+			err:  true,
+		},
+		{
+			name: "ip range extends past pool end",
+			ips:  []string{"10.10.1.250-10.10.2.10"},
+			err:  true,
+		},
+	}
+	pool := newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25")
+	for _, item := range tests {
+		r := IPReservation{Spec: IPReservationSpec{Pool: "pool", IPs: item.ips}}
+		err := r.validateInPool(pool)
+		if (err != nil) != item.err {
+			t.Errorf("test %s expect err %v, real err is %v", item.name, item.err, err)
+		}
+	}
+}
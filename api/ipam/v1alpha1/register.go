@@ -12,6 +12,12 @@ func init() {
 	SchemeBuilder.Register(
 		&IPPool{},
 		&IPPoolList{},
+		&IPBlock{},
+		&IPBlockList{},
+		&IPReservation{},
+		&IPReservationList{},
+		&IPAllocation{},
+		&IPAllocationList{},
 	)
 }
 
@@ -1,9 +1,13 @@
 package v1alpha1
 
 import (
+	"math/big"
 	"net"
+	"sort"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/everoute/ipam/pkg/utils"
 )
@@ -30,10 +34,11 @@ type IPPool struct {
 
 // IPPoolSpec provides the specification of an IPPool
 type IPPoolSpec struct {
-	// CIDR is an IP net string, e.g. 192.168.1.0/24
-	// IP will allocated from CIDR
+	// CIDR is an IP net string, e.g. 192.168.1.0/24 or fd00::/120
+	// IP will allocated from CIDR, only the first 2^63-1 ips of a larger ipv6 CIDR are allocated.
+	// The pattern of ip fields is a coarse check, they are parsed by the webhook
 	//nolint: lll
-	// +kubebuilder:validation:Pattern="^(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\/([1-9]|[1-2]\\d|3[0-2])$"
+	// +kubebuilder:validation:Pattern="^(?:(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\/(?:[1-9]|[1-2]\\d|3[0-2])|(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4}\\/(?:[1-9]|[1-9]\\d|1[01]\\d|12[0-8]))$"
 	// +optional
 	CIDR string `json:"cidr,omitempty"`
 	// Except is IP net string array, e.g. [192.168.1.0/24, 192.168.2.1/32], when allocate ip to Pod, ip in Except won't be allocated
@@ -41,48 +46,176 @@ type IPPoolSpec struct {
 	Except []string `json:"except,omitempty"`
 
 	// Start is the start ip of an ip range, required End
-	// +kubebuilder:validation:Pattern="^(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$"
+	//nolint: lll
+	// +kubebuilder:validation:Pattern="^(?:(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])|(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4})$"
 	// +optional
 	Start string `json:"start,omitempty"`
 
 	// End is the end ip of an ip range, required Start
-	// +kubebuilder:validation:Pattern="^(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$"
+	//nolint: lll
+	// +kubebuilder:validation:Pattern="^(?:(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])|(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4})$"
 	// +optional
 	End string `json:"end,omitempty"`
 
 	// Subnet is the total L2 network,
 	//nolint: lll
-	// +kubebuilder:validation:Pattern="^(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\/([1-9]|[1-2]\\d|3[0-2])$"
+	// +kubebuilder:validation:Pattern="^(?:(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\/(?:[1-9]|[1-2]\\d|3[0-2])|(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4}\\/(?:[1-9]|[1-9]\\d|1[01]\\d|12[0-8]))$"
 	Subnet string `json:"subnet"`
 	// Gateway must a valid IP in Subnet
 	//nolint: lll
-	// +kubebuilder:validation:Pattern="^(((([1]?\\d)?\\d|2[0-4]\\d|25[0-5])\\.){3}(([1]?\\d)?\\d|2[0-4]\\d|25[0-5]))|([\\da-fA-F]{1,4}(\\:[\\da-fA-F]{1,4}){7})|(([\\da-fA-F]{1,4}:){0,5}::([\\da-fA-F]{1,4}:){0,5}[\\da-fA-F]{1,4})$"
+	// +kubebuilder:validation:Pattern="^(?:(?:(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}(?:[0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])|(?:[0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4})$"
 	Gateway string `json:"gateway"`
 	Private bool   `json:"private,omitempty"`
+
+	// BlockSize is the prefix length of IPBlock, e.g. 28, it requires CIDR. When set, each node claims
+	// IPBlocks from the pool and allocates ip to its pods from them instead of the pool status
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=128
+	// +optional
+	BlockSize int32 `json:"blockSize,omitempty"`
+
+	// NamespaceSelector and PodSelector limit the pods which can be allocated ip from the pool automatically,
+	// pools whose selectors match the pod are preferred to pools without selector
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// NodeSelector limits the pool to pods on nodes with matched labels, e.g. topology.kubernetes.io/zone.
+	// When some pools match the node of pod, pools without NodeSelector won't be selected automatically
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// Priority is used by priority pool select policy, pool with higher priority is selected first
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// Weight is used by weight pool select policy, pool is selected randomly in proportion to its weight
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Weight int32 `json:"weight,omitempty"`
+
+	// Routes are static routes returned in cni result, e.g. routes to other subnets of a secondary network
+	// +optional
+	Routes []Route `json:"routes,omitempty"`
+	// DNS is the dns settings returned in cni result
+	// +optional
+	DNS *DNS `json:"dns,omitempty"`
+
+	// ReleaseCooldownSeconds keeps a released ip in quarantine for the seconds before it is allocated dynamically
+	// again, so that stale conntrack, arp and firewall rules of the old pod expire. When the pool would be full
+	// otherwise, the oldest quarantined ip is reused first. Default 0 means no quarantine
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ReleaseCooldownSeconds int32 `json:"releaseCooldownSeconds,omitempty"`
+
+	// AllocationStrategy decides which free ip is allocated dynamically, default is sequential,
+	// status.offset is only used by sequential strategy
+	// +kubebuilder:validation:Enum=sequential;lowest-first;random;highest-first
+	// +optional
+	AllocationStrategy AllocationStrategy `json:"allocationStrategy,omitempty"`
+
+	// NamespaceQuotas cap the number of ips each namespace holds in the pool, the first quota matches the
+	// namespace applies, namespaces matched by no quota are unlimited. It isn't supported in block mode
+	// +optional
+	NamespaceQuotas []NamespaceQuota `json:"namespaceQuotas,omitempty"`
+}
+
+// NamespaceQuota caps the ips held by each namespace in Namespaces or matched by NamespaceSelector,
+// the cap applies to every matched namespace separately
+type NamespaceQuota struct {
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Max is the max number of ips a namespace holds in the pool
+	// +kubebuilder:validation:Minimum=0
+	Max int64 `json:"max"`
+}
+
+type AllocationStrategy string
+
+const (
+	// AllocationStrategySequential allocates ip round-robin from status.offset
+	AllocationStrategySequential AllocationStrategy = "sequential"
+	// AllocationStrategyLowestFirst allocates the lowest free ip
+	AllocationStrategyLowestFirst AllocationStrategy = "lowest-first"
+	// AllocationStrategyRandom allocates a random free ip
+	AllocationStrategyRandom AllocationStrategy = "random"
+	// AllocationStrategyHighestFirst allocates the highest free ip
+	AllocationStrategyHighestFirst AllocationStrategy = "highest-first"
+)
+
+type Route struct {
+	// Dst is the destination network, e.g. 10.0.0.0/8, it must be the same ip family as Subnet
+	Dst string `json:"dst"`
+	// GW is the next hop of the route, it must be in Subnet, default is the default gateway of the interface
+	// +optional
+	GW string `json:"gw,omitempty"`
+}
+
+type DNS struct {
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+	// +optional
+	Domain string `json:"domain,omitempty"`
+	// +optional
+	Search []string `json:"search,omitempty"`
+	// +optional
+	Options []string `json:"options,omitempty"`
 }
 
 // IPPoolStatus describe the current state of the IPPool
 type IPPoolStatus struct {
 	// UsedIps can't delete to compatible with upgrade scenarios
 	UsedIps map[string]string `json:"usedips,omitempty"`
-	// AllocatedIPs is ip and allocated infos
+	// AllocatedIPs is ip and allocated infos, it is kept by old versions and migrated to IPAllocations.
+	// In memory it is filled with IPAllocations of the pool by LoadAllocations
 	AllocatedIPs map[string]AllocateInfo `json:"allocatedips,omitempty"`
 	// Offset stores the current read pointer
 	// -1 means this pool is full
+	// In memory it follows the newest IPAllocation of the pool by LoadAllocations, allocations don't update it
 	Offset         int64 `json:"offset,omitempty"`
 	AllocatedCount int64 `json:"allocated_count,omitempty"`
 	TotalCount     int64 `json:"total_count,omitempty"`
 	AvailableCount int64 `json:"available_count,omitempty"`
+	// BlockAllocatedCount is the number of ip allocated in IPBlocks of the pool
+	BlockAllocatedCount int64 `json:"block_allocated_count,omitempty"`
+	// ReservedCount is the number of unallocated ip held by IPReservations of the pool, they aren't available
+	ReservedCount int64 `json:"reserved_count,omitempty"`
+	// QuarantinedIPs is released ip and the release time, the ip isn't allocated dynamically
+	// until spec.releaseCooldownSeconds passes
+	QuarantinedIPs map[string]metav1.Time `json:"quarantinedips,omitempty"`
+	// RetainedIPs is ip released by a pod with sticky ip and the time until which it is retained, the allocation
+	// of the ip is kept, a pod with the same namespace and name gets the ip back before the time
+	RetainedIPs map[string]metav1.Time `json:"retainedips,omitempty"`
+	// NamespaceUsage is the number of ips held by each namespace, it is only counted when spec.namespaceQuotas is set
+	NamespaceUsage map[string]int64 `json:"namespaceusage,omitempty"`
 }
 
 type AllocateInfo struct {
 	// Type=pod, ID=podns/name
+	// Type=vm, ID=vmns/name
 	ID string `json:"id"`
 	// Type=pod, CID=containerID
 	CID  string       `json:"cid,omitempty"`
 	Type AllocateType `json:"type"`
 	// Type=statefulset, owner=statefulsetns/name
+	// Type=owner, owner=ownerns/name
+	// Type=vm, owner=vmns/name
 	Owner string `json:"owner,omitempty"`
+	// Type=owner, ownerkind=apiVersion/kind of the owner, e.g. apps/v1/Deployment
+	OwnerKind string `json:"ownerkind,omitempty"`
+	// IfName is the interface name of the cni request, a pod with multiple interfaces has an ip for each
+	// interface, it is empty for allocations without interface name
+	IfName string `json:"ifname,omitempty"`
+}
+
+// Namespace returns the namespace of the pod or its owner which holds the ip, it is empty for type cniused
+func (a AllocateInfo) Namespace() string {
+	if a.Type == AllocateTypeCNIUsed {
+		return ""
+	}
+	return utils.GetPodNsNameByAllocateID(a.ID).Namespace
 }
 
 type AllocateType string
@@ -91,6 +224,23 @@ const (
 	AllocateTypeCNIUsed     AllocateType = "cniused"
 	AllocateTypePod         AllocateType = "pod"
 	AllocateTypeStatefulSet AllocateType = "statefulset"
+	// AllocateTypeOwner is ip in the ip list of a pod owner other than statefulset, e.g. Deployment
+	AllocateTypeOwner AllocateType = "owner"
+	// AllocateTypeVM is ip of a KubeVirt virtual machine, it is shared by the virt-launcher pods of the vm
+	AllocateTypeVM AllocateType = "vm"
+)
+
+// HeldByOwner returns true when the ip is held by the owner of the pod, e.g. statefulset or virtual machine,
+// it isn't released when the pod is deleted
+func (t AllocateType) HeldByOwner() bool {
+	return t == AllocateTypeStatefulSet || t == AllocateTypeOwner || t == AllocateTypeVM
+}
+
+type IPFamily string
+
+const (
+	IPFamilyIPv4 IPFamily = "ipv4"
+	IPFamilyIPv6 IPFamily = "ipv6"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -102,6 +252,47 @@ type IPPoolList struct {
 	Items           []IPPool `json:"items"`
 }
 
+// IPFamily returns the ip family of the IPPool subnet
+func (r *IPPool) IPFamily() IPFamily {
+	_, subnet, err := net.ParseCIDR(r.Spec.Subnet)
+	if err == nil && !utils.IsIPv4(subnet.IP) {
+		return IPFamilyIPv6
+	}
+	return IPFamilyIPv4
+}
+
+// HasPodSelector returns true when spec.namespaceSelector or spec.podSelector is set
+func (r *IPPool) HasPodSelector() bool {
+	return r.Spec.NamespaceSelector != nil || r.Spec.PodSelector != nil
+}
+
+// MatchPod returns whether pod with podLabels in namespace with nsLabels matches the selectors of the pool,
+// nil selector matches everything and invalid selector matches nothing
+func (r *IPPool) MatchPod(podLabels, nsLabels map[string]string) bool {
+	return matchLabelSelector(r.Spec.NamespaceSelector, nsLabels) && matchLabelSelector(r.Spec.PodSelector, podLabels)
+}
+
+func matchLabelSelector(selector *metav1.LabelSelector, l map[string]string) bool {
+	if selector == nil {
+		return true
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false
+	}
+	return s.Matches(labels.Set(l))
+}
+
+// MatchNode returns whether node with nodeLabels matches spec.nodeSelector, nil selector matches everything
+func (r *IPPool) MatchNode(nodeLabels map[string]string) bool {
+	return matchLabelSelector(r.Spec.NodeSelector, nodeLabels)
+}
+
+// BlockMode returns true when ip is allocated from per-node IPBlocks
+func (r *IPPool) BlockMode() bool {
+	return r.Spec.BlockSize != 0
+}
+
 func (r *IPPool) StartIP() net.IP {
 	if r.Spec.Start != "" {
 		return net.ParseIP(r.Spec.Start)
@@ -120,32 +311,158 @@ func (r *IPPool) EndIP() net.IP {
 	return utils.LastIP(ipNet)
 }
 
+// Length returns the number of ips between StartIP and EndIP, it saturates at math.MaxInt64 for huge ipv6 pools,
+// offsets in status and the allocator are int64, so the webhook rejects such pools
 func (r *IPPool) Length() int64 {
-	if r.Spec.CIDR != "" {
-		_, ipNet, _ := net.ParseCIDR(r.Spec.CIDR)
-		ones, bits := ipNet.Mask.Size()
-		hostBits := bits - ones
-		return 1 << hostBits
-	}
+	return utils.SaturatedInt64(r.bigLength())
+}
 
-	return int64(utils.Ipv4ToUint32(net.ParseIP(r.Spec.End)) - utils.Ipv4ToUint32(net.ParseIP(r.Spec.Start)) + 1)
+// Truncated returns true when the pool has more ips than Length(), e.g. an ipv6 /64, such pools can't be
+// addressed by int64 offsets
+func (r *IPPool) Truncated() bool {
+	return !r.bigLength().IsInt64()
+}
+
+func (r *IPPool) bigLength() *big.Int {
+	n := utils.IPToBigInt(r.EndIP())
+	n.Sub(n, utils.IPToBigInt(r.StartIP()))
+	return n.Add(n, big.NewInt(1))
 }
 
 func (r *IPPool) UpdateIPUsageCounter() {
-	r.Status.AllocatedCount = int64(len(r.Status.AllocatedIPs) + len(r.Status.UsedIps))
-	if cnt := r.Status.TotalCount - r.Status.AllocatedCount; cnt >= 0 {
+	r.Status.AllocatedCount = int64(len(r.Status.AllocatedIPs)+len(r.Status.UsedIps)) + r.Status.BlockAllocatedCount
+	if cnt := r.Status.TotalCount - r.Status.AllocatedCount - r.Status.ReservedCount; cnt >= 0 {
 		r.Status.AvailableCount = cnt
 	}
+
+	r.Status.NamespaceUsage = nil
+	if len(r.Spec.NamespaceQuotas) == 0 {
+		return
+	}
+	for _, a := range r.Status.AllocatedIPs {
+		ns := a.Namespace()
+		if ns == "" {
+			continue
+		}
+		if r.Status.NamespaceUsage == nil {
+			r.Status.NamespaceUsage = make(map[string]int64)
+		}
+		r.Status.NamespaceUsage[ns]++
+	}
+}
+
+// NamespaceQuota returns the max number of ips namespace ns with nsLabels holds in the pool,
+// false means the namespace isn't limited
+func (r *IPPool) NamespaceQuota(ns string, nsLabels map[string]string) (int64, bool) {
+	for i := range r.Spec.NamespaceQuotas {
+		q := &r.Spec.NamespaceQuotas[i]
+		for _, n := range q.Namespaces {
+			if n == ns {
+				return q.Max, true
+			}
+		}
+		if q.NamespaceSelector != nil && matchLabelSelector(q.NamespaceSelector, nsLabels) {
+			return q.Max, true
+		}
+	}
+	return 0, false
+}
+
+// NamespaceIPCount returns the number of ips held by namespace ns in status.allocatedIPs
+func (r *IPPool) NamespaceIPCount(ns string) int64 {
+	var cnt int64
+	for _, a := range r.Status.AllocatedIPs {
+		if a.Namespace() == ns {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Quarantine puts the released ip into quarantine when spec.releaseCooldownSeconds is set
+func (r *IPPool) Quarantine(ip string, now time.Time) {
+	if r.Spec.ReleaseCooldownSeconds <= 0 {
+		return
+	}
+	if r.Status.QuarantinedIPs == nil {
+		r.Status.QuarantinedIPs = make(map[string]metav1.Time)
+	}
+	r.Status.QuarantinedIPs[ip] = metav1.NewTime(now)
+}
+
+// InQuarantine returns true when ip is released less than spec.releaseCooldownSeconds before now
+func (r *IPPool) InQuarantine(ip string, now time.Time) bool {
+	t, ok := r.Status.QuarantinedIPs[ip]
+	return ok && now.Before(t.Add(time.Duration(r.Spec.ReleaseCooldownSeconds)*time.Second))
+}
+
+// CleanQuarantine removes ips whose cooldown has passed from quarantine, ips allocated again are removed too,
+// allocations don't update the pool status
+func (r *IPPool) CleanQuarantine(now time.Time) {
+	for ip := range r.Status.QuarantinedIPs {
+		_, allocated := r.Status.AllocatedIPs[ip]
+		if allocated || !r.InQuarantine(ip, now) {
+			delete(r.Status.QuarantinedIPs, ip)
+		}
+	}
+	if len(r.Status.QuarantinedIPs) == 0 {
+		r.Status.QuarantinedIPs = nil
+	}
+}
+
+// QuarantinedIPsByAge returns ips in quarantine at now, the earliest released one is the first
+func (r *IPPool) QuarantinedIPsByAge(now time.Time) []string {
+	res := []string{}
+	for ip := range r.Status.QuarantinedIPs {
+		if r.InQuarantine(ip, now) {
+			res = append(res, ip)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		ti, tj := r.Status.QuarantinedIPs[res[i]], r.Status.QuarantinedIPs[res[j]]
+		if ti.Equal(&tj) {
+			return res[i] < res[j]
+		}
+		return ti.Before(&tj)
+	})
+	return res
+}
+
+// Retain keeps the allocation of the released ip for the pod until the time until
+func (r *IPPool) Retain(ip string, until time.Time) {
+	if r.Status.RetainedIPs == nil {
+		r.Status.RetainedIPs = make(map[string]metav1.Time)
+	}
+	r.Status.RetainedIPs[ip] = metav1.NewTime(until)
+}
+
+// Retained returns true when the allocation of ip is retained at now
+func (r *IPPool) Retained(ip string, now time.Time) bool {
+	t, ok := r.Status.RetainedIPs[ip]
+	return ok && now.Before(t.Time)
+}
+
+// CleanRetention removes retained ips which are no longer allocated
+func (r *IPPool) CleanRetention() {
+	for ip := range r.Status.RetainedIPs {
+		if _, ok := r.Status.AllocatedIPs[ip]; !ok {
+			delete(r.Status.RetainedIPs, ip)
+		}
+	}
+	if len(r.Status.RetainedIPs) == 0 {
+		r.Status.RetainedIPs = nil
+	}
 }
 
 func (r *IPPool) Contains(ip net.IP) bool {
-	startIPN := utils.Ipv4ToUint32(r.StartIP())
-	endIPN := utils.Ipv4ToUint32(r.EndIP())
-	ipN := utils.Ipv4ToUint32(ip)
-	if ipN < startIPN {
+	startIP := r.StartIP()
+	if utils.IsIPv4(ip) != utils.IsIPv4(startIP) {
+		return false
+	}
+	if utils.CompareIP(ip, startIP) < 0 {
 		return false
 	}
-	if ipN > endIPN {
+	if utils.IPBiggerThan(ip, r.EndIP()) {
 		return false
 	}
 
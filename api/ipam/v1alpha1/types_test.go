@@ -1,8 +1,11 @@
 package v1alpha1
 
 import (
+	"math"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -48,6 +51,11 @@ func TestEndIP(t *testing.T) {
 			pool: newIPPool("10.10.10.0/16", "10.10.10.1", "", "", "10.10.10.0/24"),
 			exp:  net.ParseIP("10.10.10.255"),
 		},
+		{
+			name: "ipv6 cidr",
+			pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::1:0/112"),
+			exp:  net.ParseIP("fd00::1:ffff"),
+		},
 	}
 	for i := range tests {
 		res := tests[i].pool.EndIP()
@@ -95,6 +103,21 @@ func TestLength(t *testing.T) {
 			pool: newIPPool("10.10.1.0/16", "10.10.1.1", "", "", "10.10.2.0/25", "10.10.2.45/32"),
 			exp: 128,
 		},
+		{
+			name: "ipv6 start end",
+			pool: newIPPool("fd00::/64", "fd00::1", "fd00::1:0", "fd00::2:ff", ""),
+			exp: 65792,
+		},
+		{
+			name: "ipv6 cidr",
+			pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::/112"),
+			exp: 65536,
+		},
+		{
+			name: "ipv6 cidr overflow int64",
+			pool: newIPPool("fd00::/48", "fd00::1", "", "", "fd00::/64"),
+			exp: math.MaxInt64,
+		},
 	}
 
 	for i := range tests {
@@ -136,6 +159,24 @@ func TestContains(t *testing.T) {
 			ip: net.ParseIP("10.10.3.61"),
 			exp: false,
 		},
+		{
+			name: "ip in ipv6 cidr ippool",
+			pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::100/120", "fd00::1ff/128"),
+			ip: net.ParseIP("fd00::1fe"),
+			exp: true,
+		},
+		{
+			name: "ip not in ipv6 start-end ippool",
+			pool: newIPPool("fd00::/64", "fd00::1", "fd00::10", "fd00::20", ""),
+			ip: net.ParseIP("fd00::21"),
+			exp: false,
+		},
+		{
+			name: "ipv4 ip in ipv6 ippool",
+			pool: newIPPool("::/96", "::1", "", "", "::/112"),
+			ip: net.ParseIP("0.0.0.10"),
+			exp: false,
+		},
 		{
 			name: "ip in except", 
 			pool: newIPPool("10.10.1.1/16", "10.10.1.1", "", "", "10.10.2.0/25", "10.10.2.65/31", "10.10.1.36/26"),
@@ -150,3 +191,106 @@ func TestContains(t *testing.T) {
 		}
 	}
 }
+
+func TestQuarantine(t *testing.T) {
+	now := time.Now()
+	pool := newIPPool("10.10.0.0/24", "10.10.0.1", "", "", "10.10.0.0/24")
+	pool.Quarantine("10.10.0.2", now)
+	if len(pool.Status.QuarantinedIPs) != 0 {
+		t.Errorf("pool without release cooldown shouldn't quarantine ip")
+	}
+
+	pool.Spec.ReleaseCooldownSeconds = 60
+	pool.Quarantine("10.10.0.2", now.Add(-90*time.Second))
+	pool.Quarantine("10.10.0.3", now.Add(-10*time.Second))
+	pool.Quarantine("10.10.0.4", now.Add(-30*time.Second))
+	if pool.InQuarantine("10.10.0.2", now) || !pool.InQuarantine("10.10.0.3", now) {
+		t.Errorf("unexpected quarantine state %v", pool.Status.QuarantinedIPs)
+	}
+	if res := pool.QuarantinedIPsByAge(now); len(res) != 2 || res[0] != "10.10.0.4" || res[1] != "10.10.0.3" {
+		t.Errorf("expect quarantined ips [10.10.0.4 10.10.0.3], real is %v", res)
+	}
+	pool.CleanQuarantine(now)
+	if _, ok := pool.Status.QuarantinedIPs["10.10.0.2"]; ok || len(pool.Status.QuarantinedIPs) != 2 {
+		t.Errorf("expired ip should be removed from quarantine, real is %v", pool.Status.QuarantinedIPs)
+	}
+	pool.Status.AllocatedIPs = map[string]AllocateInfo{"10.10.0.3": {Type: AllocateTypePod, ID: "ns/pod"}}
+	pool.CleanQuarantine(now)
+	if _, ok := pool.Status.QuarantinedIPs["10.10.0.3"]; ok || len(pool.Status.QuarantinedIPs) != 1 {
+		t.Errorf("allocated ip should be removed from quarantine, real is %v", pool.Status.QuarantinedIPs)
+	}
+	pool.CleanQuarantine(now.Add(time.Minute))
+	if pool.Status.QuarantinedIPs != nil {
+		t.Errorf("all ips should be removed from quarantine, real is %v", pool.Status.QuarantinedIPs)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+	pool := newIPPool("10.10.0.0/24", "10.10.0.1", "", "", "10.10.0.0/24")
+	pool.Status.AllocatedIPs = map[string]AllocateInfo{
+		"10.10.0.2": {Type: AllocateTypePod, ID: "ns/pod1"},
+		"10.10.0.3": {Type: AllocateTypePod, ID: "ns/pod2"},
+	}
+	pool.Retain("10.10.0.2", now.Add(time.Minute))
+	pool.Retain("10.10.0.3", now.Add(-time.Second))
+	if !pool.Retained("10.10.0.2", now) || pool.Retained("10.10.0.3", now) || pool.Retained("10.10.0.4", now) {
+		t.Errorf("unexpected retention state %v", pool.Status.RetainedIPs)
+	}
+
+	pool.CleanRetention()
+	if len(pool.Status.RetainedIPs) != 2 {
+		t.Errorf("retention of allocated ip shouldn't be removed, real is %v", pool.Status.RetainedIPs)
+	}
+	delete(pool.Status.AllocatedIPs, "10.10.0.2")
+	delete(pool.Status.AllocatedIPs, "10.10.0.3")
+	pool.CleanRetention()
+	if pool.Status.RetainedIPs != nil {
+		t.Errorf("retention of released ip should be removed, real is %v", pool.Status.RetainedIPs)
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	pool := newIPPool("10.10.0.0/24", "10.10.0.1", "", "", "10.10.0.0/24")
+	pool.Spec.NamespaceQuotas = []NamespaceQuota{
+		{Namespaces: []string{"ns1"}, Max: 1},
+		{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}, Max: 2},
+	}
+	pool.Status.AllocatedIPs = map[string]AllocateInfo{
+		"10.10.0.2": {Type: AllocateTypePod, ID: "ns1/pod1"},
+		"10.10.0.3": {Type: AllocateTypeStatefulSet, ID: "ns1/sts-0", Owner: "ns1/sts"},
+		"10.10.0.4": {Type: AllocateTypeVM, ID: "ns2/vm1", Owner: "ns2/vm1"},
+		"10.10.0.5": {Type: AllocateTypeCNIUsed, ID: "cid"},
+	}
+
+	tests := []struct {
+		ns      string
+		labels  map[string]string
+		limited bool
+		limit   int64
+	}{
+		{ns: "ns1", labels: map[string]string{"tenant": "a"}, limited: true, limit: 1},
+		{ns: "ns2", labels: map[string]string{"tenant": "a"}, limited: true, limit: 2},
+		{ns: "ns2", labels: map[string]string{"tenant": "b"}},
+		{ns: "ns3"},
+	}
+	for _, item := range tests {
+		limit, ok := pool.NamespaceQuota(item.ns, item.labels)
+		if ok != item.limited || limit != item.limit {
+			t.Errorf("namespace %s with labels %v expect quota %d %v, real is %d %v", item.ns, item.labels, item.limit, item.limited, limit, ok)
+		}
+	}
+
+	if cnt := pool.NamespaceIPCount("ns1"); cnt != 2 {
+		t.Errorf("namespace ns1 expect 2 ips, real is %d", cnt)
+	}
+	pool.UpdateIPUsageCounter()
+	if !reflect.DeepEqual(pool.Status.NamespaceUsage, map[string]int64{"ns1": 2, "ns2": 1}) {
+		t.Errorf("unexpected namespace usage %v", pool.Status.NamespaceUsage)
+	}
+	pool.Spec.NamespaceQuotas = nil
+	pool.UpdateIPUsageCounter()
+	if pool.Status.NamespaceUsage != nil {
+		t.Errorf("namespace usage should be nil without quota, real is %v", pool.Status.NamespaceUsage)
+	}
+}
@@ -3,9 +3,11 @@ package v1alpha1
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
 	"reflect"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -61,6 +63,9 @@ func (r *IPPool) ValidateUpdate(old runtime.Object) (admission.Warnings, error)
 		return nil, err
 	}
 
+	if _, err := LoadAllocations(context.Background(), poolsReader, r); err != nil {
+		return nil, err
+	}
 	if err := v.ValidateAllocateIPs(); err != nil {
 		klog.Errorf("IPPool %s must contains all allocate ip when update, err: %s", poolKeys, err)
 		return nil, err
@@ -76,9 +81,23 @@ func (r *IPPool) ValidateUpdate(old runtime.Object) (admission.Warnings, error)
 
 func (r *IPPool) ValidateDelete() (admission.Warnings, error) {
 	klog.Infoln("validate delete ippool name is ", r.Namespace+`/`+r.Name)
+	if _, err := LoadAllocations(context.Background(), poolsReader, r); err != nil {
+		return nil, err
+	}
 	if len(r.Status.AllocatedIPs) != 0 || len(r.Status.UsedIps) != 0 {
 		return nil, fmt.Errorf("IPPool has allocated IP, can't delete")
 	}
+	if r.BlockMode() {
+		blocks, err := ListBlocks(context.Background(), poolsReader, r.Namespace, r.Name, "")
+		if err != nil {
+			return nil, fmt.Errorf("err in list ipblocks: %s", err.Error())
+		}
+		for i := range blocks {
+			if len(blocks[i].Status.AllocatedIPs) != 0 {
+				return nil, fmt.Errorf("IPPool has allocated IP in IPBlock %s, can't delete", blocks[i].Name)
+			}
+		}
+	}
 	_ = ValidatePool(IPPoolList{Items: []IPPool{}}, IPPool{}, r.Namespace+`/`+r.Name)
 	return nil, nil
 }
@@ -109,6 +128,7 @@ func (r *IPPoolValidator) ValidateSpec(oldIPPool *IPPool) error {
 	if gateway.Equal(subnet.IP) {
 		return fmt.Errorf("gateway %s can't be subnet %s network number", r.Spec.Gateway, r.Spec.Subnet)
 	}
+	isIPv4 := utils.IsIPv4(subnet.IP)
 
 	if r.Spec.CIDR != "" {
 		if r.Spec.Start != "" {
@@ -119,10 +139,13 @@ func (r *IPPoolValidator) ValidateSpec(oldIPPool *IPPool) error {
 			return fmt.Errorf("can't set spec.cidr and spec.end at the same time")
 		}
 
-		_, _, err := net.ParseCIDR(r.Spec.CIDR)
+		cidrIP, _, err := net.ParseCIDR(r.Spec.CIDR)
 		if err != nil {
 			return fmt.Errorf("parse ippool cidr %s failed, err: %s", r.Spec.CIDR, err)
 		}
+		if utils.IsIPv4(cidrIP) != isIPv4 {
+			return fmt.Errorf("ippool cidr %s and subnet %s must be the same ip family", r.Spec.CIDR, r.Spec.Subnet)
+		}
 
 		for i := range r.Spec.Except {
 			if _, _, err := net.ParseCIDR(r.Spec.Except[i]); err != nil {
@@ -136,12 +159,15 @@ func (r *IPPoolValidator) ValidateSpec(oldIPPool *IPPool) error {
 
 		if r.Spec.Start != "" && r.Spec.End != "" {
 			startIP := net.ParseIP(r.Spec.Start)
-			if startIP == nil || startIP.To4() == nil {
-				return fmt.Errorf("invalid start ipv4 %s", r.Spec.Start)
+			if startIP == nil {
+				return fmt.Errorf("invalid start ip %s", r.Spec.Start)
 			}
 			endIP := net.ParseIP(r.Spec.End)
-			if endIP == nil || endIP.To4() == nil {
-				return fmt.Errorf("invalid end ipv4 %s", r.Spec.End)
+			if endIP == nil {
+				return fmt.Errorf("invalid end ip %s", r.Spec.End)
+			}
+			if utils.IsIPv4(startIP) != isIPv4 || utils.IsIPv4(endIP) != isIPv4 {
+				return fmt.Errorf("start ip %s, end ip %s and subnet %s must be the same ip family", r.Spec.Start, r.Spec.End, r.Spec.Subnet)
 			}
 
 			if utils.IPBiggerThan(startIP, endIP) {
@@ -155,6 +181,26 @@ func (r *IPPoolValidator) ValidateSpec(oldIPPool *IPPool) error {
 	if !subnet.Contains(r.StartIP()) || !subnet.Contains(r.EndIP()) {
 		return fmt.Errorf("ippool's ip must all in subnet %s", r.Spec.Subnet)
 	}
+	// offsets of ips in the allocator and status are int64
+	if r.Truncated() {
+		return fmt.Errorf("ippool can't have more than %d ips, use a smaller spec.cidr or spec.start and spec.end", int64(math.MaxInt64))
+	}
+
+	if err := r.validateBlockSize(oldIPPool); err != nil {
+		return err
+	}
+	if err := r.validateSelectors(); err != nil {
+		return err
+	}
+	if err := r.validateRoutesAndDNS(subnet); err != nil {
+		return err
+	}
+	if err := r.validateAllocationStrategy(); err != nil {
+		return err
+	}
+	if err := r.validateNamespaceQuotas(); err != nil {
+		return err
+	}
 
 	if oldIPPool != nil {
 		poolKeys := client.ObjectKeyFromObject(r).String()
@@ -168,6 +214,97 @@ func (r *IPPoolValidator) ValidateSpec(oldIPPool *IPPool) error {
 	return nil
 }
 
+func (r *IPPoolValidator) validateBlockSize(oldIPPool *IPPool) error {
+	if oldIPPool != nil && r.Spec.BlockSize != oldIPPool.Spec.BlockSize {
+		return fmt.Errorf("can't modify IPPool spec.blockSize from %d to %d", oldIPPool.Spec.BlockSize, r.Spec.BlockSize)
+	}
+	if !r.BlockMode() {
+		return nil
+	}
+	if r.Spec.CIDR == "" {
+		return fmt.Errorf("must set spec.cidr when set spec.blockSize")
+	}
+	_, ipNet, _ := net.ParseCIDR(r.Spec.CIDR)
+	ones, bits := ipNet.Mask.Size()
+	if int(r.Spec.BlockSize) < ones || int(r.Spec.BlockSize) > bits {
+		return fmt.Errorf("spec.blockSize %d must be in [%d, %d] for spec.cidr %s", r.Spec.BlockSize, ones, bits, r.Spec.CIDR)
+	}
+	return nil
+}
+
+func (r *IPPoolValidator) validateSelectors() error {
+	if _, err := metav1.LabelSelectorAsSelector(r.Spec.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid spec.namespaceSelector, err: %s", err)
+	}
+	if _, err := metav1.LabelSelectorAsSelector(r.Spec.PodSelector); err != nil {
+		return fmt.Errorf("invalid spec.podSelector, err: %s", err)
+	}
+	if _, err := metav1.LabelSelectorAsSelector(r.Spec.NodeSelector); err != nil {
+		return fmt.Errorf("invalid spec.nodeSelector, err: %s", err)
+	}
+	return nil
+}
+
+func (r *IPPoolValidator) validateAllocationStrategy() error {
+	switch r.Spec.AllocationStrategy {
+	case "", AllocationStrategySequential, AllocationStrategyLowestFirst, AllocationStrategyRandom, AllocationStrategyHighestFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown spec.allocationStrategy %s", r.Spec.AllocationStrategy)
+}
+
+func (r *IPPoolValidator) validateNamespaceQuotas() error {
+	if len(r.Spec.NamespaceQuotas) > 0 && r.BlockMode() {
+		return fmt.Errorf("spec.namespaceQuotas isn't supported when set spec.blockSize")
+	}
+	for i := range r.Spec.NamespaceQuotas {
+		q := &r.Spec.NamespaceQuotas[i]
+		if len(q.Namespaces) == 0 && q.NamespaceSelector == nil {
+			return fmt.Errorf("spec.namespaceQuotas[%d] must set namespaces or namespaceSelector", i)
+		}
+		if _, err := metav1.LabelSelectorAsSelector(q.NamespaceSelector); err != nil {
+			return fmt.Errorf("invalid spec.namespaceQuotas[%d].namespaceSelector, err: %s", i, err)
+		}
+		if q.Max < 0 {
+			return fmt.Errorf("spec.namespaceQuotas[%d].max %d can't be negative", i, q.Max)
+		}
+	}
+	return nil
+}
+
+func (r *IPPoolValidator) validateRoutesAndDNS(subnet *net.IPNet) error {
+	isIPv4 := utils.IsIPv4(subnet.IP)
+	for _, route := range r.Spec.Routes {
+		dstIP, _, err := net.ParseCIDR(route.Dst)
+		if err != nil {
+			return fmt.Errorf("parse spec.routes dst %s failed, err: %s", route.Dst, err)
+		}
+		if utils.IsIPv4(dstIP) != isIPv4 {
+			return fmt.Errorf("spec.routes dst %s and subnet %s must be the same ip family", route.Dst, r.Spec.Subnet)
+		}
+		if route.GW == "" {
+			continue
+		}
+		gw := net.ParseIP(route.GW)
+		if gw == nil {
+			return fmt.Errorf("invalid spec.routes gw %s", route.GW)
+		}
+		if !subnet.Contains(gw) {
+			return fmt.Errorf("spec.routes gw %s doesn't in subnet %s", route.GW, r.Spec.Subnet)
+		}
+	}
+
+	if r.Spec.DNS == nil {
+		return nil
+	}
+	for _, ns := range r.Spec.DNS.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid spec.dns nameserver %s", ns)
+		}
+	}
+	return nil
+}
+
 func (r *IPPoolValidator) ValidateAllocateIPs() error {
 	if len(r.Status.AllocatedIPs) == 0 && len(r.Status.UsedIps) == 0 {
 		return nil
@@ -228,42 +365,41 @@ func (r *IPPoolValidator) validateAllocateIPsForIPBlock() error {
 	return nil
 }
 
-//nolint:gocognit
 func (r *IPPoolValidator) validateAllocateIPsForStartEnd() error {
 	if r.Spec.Start == "" {
 		return nil
 	}
 
 	startIP := net.ParseIP(r.Spec.Start)
-	if startIP == nil || startIP.To4() == nil {
-		return fmt.Errorf("invalid ippool start ipv4 %s", r.Spec.Start)
+	if startIP == nil {
+		return fmt.Errorf("invalid ippool start ip %s", r.Spec.Start)
 	}
-	startIPn := utils.Ipv4ToUint32(startIP)
 
 	endIP := net.ParseIP(r.Spec.End)
-	if endIP == nil || endIP.To4() == nil {
-		return fmt.Errorf("invalid ippool end ipv4 %s", r.Spec.End)
+	if endIP == nil {
+		return fmt.Errorf("invalid ippool end ip %s", r.Spec.End)
+	}
+
+	inRange := func(ip net.IP) bool {
+		return utils.IsIPv4(ip) == utils.IsIPv4(startIP) && utils.CompareIP(ip, startIP) >= 0 && utils.CompareIP(ip, endIP) <= 0
 	}
-	endIPn := utils.Ipv4ToUint32(endIP)
 
 	for k := range r.Status.AllocatedIPs {
 		ip := net.ParseIP(k)
-		if ip == nil || ip.To4() == nil {
-			return fmt.Errorf("invalid allocate ipv4 %s", k)
+		if ip == nil {
+			return fmt.Errorf("invalid allocate ip %s", k)
 		}
-		ipn := utils.Ipv4ToUint32(ip)
-		if ipn < startIPn || ipn > endIPn {
+		if !inRange(ip) {
 			return fmt.Errorf("ippool must contain has been allocated ip %s", k)
 		}
 	}
 
 	for k := range r.Status.UsedIps {
 		ip := net.ParseIP(k)
-		if ip == nil || ip.To4() == nil {
-			return fmt.Errorf("invalid allocate ipv4 %s", k)
+		if ip == nil {
+			return fmt.Errorf("invalid allocate ip %s", k)
 		}
-		ipn := utils.Ipv4ToUint32(ip)
-		if ipn < startIPn || ipn > endIPn {
+		if !inRange(ip) {
 			return fmt.Errorf("ippool must contain has been allocated ip %s", k)
 		}
 	}
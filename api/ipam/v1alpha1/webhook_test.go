@@ -3,7 +3,10 @@ package v1alpha1
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestValidSpec(t *testing.T) {
@@ -33,6 +36,16 @@ func TestValidSpec(t *testing.T) {
 			pool: newIPPool("10.10.1.0/24", "10.10.1.5", "10.10.1.125", "10.10.1.125", ""),
 			exp:  nil,
 		},
+		{
+			name: "valid for ipv6 cidr",
+			pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::100/120", "fd00::1ff/128"),
+			exp:  nil,
+		},
+		{
+			name: "valid for ipv6 start end",
+			pool: newIPPool("fd00::/64", "fd00::1", "fd00::10", "fd00::ffff", ""),
+			exp:  nil,
+		},
 
 		// format err
 		{
@@ -56,14 +69,34 @@ func TestValidSpec(t *testing.T) {
 			exp:  fmt.Errorf("parse spec.except %s, err: %s", "10.10.1.192/300", &net.ParseError{Type: "CIDR address", Text: "10.10.1.192/300"}),
 		},
 		{
-			name: "start is not a valid ipv4",
+			name: "start is not a valid ip",
 			pool: newIPPool("10.10.1.0/24", "10.10.1.5", "10.10.1.", "10.10.1.125", ""),
-			exp:  fmt.Errorf("invalid start ipv4 %s", "10.10.1."),
+			exp:  fmt.Errorf("invalid start ip %s", "10.10.1."),
 		},
 		{
-			name: "end is not a valid ipv4",
+			name: "end is not a valid ip",
 			pool: newIPPool("10.10.1.0/24", "10.10.1.5", "10.10.1.123", "10.10.1::125", ""),
-			exp:  fmt.Errorf("invalid end ipv4 %s", "10.10.1::125"),
+			exp:  fmt.Errorf("invalid end ip %s", "10.10.1::125"),
+		},
+		{
+			name: "subnet is not valid ipv6 net",
+			pool: newIPPool("::::::/64", "fd00::1", "", "", "fd00::/120"),
+			exp:  fmt.Errorf("failed to parse subnet %s, err: %s", "::::::/64", &net.ParseError{Type: "CIDR address", Text: "::::::/64"}),
+		},
+		{
+			name: "gateway is not a valid ipv6",
+			pool: newIPPool("fd00::/64", "fd00:::1", "", "", "fd00::/120"),
+			exp:  fmt.Errorf("invalid ippool gateway %s", "fd00:::1"),
+		},
+		{
+			name: "cidr is not valid ipv6 net",
+			pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::::/120"),
+			exp:  fmt.Errorf("parse ippool cidr %s failed, err: %s", "fd00::::/120", &net.ParseError{Type: "CIDR address", Text: "fd00::::/120"}),
+		},
+		{
+			name: "start is not a valid ipv6",
+			pool: newIPPool("fd00::/64", "fd00::1", ":::::", "fd00::ff", ""),
+			exp:  fmt.Errorf("invalid start ip %s", ":::::"),
 		},
 
 		// optional err
@@ -135,6 +168,18 @@ func TestValidSpec(t *testing.T) {
 			exp:  fmt.Errorf("ippool's ip must all in subnet %s", "10.10.1.0/24"),
 		},
 
+		// ip family
+		{
+			name: "cidr and subnet are different ip family",
+			pool: newIPPool("10.10.1.0/24", "10.10.1.5", "", "", "fd00::/120"),
+			exp:  fmt.Errorf("ippool cidr %s and subnet %s must be the same ip family", "fd00::/120", "10.10.1.0/24"),
+		},
+		{
+			name: "start end and subnet are different ip family",
+			pool: newIPPool("fd00::/64", "fd00::1", "10.10.1.2", "10.10.1.8", ""),
+			exp:  fmt.Errorf("start ip %s, end ip %s and subnet %s must be the same ip family", "10.10.1.2", "10.10.1.8", "fd00::/64"),
+		},
+
 		// start end
 		{
 			name: "start ip must litter or equal with end ip",
@@ -157,6 +202,158 @@ func TestValidSpec(t *testing.T) {
 	}
 }
 
+func TestValidateBlockSize(t *testing.T) {
+	withBlockSize := func(p *IPPool, size int32) *IPPool {
+		p.Spec.BlockSize = size
+		return p
+	}
+	tests := []struct {
+		name    string
+		pool    *IPPool
+		oldPool *IPPool
+		exp     error
+	}{
+		{
+			name: "valid for ipv4 cidr",
+			pool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 28),
+			exp:  nil,
+		},
+		{
+			name: "valid for ipv6 cidr",
+			pool: withBlockSize(newIPPool("fd00::/64", "fd00::1", "", "", "fd00::/112"), 122),
+			exp:  nil,
+		},
+		{
+			name:    "valid for update without modify blocksize",
+			pool:    withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 28),
+			oldPool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 28),
+			exp:     nil,
+		},
+		{
+			name: "blocksize requires cidr",
+			pool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "10.10.0.2", "10.10.0.100", ""), 28),
+			exp:  fmt.Errorf("must set spec.cidr when set spec.blockSize"),
+		},
+		{
+			name: "blocksize smaller than cidr prefix length",
+			pool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 19),
+			exp:  fmt.Errorf("spec.blockSize %d must be in [%d, %d] for spec.cidr %s", 19, 20, 32, "10.10.0.0/20"),
+		},
+		{
+			name: "ipv4 blocksize bigger than 32",
+			pool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 33),
+			exp:  fmt.Errorf("spec.blockSize %d must be in [%d, %d] for spec.cidr %s", 33, 20, 32, "10.10.0.0/20"),
+		},
+		{
+			name:    "can't modify blocksize",
+			pool:    withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 26),
+			oldPool: withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 28),
+			exp:     fmt.Errorf("can't modify IPPool spec.blockSize from %d to %d", 28, 26),
+		},
+		{
+			name:    "can't enable block mode for existing ippool",
+			pool:    withBlockSize(newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"), 28),
+			oldPool: newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/20"),
+			exp:     fmt.Errorf("can't modify IPPool spec.blockSize from %d to %d", 0, 28),
+		},
+	}
+
+	for i := range tests {
+		res := NewIPPoolValidator(tests[i].pool).ValidateSpec(tests[i].oldPool)
+		if res == nil && tests[i].exp == nil {
+			continue
+		}
+		if res == nil || tests[i].exp == nil {
+			t.Errorf("test %s failed, expect is %v, real is %v", tests[i].name, tests[i].exp, res)
+			continue
+		}
+		if res.Error() != tests[i].exp.Error() {
+			t.Errorf("test %s failed, expect is %s, real is %s", tests[i].name, tests[i].exp.Error(), res.Error())
+		}
+	}
+}
+
+func TestValidateSelectors(t *testing.T) {
+	pool := newIPPool("10.10.1.0/24", "10.10.1.5", "", "", "10.10.1.128/25")
+	pool.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}
+	pool.Spec.PodSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "db"}},
+	}}
+	if err := NewIPPoolValidator(pool).ValidateSpec(nil); err != nil {
+		t.Errorf("valid selectors failed, err: %s", err)
+	}
+
+	pool.Spec.PodSelector.MatchExpressions[0].Operator = "Unknown"
+	if err := NewIPPoolValidator(pool).ValidateSpec(nil); err == nil || !strings.HasPrefix(err.Error(), "invalid spec.podSelector") {
+		t.Errorf("expect invalid spec.podSelector, real is %v", err)
+	}
+}
+
+func TestValidateRoutesAndDNS(t *testing.T) {
+	withRoutes := func(p *IPPool, routes []Route, dns *DNS) *IPPool {
+		p.Spec.Routes = routes
+		p.Spec.DNS = dns
+		return p
+	}
+	tests := []struct {
+		name string
+		pool *IPPool
+		exp  error
+	}{
+		{
+			name: "valid routes and dns",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"),
+				[]Route{{Dst: "192.168.0.0/16", GW: "10.10.1.254"}, {Dst: "0.0.0.0/0"}},
+				&DNS{Nameservers: []string{"10.10.1.53", "fd00::53"}, Search: []string{"svc.cluster.local"}}),
+			exp: nil,
+		},
+		{
+			name: "valid ipv6 route",
+			pool: withRoutes(newIPPool("fd00::/64", "fd00::1", "", "", "fd00::100/120"), []Route{{Dst: "fd01::/64", GW: "fd00::fe"}}, nil),
+			exp:  nil,
+		},
+		{
+			name: "invalid route dst",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"), []Route{{Dst: "192.168.0.0"}}, nil),
+			exp:  fmt.Errorf("parse spec.routes dst %s failed, err: %s", "192.168.0.0", &net.ParseError{Type: "CIDR address", Text: "192.168.0.0"}),
+		},
+		{
+			name: "route dst is different ip family",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"), []Route{{Dst: "fd01::/64"}}, nil),
+			exp:  fmt.Errorf("spec.routes dst %s and subnet %s must be the same ip family", "fd01::/64", "10.10.1.0/24"),
+		},
+		{
+			name: "invalid route gw",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"), []Route{{Dst: "192.168.0.0/16", GW: "10.10.1"}}, nil),
+			exp:  fmt.Errorf("invalid spec.routes gw %s", "10.10.1"),
+		},
+		{
+			name: "route gw isn't in subnet",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"), []Route{{Dst: "192.168.0.0/16", GW: "10.10.2.1"}}, nil),
+			exp:  fmt.Errorf("spec.routes gw %s doesn't in subnet %s", "10.10.2.1", "10.10.1.0/24"),
+		},
+		{
+			name: "invalid nameserver",
+			pool: withRoutes(newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25"), nil, &DNS{Nameservers: []string{"dns.local"}}),
+			exp:  fmt.Errorf("invalid spec.dns nameserver %s", "dns.local"),
+		},
+	}
+
+	for i := range tests {
+		res := NewIPPoolValidator(tests[i].pool).ValidateSpec(nil)
+		if res == nil && tests[i].exp == nil {
+			continue
+		}
+		if res == nil || tests[i].exp == nil {
+			t.Errorf("test %s failed, expect is %v, real is %v", tests[i].name, tests[i].exp, res)
+			continue
+		}
+		if res.Error() != tests[i].exp.Error() {
+			t.Errorf("test %s failed, expect is %s, real is %s", tests[i].name, tests[i].exp.Error(), res.Error())
+		}
+	}
+}
+
 func TestValidateAllocateIPs(t *testing.T) {
 	tests := []struct {
 		name string
@@ -238,6 +435,16 @@ func TestValidateAllocateIPs(t *testing.T) {
 			pool: newIPPoolWithStatus(newIPPool("10.10.1.0/24", "10.10.1.1", "10.10.1.121", "10.10.1.192", ""), []string{"10.10.1.121", "10.10.1.199"}, nil),
 			exp:  fmt.Errorf("ippool must contain has been allocated ip %s", "10.10.1.199"),
 		},
+		{
+			name: "allocate ip in ipv6 start-end",
+			pool: newIPPoolWithStatus(newIPPool("fd00::/64", "fd00::1", "fd00::10", "fd00::20", ""), nil, []string{"fd00::10", "fd00::1a"}),
+			exp:  nil,
+		},
+		{
+			name: "allocate ip not in ipv6 start-end",
+			pool: newIPPoolWithStatus(newIPPool("fd00::/64", "fd00::1", "fd00::10", "fd00::20", ""), nil, []string{"fd00::21"}),
+			exp:  fmt.Errorf("ippool must contain has been allocated ip %s", "fd00::21"),
+		},
 		{
 			name: "used ip not in start-end for change start-end range",
 			pool: newIPPoolWithStatus(newIPPool("10.10.1.0/24", "10.10.1.1", "10.10.1.121", "10.10.1.192", ""), []string{"10.10.1.50"}, nil),
@@ -277,3 +484,94 @@ func newIPPoolWithStatus(p *IPPool, usedIPs []string, allocateIPs []string) *IPP
 
 	return p
 }
+
+func TestValidateAllocationStrategy(t *testing.T) {
+	for _, strategy := range []AllocationStrategy{"", AllocationStrategySequential, AllocationStrategyLowestFirst,
+		AllocationStrategyRandom, AllocationStrategyHighestFirst} {
+		pool := newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25")
+		pool.Spec.AllocationStrategy = strategy
+		if err := NewIPPoolValidator(pool).ValidateSpec(nil); err != nil {
+			t.Errorf("allocation strategy %s should be valid, err: %s", strategy, err)
+		}
+	}
+
+	pool := newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25")
+	pool.Spec.AllocationStrategy = "unknown"
+	if err := NewIPPoolValidator(pool).ValidateSpec(nil); err == nil {
+		t.Errorf("unknown allocation strategy should be invalid")
+	}
+}
+
+func TestValidateNamespaceQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotas []NamespaceQuota
+		block  bool
+		valid  bool
+	}{
+		{
+			name:   "namespaces",
+			quotas: []NamespaceQuota{{Namespaces: []string{"ns1", "ns2"}, Max: 10}},
+			valid:  true,
+		},
+		{
+			name:   "namespace selector",
+			quotas: []NamespaceQuota{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}, Max: 0}},
+			valid:  true,
+		},
+		{
+			name:   "no namespace",
+			quotas: []NamespaceQuota{{Max: 10}},
+		},
+		{
+			name: "invalid namespace selector",
+			quotas: []NamespaceQuota{{NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tenant", Operator: "unknown"},
+			}}, Max: 10}},
+		},
+		{
+			name:   "negative max",
+			quotas: []NamespaceQuota{{Namespaces: []string{"ns1"}, Max: -1}},
+		},
+		{
+			name:   "block mode",
+			quotas: []NamespaceQuota{{Namespaces: []string{"ns1"}, Max: 10}},
+			block:  true,
+		},
+	}
+	for _, item := range tests {
+		pool := newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.128/25")
+		pool.Spec.NamespaceQuotas = item.quotas
+		if item.block {
+			pool.Spec.BlockSize = 28
+		}
+		err := NewIPPoolValidator(pool).ValidateSpec(nil)
+		if item.valid && err != nil {
+			t.Errorf("test %s failed, expect valid, err: %s", item.name, err)
+		}
+		if !item.valid && err == nil {
+			t.Errorf("test %s failed, expect invalid", item.name)
+		}
+	}
+}
+
+func TestPoolTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		pool *IPPool
+		exp  bool
+	}{
+		{name: "ipv4", pool: newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "10.10.0.0/16"), exp: false},
+		{name: "ipv6 /66", pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::/66"), exp: false},
+		{name: "ipv6 /64", pool: newIPPool("fd00::/64", "fd00::1", "", "", "fd00::/64"), exp: true},
+		{name: "ipv6 large start end", pool: newIPPool("fd00::/48", "fd00::1", "fd00::", "fd00:0:0:1::", ""), exp: true},
+	}
+	for _, item := range tests {
+		if res := item.pool.Truncated(); res != item.exp {
+			t.Errorf("test %s failed, expect truncated %v, real %v", item.name, item.exp, res)
+		}
+		if err := NewIPPoolValidator(item.pool).ValidateSpec(nil); (err != nil) != item.exp {
+			t.Errorf("test %s failed, expect rejected %v, real err: %v", item.name, item.exp, err)
+		}
+	}
+}
@@ -1,9 +1,35 @@
 package constants
 
+// The pool and static ip annotations of pod suffixed by "-" and an interface name, e.g. ipam.everoute.io/pool-net1,
+// only apply to the interface, the annotations without suffix only apply to the default interface
 const (
+	// IpamAnnotationPool is an ippool or an ordered ippool list separated by comma, e.g. "pool1,pool2"
 	IpamAnnotationPool     = "ipam.everoute.io/pool"
 	IpamAnnotationStaticIP = "ipam.everoute.io/static-ip"
 	IpamAnnotationIPList   = "ipam.everoute.io/ip-list"
+	// IpamAnnotationAllowedPools of namespace is the ippools allowed for pods in the namespace separated by comma,
+	// IpamAnnotationPool of namespace is the default ippool for pods in the namespace
+	IpamAnnotationAllowedPools = "ipam.everoute.io/allowed-pools"
+	// IpamAnnotationIPListMode is the ip list mode of statefulset, IPListModeOrdinal maps pod ordinal N to
+	// the Nth ip of the ip list, the default mode allocates an unused ip in the list randomly
+	IpamAnnotationIPListMode = "ipam.everoute.io/ip-list-mode"
+	IPListModeOrdinal        = "ordinal"
+
+	// IpamAnnotationStickyIPSeconds retains the ip released by the pod for the seconds, the pod recreated
+	// with the same namespace and name in the period gets the ip back
+	IpamAnnotationStickyIPSeconds = "ipam.everoute.io/sticky-ip-seconds"
+
+	// IpamAnnotationIPv6Pool and IpamAnnotationIPv6StaticIP request an extra ipv6 address for dual-stack Pod
+	IpamAnnotationIPv6Pool     = "ipam.everoute.io/ipv6-pool"
+	IpamAnnotationIPv6StaticIP = "ipam.everoute.io/ipv6-static-ip"
+
+	// DefaultIfName is the interface name of the pod default network
+	DefaultIfName = "eth0"
 
 	KindStatefulSet = "StatefulSet"
+
+	// KubeVirtGroup, KindVirtualMachine and KindVirtualMachineInstance identify KubeVirt virtual machines
+	KubeVirtGroup              = "kubevirt.io"
+	KindVirtualMachine         = "VirtualMachine"
+	KindVirtualMachineInstance = "VirtualMachineInstance"
 )
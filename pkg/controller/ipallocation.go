@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+)
+
+// AllocationController updates ip counters of the IPPool when its IPAllocations are created or deleted, allocations
+// of ipam only create IPAllocations without updating the IPPool status. It resets the offset of the full IPPool,
+// and quarantines ips whose IPAllocations are deleted outside ipam, e.g. by kubernetes gc
+type AllocationController struct {
+	client.Client
+	// reader reads ippools and ipallocations, it is the indexed cache of the manager after SetupWithManager
+	reader client.Reader
+
+	lock sync.Mutex
+	// deleted is ips of deleted IPAllocations with owners and their deletion time, keyed by the IPPool
+	deleted map[types.NamespacedName]map[string]time.Time
+}
+
+func (a *AllocationController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	klog.Infof("IPAllocation controller receive ippool %s", req.NamespacedName)
+	pool := v1alpha1.IPPool{}
+	snapshot, err := v1alpha1.GetIPPool(ctx, readerOr(a.reader, a.Client), req.NamespacedName, &pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			a.takeDeleted(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		klog.Errorf("Failed to get ippool %s, err: %s", req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+
+	// ips released by ipam have been quarantined, ips released by kubernetes gc are quarantined here
+	deleted := a.takeDeleted(req.NamespacedName)
+	for ip, t := range deleted {
+		_, allocated := pool.Status.AllocatedIPs[ip]
+		_, quarantined := pool.Status.QuarantinedIPs[ip]
+		if !allocated && !quarantined {
+			pool.Quarantine(ip, t)
+		}
+	}
+	pool.CleanQuarantine(time.Now())
+
+	allocated := pool.Status.AllocatedCount
+	pool.UpdateIPUsageCounter()
+	if pool.Status.Offset == constants.IPPoolOffsetFull && pool.Status.AllocatedCount < allocated {
+		pool.Status.Offset = constants.IPPoolOffsetReset
+	}
+
+	if err := v1alpha1.SyncAllocations(ctx, a.Client, &pool, snapshot, nil); err != nil {
+		klog.Errorf("Failed to update ippool %s status, err: %s", req.NamespacedName, err)
+		a.addDeleted(req.NamespacedName, deleted)
+		return ctrl.Result{}, err
+	}
+	if pool.Status.AllocatedCount != allocated {
+		klog.Infof("Success update ippool %s allocated count from %d to %d", req.NamespacedName, allocated, pool.Status.AllocatedCount)
+	}
+	return ctrl.Result{}, nil
+}
+
+// addDeleted records ips deleted from pool, the earliest deletion time of an ip is kept
+func (a *AllocationController) addDeleted(pool types.NamespacedName, ips map[string]time.Time) {
+	if len(ips) == 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.deleted == nil {
+		a.deleted = make(map[types.NamespacedName]map[string]time.Time)
+	}
+	if a.deleted[pool] == nil {
+		a.deleted[pool] = make(map[string]time.Time, len(ips))
+	}
+	for ip, t := range ips {
+		if cur, ok := a.deleted[pool][ip]; !ok || t.Before(cur) {
+			a.deleted[pool][ip] = t
+		}
+	}
+}
+
+// takeDeleted returns and forgets ips deleted from pool
+func (a *AllocationController) takeDeleted(pool types.NamespacedName) map[string]time.Time {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := a.deleted[pool]
+	delete(a.deleted, pool)
+	return res
+}
+
+func (a *AllocationController) SetupWithManager(mgr ctrl.Manager) error {
+	if mgr == nil {
+		return fmt.Errorf("can't setup with nil mgr")
+	}
+	reader, err := indexedReader(mgr)
+	if err != nil {
+		return err
+	}
+	a.reader = reader
+
+	c, err := controller.New("ipallocation controller", mgr, controller.Options{
+		Reconciler: a,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Watch(source.Kind(mgr.GetCache(), &v1alpha1.IPAllocation{}), handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(q, allocationToPool(ctx, e.Object))
+		},
+		DeleteFunc: func(ctx context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+			reqs := allocationToPool(ctx, e.Object)
+			// only ipallocations with owners are deleted by kubernetes gc
+			if allocation, ok := e.Object.(*v1alpha1.IPAllocation); ok && len(reqs) != 0 && len(allocation.OwnerReferences) != 0 {
+				a.addDeleted(reqs[0].NamespacedName, map[string]time.Time{allocation.Spec.IP: time.Now()})
+			}
+			enqueue(q, reqs)
+		},
+	})
+}
+
+func enqueue(q workqueue.RateLimitingInterface, reqs []reconcile.Request) {
+	for _, req := range reqs {
+		q.Add(req)
+	}
+}
+
+// indexedReader registers v1alpha1.AllocationPoolIndex to the cache of mgr and returns the cached client of mgr
+// which lists ipallocations of an ippool by the index
+func indexedReader(mgr ctrl.Manager) (client.Reader, error) {
+	if err := v1alpha1.IndexAllocations(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		return nil, err
+	}
+	return v1alpha1.IndexedReader{Reader: mgr.GetClient()}, nil
+}
+
+// readerOr returns reader, or c when reader is nil, e.g. the controller isn't setup with a manager
+func readerOr(reader client.Reader, c client.Client) client.Reader {
+	if reader == nil {
+		return c
+	}
+	return reader
+}
+
+func allocationToPool(_ context.Context, obj client.Object) []reconcile.Request {
+	a, ok := obj.(*v1alpha1.IPAllocation)
+	if !ok {
+		klog.Errorf("Can't transform object to ipallocation")
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{
+			Namespace: a.Namespace,
+			Name:      a.Spec.Pool,
+		},
+	}}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+var _ = Describe("ipallocation controller test", func() {
+	name := "pool-allocation"
+	pool := v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+		},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:                   "192.30.0.0/24",
+			Gateway:                "192.30.0.1",
+			Subnet:                 "192.30.0.0/24",
+			ReleaseCooldownSeconds: 600,
+		},
+	}
+	getPool := func(g Gomega) v1alpha1.IPPool {
+		p := v1alpha1.IPPool{}
+		g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+		return p
+	}
+
+	BeforeEach(func() {
+		Expect(k8sClient.Create(ctx, pool.DeepCopy())).Should(Succeed())
+	})
+	AfterEach(func() {
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+	})
+
+	Context("allocated count", func() {
+		var owned *v1alpha1.IPAllocation
+		BeforeEach(func() {
+			owned = v1alpha1.NewIPAllocation(&pool, "192.30.0.2", v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns/pod2"})
+			owned.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: "pod2", UID: "uid2"}}
+			Expect(k8sClient.Create(ctx, owned)).Should(Succeed())
+			Expect(k8sClient.Create(ctx, v1alpha1.NewIPAllocation(&pool, "192.30.0.3",
+				v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns/pod3"}))).Should(Succeed())
+		})
+		It("should count created ipallocations", func() {
+			Eventually(func(g Gomega) {
+				g.Expect(getPool(g).Status.AllocatedCount).Should(Equal(int64(2)))
+			}, timeout, interval).Should(Succeed())
+		})
+
+		When("ipallocation is deleted by kubernetes gc", func() {
+			BeforeEach(func() {
+				Eventually(func(g Gomega) {
+					g.Expect(getPool(g).Status.AllocatedCount).Should(Equal(int64(2)))
+				}, timeout, interval).Should(Succeed())
+				Expect(k8sClient.Delete(ctx, owned)).Should(Succeed())
+			})
+			It("should update allocated count and quarantine the ip", func() {
+				Eventually(func(g Gomega) {
+					p := getPool(g)
+					g.Expect(p.Status.AllocatedCount).Should(Equal(int64(1)))
+					g.Expect(p.Status.QuarantinedIPs).Should(HaveKey("192.30.0.2"))
+				}, timeout, interval).Should(Succeed())
+			})
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+// BlockController sums allocated ips of IPBlocks into the status of the IPPool they belong to
+type BlockController struct {
+	client.Client
+	// reader reads ippools and ipallocations, it is the indexed cache of the manager after SetupWithManager
+	reader client.Reader
+}
+
+func (b *BlockController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	klog.Infof("IPBlock controller receive ippool %s", req.NamespacedName)
+	pool := v1alpha1.IPPool{}
+	snapshot, err := v1alpha1.GetIPPool(ctx, readerOr(b.reader, b.Client), req.NamespacedName, &pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		klog.Errorf("Failed to get ippool %s, err: %s", req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+
+	blocks, err := v1alpha1.ListBlocks(ctx, b.Client, req.Namespace, req.Name, "")
+	if err != nil {
+		klog.Errorf("Failed to list ipblocks of ippool %s, err: %s", req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+	var count int64
+	for i := range blocks {
+		count += int64(len(blocks[i].Status.AllocatedIPs))
+	}
+	if count == pool.Status.BlockAllocatedCount {
+		return ctrl.Result{}, nil
+	}
+
+	pool.Status.BlockAllocatedCount = count
+	pool.UpdateIPUsageCounter()
+	if err := v1alpha1.SyncAllocations(ctx, b.Client, &pool, snapshot, nil); err != nil {
+		klog.Errorf("Failed to update ippool %s status, err: %s", req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+	klog.Infof("Success update ippool %s block allocated count to %d", req.NamespacedName, count)
+	return ctrl.Result{}, nil
+}
+
+func (b *BlockController) SetupWithManager(mgr ctrl.Manager) error {
+	if mgr == nil {
+		return fmt.Errorf("can't setup with nil mgr")
+	}
+	reader, err := indexedReader(mgr)
+	if err != nil {
+		return err
+	}
+	b.reader = reader
+
+	c, err := controller.New("ipblock controller", mgr, controller.Options{
+		Reconciler: b,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Watch(source.Kind(mgr.GetCache(), &v1alpha1.IPBlock{}), handler.EnqueueRequestsFromMapFunc(blockToPool))
+}
+
+func blockToPool(_ context.Context, obj client.Object) []reconcile.Request {
+	block, ok := obj.(*v1alpha1.IPBlock)
+	if !ok {
+		klog.Errorf("Can't transform object to ipblock")
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{
+			Namespace: block.Namespace,
+			Name:      block.Spec.Pool,
+		},
+	}}
+}
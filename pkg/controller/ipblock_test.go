@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+var _ = Describe("ipblock controller test", func() {
+	name := "pool-block"
+	pool := v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+		},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:      "192.20.0.0/24",
+			Gateway:   "192.20.1.1",
+			Subnet:    "192.20.0.0/16",
+			BlockSize: 28,
+		},
+	}
+	newBlock := func(cidr, node string, ips ...string) *v1alpha1.IPBlock {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		block := &v1alpha1.IPBlock{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      utils.GenBlockName(name, ipNet),
+				Namespace: ns,
+				Labels:    v1alpha1.BlockLabels(name, node),
+			},
+			Spec: v1alpha1.IPBlockSpec{Pool: name, Node: node, CIDR: cidr},
+		}
+		Expect(k8sClient.Create(ctx, block)).Should(Succeed())
+		block.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+		for _, ip := range ips {
+			block.Status.AllocatedIPs[ip] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns/" + ip}
+		}
+		Expect(k8sClient.Status().Update(ctx, block)).Should(Succeed())
+		return block
+	}
+	blockAllocatedCount := func(g Gomega) int64 {
+		p := v1alpha1.IPPool{}
+		g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+		return p.Status.BlockAllocatedCount
+	}
+
+	BeforeEach(func() {
+		Expect(k8sClient.Create(ctx, pool.DeepCopy())).Should(Succeed())
+	})
+	AfterEach(func() {
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPBlock{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+	})
+
+	Context("block allocated count", func() {
+		var block *v1alpha1.IPBlock
+		BeforeEach(func() {
+			block = newBlock("192.20.0.0/28", "node1", "192.20.0.2", "192.20.0.3")
+			newBlock("192.20.0.16/28", "node2", "192.20.0.18")
+		})
+		It("should sum allocated ips of all blocks", func() {
+			Eventually(func(g Gomega) {
+				g.Expect(blockAllocatedCount(g)).Should(Equal(int64(3)))
+			}, timeout, interval).Should(Succeed())
+		})
+
+		When("release ip in block", func() {
+			BeforeEach(func() {
+				Eventually(func(g Gomega) {
+					g.Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(block), block)).Should(Succeed())
+					delete(block.Status.AllocatedIPs, "192.20.0.2")
+					g.Expect(k8sClient.Status().Update(ctx, block)).Should(Succeed())
+				}, timeout, interval).Should(Succeed())
+			})
+			It("should update block allocated count", func() {
+				Eventually(func(g Gomega) {
+					g.Expect(blockAllocatedCount(g)).Should(Equal(int64(2)))
+				}, timeout, interval).Should(Succeed())
+			})
+		})
+
+		When("delete block", func() {
+			BeforeEach(func() {
+				Expect(k8sClient.Delete(ctx, block)).Should(Succeed())
+			})
+			It("should update block allocated count", func() {
+				Eventually(func(g Gomega) {
+					g.Expect(blockAllocatedCount(g)).Should(Equal(int64(1)))
+				}, timeout, interval).Should(Succeed())
+			})
+		})
+	})
+})
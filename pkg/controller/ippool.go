@@ -3,11 +3,14 @@ package controller
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/mikioh/ipaddr"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -16,20 +19,24 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/everoute/ipam/api/ipam/v1alpha1"
 	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
 )
 
 type PoolController struct {
 	client.Client
+	// reader reads ippools and ipallocations, it is the indexed cache of the manager after SetupWithManager
+	reader client.Reader
 }
 
 func (p *PoolController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	klog.Infof("IPPool controller receive ippool %s", req.NamespacedName)
 	pool := v1alpha1.IPPool{}
-	err := p.Get(ctx, req.NamespacedName, &pool)
+	snapshot, err := v1alpha1.GetIPPool(ctx, readerOr(p.reader, p.Client), req.NamespacedName, &pool)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			return ctrl.Result{}, nil
@@ -42,8 +49,15 @@ func (p *PoolController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 
 	// re-calculate ip counters
 	pool.Status.TotalCount = p.calAvailableIPs(pool.Spec)
+	reserved, err := p.calReservedIPs(ctx, &pool)
+	if err != nil {
+		klog.Errorf("Failed to calculate reserved ips of ippool %s, err: %s", req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+	pool.Status.ReservedCount = reserved
 	pool.UpdateIPUsageCounter()
-	if err := p.Status().Update(ctx, &pool); err != nil {
+	// allocations in status of old versions are migrated to ipallocations
+	if err := v1alpha1.SyncAllocations(ctx, p.Client, &pool, snapshot, nil); err != nil {
 		klog.Errorf("Failed to update ippool %s status, err: %s", req.NamespacedName, err)
 		return ctrl.Result{}, err
 	}
@@ -57,6 +71,14 @@ func (p *PoolController) SetupWithManager(mgr ctrl.Manager) error {
 	if mgr == nil {
 		return fmt.Errorf("can't setup with nil mgr")
 	}
+	if err := registerPoolCollector(mgr.GetClient()); err != nil {
+		return err
+	}
+	reader, err := indexedReader(mgr)
+	if err != nil {
+		return err
+	}
+	p.reader = reader
 
 	c, err := controller.New("ippool controller", mgr, controller.Options{
 		Reconciler: p,
@@ -65,11 +87,30 @@ func (p *PoolController) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	return c.Watch(source.Kind(mgr.GetCache(), &v1alpha1.IPPool{}), &handler.EnqueueRequestForObject{}, predicate.Funcs{
+	err = c.Watch(source.Kind(mgr.GetCache(), &v1alpha1.IPPool{}), &handler.EnqueueRequestForObject{}, predicate.Funcs{
 		CreateFunc: func(event.CreateEvent) bool { return true },
 		UpdateFunc: p.predicateUpdate,
 		DeleteFunc: func(event.DeleteEvent) bool { return false },
 	})
+	if err != nil {
+		return err
+	}
+
+	return c.Watch(source.Kind(mgr.GetCache(), &v1alpha1.IPReservation{}), handler.EnqueueRequestsFromMapFunc(reservationToPool))
+}
+
+func reservationToPool(_ context.Context, obj client.Object) []reconcile.Request {
+	r, ok := obj.(*v1alpha1.IPReservation)
+	if !ok {
+		klog.Errorf("Can't transform object to ipreservation")
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{
+			Namespace: r.Namespace,
+			Name:      r.Spec.Pool,
+		},
+	}}
 }
 
 func (p *PoolController) predicateUpdate(e event.UpdateEvent) bool {
@@ -114,22 +155,75 @@ func (p *PoolController) calAvailableIPs(spec v1alpha1.IPPoolSpec) int64 {
 	subnetPrefix := ipaddr.NewPrefix(subnetCIDR)
 	// except first ip of subnet
 	exceptPrefix = append(exceptPrefix, ip2Prefix(subnetCIDR.IP.String()))
-	// except last ip of subnet
-	exceptPrefix = append(exceptPrefix, ip2Prefix(subnetPrefix.Last().String()))
+	// except last ip of subnet, ipv6 has no broadcast address
+	if utils.IsIPv4(subnetCIDR.IP) {
+		exceptPrefix = append(exceptPrefix, ip2Prefix(subnetPrefix.Last().String()))
+	}
 	// except gateway ip
 	exceptPrefix = append(exceptPrefix, ip2Prefix(spec.Gateway))
 
 	validPrefix := ipListDifference(allPrefix, exceptPrefix)
-	var cnt int64
+	cnt := new(big.Int)
 	for _, item := range validPrefix {
-		cnt += item.NumNodes().Int64()
+		cnt.Add(cnt, item.NumNodes())
 	}
-	return cnt
+	// a huge ipv6 pool, e.g. /64, overflows int64
+	return utils.SaturatedInt64(cnt)
+}
+
+// calReservedIPs returns the number of valid ips reserved by unexpired IPReservations of pool except allocated ones
+func (p *PoolController) calReservedIPs(ctx context.Context, pool *v1alpha1.IPPool) (int64, error) {
+	reservations := v1alpha1.IPReservationList{}
+	if err := p.List(ctx, &reservations, client.InNamespace(pool.Namespace)); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	spec := *pool.Spec.DeepCopy()
+	var cidrs []*net.IPNet
+	for i := range reservations.Items {
+		r := &reservations.Items[i]
+		if r.Spec.Pool != pool.Name || r.Expired(now) {
+			continue
+		}
+		items, err := r.CIDRs()
+		if err != nil {
+			klog.Errorf("Invalid ipreservation %s/%s, err: %s", r.Namespace, r.Name, err)
+			continue
+		}
+		for _, item := range items {
+			spec.Except = append(spec.Except, item.String())
+		}
+		cidrs = append(cidrs, items...)
+	}
+	if len(cidrs) == 0 {
+		return 0, nil
+	}
+
+	reserved := pool.Status.TotalCount - p.calAvailableIPs(spec)
+	// ips allocated to the owner of the reservation have been counted in allocated_count
+	allocated := sets.KeySet(pool.Status.AllocatedIPs).Union(sets.KeySet(pool.Status.UsedIps))
+	for ip := range allocated {
+		for _, cidr := range cidrs {
+			if cidr.Contains(net.ParseIP(ip)) {
+				reserved--
+				break
+			}
+		}
+	}
+	if reserved < 0 {
+		return 0, nil
+	}
+	return reserved, nil
 }
 
 func ip2Prefix(str string) ipaddr.Prefix {
 	if !strings.Contains(str, "/") {
-		str += "/32"
+		if utils.IsIPv4(net.ParseIP(str)) {
+			str += "/32"
+		} else {
+			str += "/128"
+		}
 	}
 	_, cidr, _ := net.ParseCIDR(str)
 	return *ipaddr.NewPrefix(cidr)
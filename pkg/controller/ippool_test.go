@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"math"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -61,6 +62,7 @@ var _ = Describe("ippool controller test", func() {
 	})
 	AfterEach(func() {
 		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
 	})
 
 	Context("update ippool spec", func() {
@@ -69,7 +71,7 @@ var _ = Describe("ippool controller test", func() {
 				By("set offset")
 				p := v1alpha1.IPPool{}
 				Eventually(func(g Gomega) {
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					p.Status.Offset = 10
 					g.Expect(k8sClient.Status().Update(ctx, &p)).Should(Succeed())
 				}, timeout, interval).Should(Succeed())
@@ -81,14 +83,14 @@ var _ = Describe("ippool controller test", func() {
 			It("should reset offset", func() {
 				Eventually(func(g Gomega) {
 					p := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					g.Expect(p.Status.Offset).Should(Equal(constants.IPPoolOffsetReset))
 				}, timeout, interval).Should(Succeed())
 			})
 			It("should update counter", func() {
 				Eventually(func(g Gomega) {
 					p := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					g.Expect(p.Status.TotalCount).Should(Equal(int64(256)))
 					g.Expect(p.Status.AvailableCount).Should(Equal(int64(256)))
 				}, timeout, interval).Should(Succeed())
@@ -100,7 +102,7 @@ var _ = Describe("ippool controller test", func() {
 				By("set offset")
 				p := v1alpha1.IPPool{}
 				Eventually(func(g Gomega) {
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					p.Status.Offset = constants.IPPoolOffsetFull
 					g.Expect(k8sClient.Status().Update(ctx, &p)).Should(Succeed())
 				}, timeout, interval).Should(Succeed())
@@ -112,14 +114,14 @@ var _ = Describe("ippool controller test", func() {
 			It("should reset offset", func() {
 				Eventually(func(g Gomega) {
 					p := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					g.Expect(p.Status.Offset).Should(Equal(constants.IPPoolOffsetReset))
 				}, timeout, interval).Should(Succeed())
 			})
 			It("should update counter", func() {
 				Eventually(func(g Gomega) {
 					p := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name, Namespace: ns}, &p)).Should(Succeed())
 					g.Expect(p.Status.TotalCount).Should(Equal(int64(253)))
 					g.Expect(p.Status.AvailableCount).Should(Equal(int64(253)))
 				}, timeout, interval).Should(Succeed())
@@ -135,24 +137,45 @@ var _ = Describe("ippool controller test", func() {
 			})
 			It("should set right counters", func() {
 				Eventually(func(g Gomega) {
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
 					g.Expect(p.Status.TotalCount).Should(Equal(int64(240)))
 					g.Expect(p.Status.AvailableCount).Should(Equal(int64(240)))
 				}, timeout, interval).Should(Succeed())
 			})
 
+			When("reserve ip in pool", func() {
+				BeforeEach(func() {
+					r := v1alpha1.IPReservation{
+						ObjectMeta: metav1.ObjectMeta{Name: "reservation", Namespace: ns},
+						Spec:       v1alpha1.IPReservationSpec{Pool: name2, IPs: []string{"192.168.0.16/30", "192.168.0.2"}},
+					}
+					Expect(k8sClient.Create(ctx, &r)).Should(Succeed())
+				})
+				AfterEach(func() {
+					Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPReservation{}, client.InNamespace(ns))).Should(Succeed())
+				})
+				It("should count reserved ip separately", func() {
+					Eventually(func(g Gomega) {
+						g.Expect(getIPPool(types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
+						g.Expect(p.Status.TotalCount).Should(Equal(int64(240)))
+						g.Expect(p.Status.ReservedCount).Should(Equal(int64(4)))
+						g.Expect(p.Status.AvailableCount).Should(Equal(int64(236)))
+					}, timeout, interval).Should(Succeed())
+				})
+			})
+
 			When("update pool", func() {
 				BeforeEach(func() {
 					By("update spec cidr")
 					Eventually(func(g Gomega) {
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
 						p.Spec.Except = []string{"192.168.128.0/28"}
 						g.Expect(k8sClient.Update(ctx, p)).Should(Succeed())
 					}, timeout, interval).Should(Succeed())
 				})
 				It("should update counters", func() {
 					Eventually(func(g Gomega) {
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Name: name2, Namespace: ns}, p)).Should(Succeed())
 						g.Expect(p.Status.TotalCount).Should(Equal(int64(254)))
 						g.Expect(p.Status.AvailableCount).Should(Equal(int64(254)))
 					}, timeout, interval).Should(Succeed())
@@ -167,7 +190,7 @@ var _ = Describe("ippool controller test", func() {
 			})
 			It("should set right counters", func() {
 				Eventually(func(g Gomega) {
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
 					g.Expect(p.Status.TotalCount).Should(Equal(int64(513)))
 					g.Expect(p.Status.AvailableCount).Should(Equal(int64(513)))
 				}, timeout, interval).Should(Succeed())
@@ -177,14 +200,14 @@ var _ = Describe("ippool controller test", func() {
 				BeforeEach(func() {
 					By("update spec cidr")
 					Eventually(func(g Gomega) {
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
 						p.Spec.Except = []string{"192.168.128.0/28"}
 						g.Expect(k8sClient.Update(ctx, p)).Should(Succeed())
 					}, timeout, interval).Should(Succeed())
 				})
 				It("should update counters", func() {
 					Eventually(func(g Gomega) {
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Name: name3, Namespace: ns}, p)).Should(Succeed())
 						g.Expect(p.Status.TotalCount).Should(Equal(int64(527)))
 						g.Expect(p.Status.AvailableCount).Should(Equal(int64(527)))
 					}, timeout, interval).Should(Succeed())
@@ -281,3 +304,64 @@ func TestPredicateUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestCalAvailableIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		pool *v1alpha1.IPPool
+		exp  int64
+	}{
+		{
+			name: "ipv4 cidr equal subnet",
+			pool: newIPPool("10.10.1.0/24", "10.10.1.1", "", "", "10.10.1.0/24"),
+			exp:  253,
+		},
+		{
+			name: "ipv4 start end",
+			pool: newIPPool("10.10.0.0/16", "10.10.0.1", "10.10.1.0", "10.10.1.9", ""),
+			exp:  10,
+		},
+		{
+			name: "ipv6 cidr equal subnet",
+			pool: newIPPool("fd00::/120", "fd00::1", "", "", "fd00::/120", "fd00::10/126"),
+			exp:  250,
+		},
+		{
+			name: "ipv6 cidr overflow int64",
+			pool: newIPPool("fd00::/48", "fd00::1", "", "", "fd00::/64"),
+			exp:  math.MaxInt64,
+		},
+	}
+
+	p := &PoolController{}
+	for i := range tests {
+		res := p.calAvailableIPs(tests[i].pool.Spec)
+		if res != tests[i].exp {
+			t.Errorf("test %s failed, expect is %d, real is %d", tests[i].name, tests[i].exp, res)
+		}
+	}
+}
+
+func TestAllocatedByType(t *testing.T) {
+	pool := newIPPool("10.10.0.0/16", "10.10.0.1", "", "", "")
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{
+		"10.10.0.2": {ID: "ns/pod1", Type: v1alpha1.AllocateTypePod},
+		"10.10.0.3": {ID: "ns/pod2", Type: v1alpha1.AllocateTypePod},
+		"10.10.0.4": {ID: "ns/sts-0", Type: v1alpha1.AllocateTypeStatefulSet},
+	}
+	pool.Status.UsedIps = map[string]string{"10.10.0.5": "cid"}
+	res := allocatedByType(pool, map[v1alpha1.AllocateType]int{v1alpha1.AllocateTypePod: 2})
+	exp := map[v1alpha1.AllocateType]int{
+		v1alpha1.AllocateTypePod:         4,
+		v1alpha1.AllocateTypeStatefulSet: 1,
+		v1alpha1.AllocateTypeCNIUsed:     1,
+	}
+	if len(res) != len(exp) {
+		t.Errorf("expect %v, real is %v", exp, res)
+	}
+	for k, v := range exp {
+		if res[k] != v {
+			t.Errorf("type %s expect %d, real is %d", k, v, res[k])
+		}
+	}
+}
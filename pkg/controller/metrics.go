@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+const collectTimeout = 10 * time.Second
+
+var (
+	poolTotalDesc = prometheus.NewDesc("ipam_ippool_total_ips",
+		"Number of ips can be allocated in the ippool", []string{"namespace", "pool"}, nil)
+	poolAvailableDesc = prometheus.NewDesc("ipam_ippool_available_ips",
+		"Number of unallocated and unreserved ips in the ippool", []string{"namespace", "pool"}, nil)
+	poolReservedDesc = prometheus.NewDesc("ipam_ippool_reserved_ips",
+		"Number of ips reserved by ipreservations in the ippool", []string{"namespace", "pool"}, nil)
+	poolAllocatedDesc = prometheus.NewDesc("ipam_ippool_allocated_ips",
+		"Number of allocated ips in the ippool and its ipblocks by allocate type", []string{"namespace", "pool", "type"}, nil)
+)
+
+// poolCollector collects ip counters of all ippools when metrics are scraped, so the gauges are always
+// consistent with ippools and ipallocations in the reader, e.g. the cache of the manager
+type poolCollector struct {
+	reader client.Reader
+}
+
+// registerPoolCollector registers the poolCollector to the controller-runtime metrics registry,
+// only the first registered one takes effect
+func registerPoolCollector(reader client.Reader) error {
+	err := metrics.Registry.Register(&poolCollector{reader: reader})
+	if are := (prometheus.AlreadyRegisteredError{}); errors.As(err, &are) {
+		return nil
+	}
+	return err
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolTotalDesc
+	ch <- poolAvailableDesc
+	ch <- poolReservedDesc
+	ch <- poolAllocatedDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	pools := v1alpha1.IPPoolList{}
+	if err := c.reader.List(ctx, &pools); err != nil {
+		klog.Errorf("Failed to list ippools for metrics, err: %v", err)
+		return
+	}
+	if _, err := v1alpha1.LoadAllocationsForList(ctx, c.reader, &pools); err != nil {
+		klog.Errorf("Failed to load ipallocations for metrics, err: %v", err)
+		return
+	}
+	blocks := v1alpha1.IPBlockList{}
+	if err := c.reader.List(ctx, &blocks); err != nil {
+		klog.Errorf("Failed to list ipblocks for metrics, err: %v", err)
+		return
+	}
+	blockTypes := make(map[client.ObjectKey]map[v1alpha1.AllocateType]int)
+	for index := range blocks.Items {
+		block := &blocks.Items[index]
+		key := client.ObjectKey{Namespace: block.Namespace, Name: block.Spec.Pool}
+		if blockTypes[key] == nil {
+			blockTypes[key] = make(map[v1alpha1.AllocateType]int)
+		}
+		for _, a := range block.Status.AllocatedIPs {
+			blockTypes[key][a.Type]++
+		}
+	}
+
+	for index := range pools.Items {
+		pool := &pools.Items[index]
+		ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(pool.Status.TotalCount), pool.Namespace, pool.Name)
+		ch <- prometheus.MustNewConstMetric(poolAvailableDesc, prometheus.GaugeValue, float64(pool.Status.AvailableCount), pool.Namespace, pool.Name)
+		ch <- prometheus.MustNewConstMetric(poolReservedDesc, prometheus.GaugeValue, float64(pool.Status.ReservedCount), pool.Namespace, pool.Name)
+		for t, cnt := range allocatedByType(pool, blockTypes[client.ObjectKeyFromObject(pool)]) {
+			ch <- prometheus.MustNewConstMetric(poolAllocatedDesc, prometheus.GaugeValue, float64(cnt), pool.Namespace, pool.Name, string(t))
+		}
+	}
+}
+
+// allocatedByType counts allocated ips of pool by allocate type, ips in status.usedips are type cniused,
+// inBlocks is the counts of ips allocated in ipblocks of the pool
+func allocatedByType(pool *v1alpha1.IPPool, inBlocks map[v1alpha1.AllocateType]int) map[v1alpha1.AllocateType]int {
+	res := make(map[v1alpha1.AllocateType]int)
+	for _, a := range pool.Status.AllocatedIPs {
+		res[a.Type]++
+	}
+	if len(pool.Status.UsedIps) > 0 {
+		res[v1alpha1.AllocateTypeCNIUsed] += len(pool.Status.UsedIps)
+	}
+	for t, cnt := range inBlocks {
+		res[t] += cnt
+	}
+	return res
+}
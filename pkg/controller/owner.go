@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// DefaultOwnerKinds are the owner kinds watched by OwnerReconciler when Kinds is empty
+var DefaultOwnerKinds = []schema.GroupVersionKind{
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+	{Group: "batch", Version: "v1", Kind: "Job"},
+	{Group: "batch", Version: "v1", Kind: "CronJob"},
+}
+
+// OwnerReconciler releases ip-list ips of type owner when the owner is deleted, ips of owner kinds
+// which aren't watched are released by the cron job. It watches metadata of Kinds, so the ServiceAccount
+// of ipam needs get, list and watch permissions of them
+type OwnerReconciler struct {
+	client.Client
+	// Kinds is the watched owner kinds, default is DefaultOwnerKinds
+	Kinds []schema.GroupVersionKind
+}
+
+func (o *OwnerReconciler) SetUpWithManager(mgr ctrl.Manager) error {
+	if mgr == nil {
+		return fmt.Errorf("can't setup with nil manager")
+	}
+
+	kinds := o.Kinds
+	if len(kinds) == 0 {
+		kinds = DefaultOwnerKinds
+	}
+	for _, gvk := range kinds {
+		gvk := gvk
+		c, err := controller.New("owner-controller-"+strings.ToLower(gvk.GroupKind().String()), mgr, controller.Options{
+			Reconciler: reconcile.Func(func(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+				return o.reconcileKind(ctx, gvk, req)
+			}),
+		})
+		if err != nil {
+			return err
+		}
+
+		owner := &metav1.PartialObjectMetadata{}
+		owner.SetGroupVersionKind(gvk)
+		if err := c.Watch(source.Kind(mgr.GetCache(), owner), &handler.EnqueueRequestForObject{}, deletePredicate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OwnerReconciler) reconcileKind(ctx context.Context, gvk schema.GroupVersionKind, req ctrl.Request) (ctrl.Result, error) {
+	klog.Infof("Received %s %v reconcile", gvk.Kind, req.NamespacedName)
+	owner := &metav1.PartialObjectMetadata{}
+	owner.SetGroupVersionKind(gvk)
+	err := o.Client.Get(ctx, req.NamespacedName, owner)
+	if err == nil {
+		klog.Infof("Success get %s %v, return", gvk.Kind, req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	if !errors.IsNotFound(err) {
+		klog.Errorf("Failed to get %s %v, err: %v", gvk.Kind, req.NamespacedName, err)
+		return ctrl.Result{}, err
+	}
+
+	pools := v1alpha1.IPPoolList{}
+	if err := o.Client.List(ctx, &pools); err != nil {
+		klog.Errorf("Failed to list IPPools, err: %v", err)
+		return ctrl.Result{}, err
+	}
+	snapshots, err := v1alpha1.LoadAllocationsForList(ctx, o.Client, &pools)
+	if err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return ctrl.Result{}, err
+	}
+
+	ownerStr := utils.GenOwner(req.Namespace, req.Name)
+	failed := false
+	for i := range pools.Items {
+		pool := pools.Items[i]
+		if pool.Status.AllocatedIPs == nil {
+			continue
+		}
+		releaseIPs := []string{}
+		for ip, a := range pool.Status.AllocatedIPs {
+			if a.Type != v1alpha1.AllocateTypeOwner || a.Owner != ownerStr {
+				continue
+			}
+			if utils.GetGVKByOwnerKind(a.OwnerKind).GroupKind() != gvk.GroupKind() {
+				continue
+			}
+			releaseIPs = append(releaseIPs, ip)
+		}
+		if len(releaseIPs) == 0 {
+			continue
+		}
+		for _, ip := range releaseIPs {
+			delete(pool.Status.AllocatedIPs, ip)
+			pool.Quarantine(ip, time.Now())
+		}
+		if pool.Status.Offset == constants.IPPoolOffsetFull {
+			pool.Status.Offset = constants.IPPoolOffsetReset
+		}
+		pool.UpdateIPUsageCounter()
+		poolNsName := pool.GetNamespace() + "/" + pool.GetName()
+		if err := v1alpha1.SyncAllocations(ctx, o.Client, &pool, snapshots[client.ObjectKeyFromObject(&pool)], nil); err != nil {
+			failed = true
+			klog.Errorf("Failed to release ip-list %v of deleted %s %v in ippool %s, err: %v", releaseIPs, gvk.Kind, req.NamespacedName, poolNsName, err)
+			continue
+		}
+		klog.Infof("Success release ip-list %v of deleted %s %v in ippool %s", releaseIPs, gvk.Kind, req.NamespacedName, poolNsName)
+	}
+
+	if failed {
+		return ctrl.Result{}, fmt.Errorf("failed to release ip-list of deleted %s %v in all ippool", gvk.Kind, req.NamespacedName)
+	}
+
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+var _ = Describe("owner_controller", func() {
+	pool1 := v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pool1",
+			Namespace: ns,
+		},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:    "10.10.65.0/28",
+			Subnet:  "10.10.64.0/20",
+			Gateway: "10.10.65.1",
+		},
+	}
+	deployName := "deploy1"
+	podLabel := map[string]string{"Owner": deployName}
+	deploy1 := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deployName,
+			Namespace: ns,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: podLabel,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: podLabel,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "test",
+							Image: "network",
+						},
+					},
+				},
+			},
+		},
+	}
+	BeforeEach(func() {
+		By("setup resources")
+		Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+		Expect(k8sClient.Create(ctx, deploy1.DeepCopy())).Should(Succeed())
+		Eventually(func(g Gomega) {
+			ippool := v1alpha1.IPPool{}
+			g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+			ippool.Status.Offset = 3
+			ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+			ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/pod1"}
+			ippool.Status.AllocatedIPs["10.10.65.2"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeOwner, ID: ns + "/pod2",
+				Owner: ns + "/" + deployName, OwnerKind: "apps/v1/Deployment"}
+			ippool.Status.AllocatedIPs["10.10.65.4"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeOwner, ID: ns + "/pod3",
+				Owner: ns + "/" + deployName, OwnerKind: "apps/v1/DaemonSet"}
+			g.Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
+		}, timeout, interval).Should(Succeed())
+	})
+	AfterEach(func() {
+		By("clean resources")
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.Deployment{}, client.InNamespace(ns))).Should(Succeed())
+	})
+	When("delete deployment", func() {
+		BeforeEach(func() {
+			deploy := appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: deployName}, &deploy)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &deploy)).Should(Succeed())
+		})
+		It("only release ip of the deployment", func() {
+			Eventually(func(g Gomega) {
+				ippool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
+				g.Expect(len(ippool.Status.AllocatedIPs)).Should(Equal(2))
+				g.Expect(ippool.Status.AllocatedCount).Should(Equal(int64(2)))
+				g.Expect(ippool.Status.AllocatedIPs).Should(HaveKey("10.10.65.1"))
+				g.Expect(ippool.Status.AllocatedIPs).Should(HaveKey("10.10.65.4"))
+				g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.2"))
+			}, timeout, interval).Should(Succeed())
+		})
+	})
+})
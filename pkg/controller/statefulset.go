@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"fmt"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -20,7 +21,8 @@ import (
 	"github.com/everoute/ipam/pkg/utils"
 )
 
-var stsPredicate predicate.Predicate = predicate.Funcs{
+// deletePredicate only passes delete events, ips held by an owner are released after the owner is deleted
+var deletePredicate predicate.Predicate = predicate.Funcs{
 	CreateFunc: func(event.CreateEvent) bool {
 		return false
 	},
@@ -51,7 +53,7 @@ func (s *STSReconciler) SetUpWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	err = c.Watch(source.Kind(mgr.GetCache(), &appsv1.StatefulSet{}), &handler.EnqueueRequestForObject{}, stsPredicate)
+	err = c.Watch(source.Kind(mgr.GetCache(), &appsv1.StatefulSet{}), &handler.EnqueueRequestForObject{}, deletePredicate)
 	return err
 }
 
@@ -72,6 +74,11 @@ func (s *STSReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		klog.Errorf("Failed to list IPPools, err: %v", err)
 		return ctrl.Result{}, err
 	}
+	snapshots, err := v1alpha1.LoadAllocationsForList(ctx, s.Client, &pools)
+	if err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return ctrl.Result{}, err
+	}
 
 	failed := false
 	for i := range pools.Items {
@@ -92,12 +99,13 @@ func (s *STSReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		if len(releaseIPs) > 0 {
 			for _, ip := range releaseIPs {
 				delete(pool.Status.AllocatedIPs, ip)
+				pool.Quarantine(ip, time.Now())
 			}
 			if pool.Status.Offset == constants.IPPoolOffsetFull {
 				pool.Status.Offset = constants.IPPoolOffsetReset
 			}
 			poolNsName := pool.GetNamespace() + "/" + pool.GetName()
-			if err := s.Client.Status().Update(ctx, &pool); err != nil {
+			if err := v1alpha1.SyncAllocations(ctx, s.Client, &pool, snapshots[client.ObjectKeyFromObject(&pool)], nil); err != nil {
 				failed = true
 				klog.Errorf("Failed to release ip-list %v of deleted StatefulSet %v in ippool %s, err: %v", releaseIPs, req.NamespacedName, poolNsName, err)
 			}
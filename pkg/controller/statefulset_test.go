@@ -62,13 +62,14 @@ var _ = Describe("statefulset_controller", func() {
 	AfterEach(func() {
 		By("clean resources")
 		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
 		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.StatefulSet{}, client.InNamespace(ns))).Should(Succeed())
 	})
 	Context("ippool full", func() {
 		BeforeEach(func() {
 			Eventually(func(g Gomega) {
 				ippool := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = constants.IPPoolOffsetFull
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/pod1"}
@@ -89,7 +90,7 @@ var _ = Describe("statefulset_controller", func() {
 			It("release ip and reset ippool offset", func() {
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("check reset offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(constants.IPPoolOffsetReset)))
 					By("check release ip")
@@ -108,7 +109,7 @@ var _ = Describe("statefulset_controller", func() {
 		BeforeEach(func() {
 			Eventually(func(g Gomega) {
 				ippool := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = 3
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/pod1"}
@@ -129,7 +130,7 @@ var _ = Describe("statefulset_controller", func() {
 			It("only release ip", func() {
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("check doesn't change offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 					By("check release ip")
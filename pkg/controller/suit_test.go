@@ -12,6 +12,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/scheme"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -61,9 +62,18 @@ var _ = BeforeSuite(func() {
 	By("setup statefulset controller")
 	Expect((&STSReconciler{Client: mgr.GetClient()}).SetUpWithManager(mgr)).Should(Succeed())
 
+	By("setup owner controller")
+	Expect((&OwnerReconciler{Client: mgr.GetClient()}).SetUpWithManager(mgr)).Should(Succeed())
+
 	By("setup ippool controller")
 	Expect((&PoolController{Client: mgr.GetClient()}).SetupWithManager(mgr)).Should(Succeed())
 
+	By("setup ipallocation controller")
+	Expect((&AllocationController{Client: mgr.GetClient()}).SetupWithManager(mgr)).Should(Succeed())
+
+	By("setup ipblock controller")
+	Expect((&BlockController{Client: mgr.GetClient()}).SetupWithManager(mgr)).Should(Succeed())
+
 	By("get k8sClient")
 	k8sClient = mgr.GetClient()
 	Expect(k8sClient).ToNot(BeNil())
@@ -132,3 +142,9 @@ func newIPPoolWithStatus(p *v1alpha1.IPPool, offset int64, usedIPs []string, all
 
 	return p
 }
+
+// getIPPool gets the ippool with its ipallocations
+func getIPPool(key types.NamespacedName, pool *v1alpha1.IPPool) error {
+	_, err := v1alpha1.GetIPPool(ctx, k8sClient, key, pool)
+	return err
+}
@@ -26,6 +26,11 @@ func NewCleanStaleIP(period time.Duration, k8sClient client.Client, k8sReader cl
 	}
 	c.RegistryCleanFunc(cleanStaleIPForPod)
 	c.RegistryCleanFunc(cleanStaleIPForStatefulSet)
+	c.RegistryCleanFunc(cleanStaleIPForOwner)
+	c.RegistryCleanFunc(cleanStaleIPForVM)
+	c.RegistryCleanFunc(cleanStaleIPForBlock)
+	c.RegistryCleanFunc(cleanStaleBlock)
+	c.RegistryCleanFunc(cleanExpiredReservation)
 
 	return &c
 }
@@ -1,6 +1,7 @@
 package cron
 
 import (
+	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -113,6 +114,7 @@ var _ = Describe("clean_stale_ip", func() {
 	AfterEach(func() {
 		By("clean resources")
 		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
 		Expect(k8sClient.DeleteAllOf(ctx, &corev1.Pod{}, client.InNamespace(ns))).Should(Succeed())
 		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.StatefulSet{}, client.InNamespace(ns))).Should(Succeed())
 	})
@@ -121,7 +123,7 @@ var _ = Describe("clean_stale_ip", func() {
 		When("pool has full", func() {
 			BeforeEach(func() {
 				ippool := v1alpha1.IPPool{}
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = constants.IPPoolOffsetFull
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
@@ -134,7 +136,7 @@ var _ = Describe("clean_stale_ip", func() {
 				time.Sleep(period)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("should reset offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(constants.IPPoolOffsetReset)))
 					By("should cleanup stale IP for Pod")
@@ -145,7 +147,7 @@ var _ = Describe("clean_stale_ip", func() {
 					g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.3"))
 					By("another pool doesn't change")
 					ippool2 := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 					g.Expect(ippool2.Status.AllocatedIPs).Should(BeNil())
 				}, timeout, interval).Should(Succeed())
 			})
@@ -153,7 +155,7 @@ var _ = Describe("clean_stale_ip", func() {
 		When("pool doesn't full", func() {
 			BeforeEach(func() {
 				ippool := v1alpha1.IPPool{}
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = 1
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
@@ -165,7 +167,7 @@ var _ = Describe("clean_stale_ip", func() {
 				time.Sleep(period)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("shouldn't change offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 					By("should cleanup stale IP")
@@ -175,7 +177,7 @@ var _ = Describe("clean_stale_ip", func() {
 					g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.3"))
 					By("another pool doesn't change")
 					ippool2 := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 					g.Expect(ippool2.Status.AllocatedIPs).Should(BeNil())
 				}, timeout, interval).Should(Succeed())
 			})
@@ -186,7 +188,7 @@ var _ = Describe("clean_stale_ip", func() {
 		When("pool has full", func() {
 			BeforeEach(func() {
 				ippool := v1alpha1.IPPool{}
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = constants.IPPoolOffsetFull
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
@@ -200,7 +202,7 @@ var _ = Describe("clean_stale_ip", func() {
 				time.Sleep(period)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("should reset offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(constants.IPPoolOffsetReset)))
 					By("should cleanup stale IP for StatefulSet")
@@ -212,7 +214,7 @@ var _ = Describe("clean_stale_ip", func() {
 					g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.7"))
 					By("another pool doesn't change")
 					ippool2 := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 					g.Expect(ippool2.Status.AllocatedIPs).Should(BeNil())
 				}, timeout, interval).Should(Succeed())
 			})
@@ -220,7 +222,7 @@ var _ = Describe("clean_stale_ip", func() {
 		When("pool doesn't full", func() {
 			BeforeEach(func() {
 				ippool := v1alpha1.IPPool{}
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.Offset = 1
 				ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
@@ -234,7 +236,7 @@ var _ = Describe("clean_stale_ip", func() {
 				time.Sleep(period)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					By("shouldn't change offset")
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 					By("should cleanup stale IP for StatefulSet")
@@ -246,17 +248,46 @@ var _ = Describe("clean_stale_ip", func() {
 					g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.7"))
 					By("another pool doesn't change")
 					ippool2 := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 					g.Expect(ippool2.Status.AllocatedIPs).Should(BeNil())
 				}, timeout, interval).Should(Succeed())
 			})
 		})
 	})
 
+	Context("single pool has stale IP for other owner in pool", func() {
+		BeforeEach(func() {
+			ippool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+			ippool.Status.Offset = constants.IPPoolOffsetFull
+			ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+			ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
+			ippool.Status.AllocatedIPs["10.10.65.4"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeOwner, ID: "ownerPod",
+				Owner: ns + "/" + sts1Name, OwnerKind: "apps/v1/StatefulSet"}
+			ippool.Status.AllocatedIPs["10.10.65.5"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeOwner, ID: "ownerPod",
+				Owner: ns + "/deploy-unexist", OwnerKind: "apps/v1/Deployment"}
+			Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
+		})
+		It("clean stale IP", func() {
+			time.Sleep(period)
+			Eventually(func(g Gomega) {
+				ippool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				By("should reset offset")
+				g.Expect(ippool.Status.Offset).Should(Equal(int64(constants.IPPoolOffsetReset)))
+				By("should cleanup stale IP for owner")
+				g.Expect(len(ippool.Status.AllocatedIPs)).Should(Equal(2))
+				g.Expect(ippool.Status.AllocatedIPs).Should(HaveKey("10.10.65.1"))
+				g.Expect(ippool.Status.AllocatedIPs).Should(HaveKey("10.10.65.4"))
+				g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.5"))
+			}, timeout, interval).Should(Succeed())
+		})
+	})
+
 	Context("multi pool has stale IP in pool", func() {
 		BeforeEach(func() {
 			ippool := v1alpha1.IPPool{}
-			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 			ippool.Status.Offset = 1
 			ippool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 			ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod1Name}
@@ -266,7 +297,7 @@ var _ = Describe("clean_stale_ip", func() {
 			ippool.Status.AllocatedIPs["10.10.65.5"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeStatefulSet, ID: "ownerstsPod", Owner: ns + "/sts-unexist"}
 			Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
 			ippool2 := v1alpha1.IPPool{}
-			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 			ippool2.Status.Offset = constants.IPPoolOffsetFull
 			ippool2.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 			ippool2.Status.AllocatedIPs["12.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: ns + "/" + pod2Name}
@@ -282,7 +313,7 @@ var _ = Describe("clean_stale_ip", func() {
 			time.Sleep(period)
 			Eventually(func(g Gomega) {
 				ippool := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				By("shouldn't change offset")
 				g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 				By("should cleanup stale IP")
@@ -294,7 +325,7 @@ var _ = Describe("clean_stale_ip", func() {
 				g.Expect(ippool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.65.5"))
 
 				ippool2 := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool2)).Should(Succeed())
 				By("should reset offset")
 				g.Expect(ippool2.Status.Offset).Should(Equal(int64(constants.IPPoolOffsetReset)))
 				By("should cleanup stale IP")
@@ -308,3 +339,44 @@ var _ = Describe("clean_stale_ip", func() {
 		})
 	})
 })
+
+func TestPodHasIP(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		ip   string
+		exp  bool
+	}{
+		{
+			name: "match pod ip",
+			pod:  corev1.Pod{Status: corev1.PodStatus{PodIP: "10.1.1.1"}},
+			ip:   "10.1.1.1",
+			exp:  true,
+		},
+		{
+			name: "match the second ip of dual-stack pod",
+			pod: corev1.Pod{Status: corev1.PodStatus{
+				PodIP:  "10.1.1.1",
+				PodIPs: []corev1.PodIP{{IP: "10.1.1.1"}, {IP: "fd00::10"}},
+			}},
+			ip:  "fd00::10",
+			exp: true,
+		},
+		{
+			name: "doesn't match",
+			pod: corev1.Pod{Status: corev1.PodStatus{
+				PodIP:  "10.1.1.1",
+				PodIPs: []corev1.PodIP{{IP: "10.1.1.1"}, {IP: "fd00::10"}},
+			}},
+			ip:  "fd00::11",
+			exp: false,
+		},
+	}
+
+	for i := range tests {
+		res := podHasIP(&tests[i].pod, tests[i].ip)
+		if res != tests[i].exp {
+			t.Errorf("test %s failed, expect is %v, real is %v", tests[i].name, tests[i].exp, res)
+		}
+	}
+}
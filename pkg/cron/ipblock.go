@@ -0,0 +1,144 @@
+package cron
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+var _ ProcessFun = cleanStaleIPForBlock
+var _ ProcessFun = cleanStaleBlock
+
+func cleanStaleIPForBlock(ctx context.Context, k8sClient client.Client, k8sReader client.Reader) {
+	blocks := v1alpha1.IPBlockList{}
+	if err := k8sClient.List(ctx, &blocks); err != nil {
+		klog.Errorf("Failed to list ipblocks, err: %v", err)
+		return
+	}
+
+	for i := range blocks.Items {
+		block := blocks.Items[i]
+		blockNsName := types.NamespacedName{
+			Namespace: block.GetNamespace(),
+			Name:      block.GetName(),
+		}
+		for ip, allo := range block.Status.AllocatedIPs {
+			if allo.Type != v1alpha1.AllocateTypePod {
+				continue
+			}
+			podNsName := utils.GetPodNsNameByAllocateID(allo.ID)
+			if podNsName.Name == "" || podNsName.Namespace == "" {
+				klog.Errorf("Can't get pod namespace and name for allocate info %v and ip %s in ipblock %v", allo, ip, blockNsName)
+				continue
+			}
+			used, err := isAllocationUsedByPod(ctx, ip, allo, podNsName, k8sClient, k8sReader)
+			if err != nil {
+				klog.Errorf("Failed to get pod %v for clean stale ip in ipblock %v, err: %v", podNsName, blockNsName, err)
+				continue
+			}
+			if used {
+				continue
+			}
+			blockNow := v1alpha1.IPBlock{}
+			if err := k8sClient.Get(ctx, blockNsName, &blockNow); err != nil {
+				klog.Errorf("Failed to get the latest ipblock %s status, err: %s", blockNsName, err)
+				continue
+			}
+			if alloNew, ok := blockNow.Status.AllocatedIPs[ip]; !ok || alloNew != allo {
+				klog.Infof("Allocate info of stale ip %s in ipblock %s has updated, skip update ipblock status", ip, blockNsName)
+				continue
+			}
+			klog.Infof("IP %s for pod %s is stale, begin to cleanup from ipblock %s", ip, podNsName, blockNsName)
+			base := blockNow.DeepCopy()
+			delete(blockNow.Status.AllocatedIPs, ip)
+			pool := v1alpha1.IPPool{}
+			poolNsName := types.NamespacedName{Namespace: block.GetNamespace(), Name: block.Spec.Pool}
+			if err := k8sClient.Get(ctx, poolNsName, &pool); err != nil && !errors.IsNotFound(err) {
+				klog.Errorf("Failed to get ippool %s of ipblock %s, err: %s", poolNsName, blockNsName, err)
+				continue
+			}
+			blockNow.Quarantine(&pool, ip, time.Now())
+			// the patch fails on conflict, so the ip allocated again by others after the get isn't released
+			patch := client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})
+			if err := k8sClient.Status().Patch(ctx, &blockNow, patch); err != nil {
+				klog.Errorf("Failed to cleanup ipblock %s stale ip %s, update ipblock status err: %s", blockNsName, ip, err)
+				continue
+			}
+			recordCleanedIPs(block.Spec.Pool, allo.Type, 1)
+			klog.Infof("Success to cleanup ipblock %s stale ip %s for pod %s", blockNsName, ip, podNsName)
+		}
+	}
+}
+
+// cleanStaleBlock reclaims empty ipblocks, a node without allocated ip keeps one empty ipblock
+// of each ippool until the node is deleted
+func cleanStaleBlock(ctx context.Context, k8sClient client.Client, k8sReader client.Reader) {
+	blocks := v1alpha1.IPBlockList{}
+	if err := k8sClient.List(ctx, &blocks); err != nil {
+		klog.Errorf("Failed to list ipblocks, err: %v", err)
+		return
+	}
+	sort.Slice(blocks.Items, func(a, b int) bool {
+		return blocks.Items[a].Name < blocks.Items[b].Name
+	})
+
+	// kept records pool/node which has a non-empty or kept ipblock
+	kept := make(map[string]bool)
+	for i := range blocks.Items {
+		if len(blocks.Items[i].Status.AllocatedIPs) != 0 {
+			kept[blocks.Items[i].Spec.Pool+"/"+blocks.Items[i].Spec.Node] = true
+		}
+	}
+	for i := range blocks.Items {
+		block := &blocks.Items[i]
+		if len(block.Status.AllocatedIPs) != 0 {
+			continue
+		}
+		exist, err := isNodeExist(ctx, block.Spec.Node, k8sClient, k8sReader)
+		if err != nil {
+			klog.Errorf("Failed to get node %s for clean stale ipblock %s, err: %v", block.Spec.Node, block.Name, err)
+			continue
+		}
+		key := block.Spec.Pool + "/" + block.Spec.Node
+		if exist && !kept[key] {
+			kept[key] = true
+			continue
+		}
+
+		// the precondition prevents deleting the ipblock which has allocated ip after list
+		err = k8sClient.Delete(ctx, block, client.Preconditions{ResourceVersion: &block.ResourceVersion})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("Failed to reclaim ipblock %s of node %s, err: %v", block.Name, block.Spec.Node, err)
+			continue
+		}
+		klog.Infof("Success to reclaim ipblock %s %s of node %s in ippool %s", block.Name, block.Spec.CIDR, block.Spec.Node, block.Spec.Pool)
+	}
+}
+
+func isNodeExist(ctx context.Context, name string, k8sClient client.Client, k8sReader client.Reader) (bool, error) {
+	err := k8sClient.Get(ctx, types.NamespacedName{Name: name}, &corev1.Node{})
+	if err == nil {
+		return true, nil
+	}
+	if !errors.IsNotFound(err) {
+		return true, err
+	}
+
+	err = k8sReader.Get(ctx, types.NamespacedName{Name: name}, &corev1.Node{})
+	if err == nil {
+		return true, nil
+	}
+	if !errors.IsNotFound(err) {
+		return true, err
+	}
+	return false, nil
+}
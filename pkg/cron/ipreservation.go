@@ -0,0 +1,38 @@
+package cron
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+var _ ProcessFun = cleanExpiredReservation
+
+// cleanExpiredReservation deletes expired ipreservations, the reserved ips become available again
+func cleanExpiredReservation(ctx context.Context, k8sClient client.Client, _ client.Reader) {
+	reservations := v1alpha1.IPReservationList{}
+	if err := k8sClient.List(ctx, &reservations); err != nil {
+		klog.Errorf("Failed to list ipreservations, err: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range reservations.Items {
+		r := &reservations.Items[i]
+		if !r.Expired(now) {
+			continue
+		}
+		// the precondition prevents deleting the ipreservation which has been renewed after list
+		err := k8sClient.Delete(ctx, r, client.Preconditions{ResourceVersion: &r.ResourceVersion})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("Failed to delete expired ipreservation %s/%s, err: %v", r.Namespace, r.Name, err)
+			continue
+		}
+		klog.Infof("Success to delete expired ipreservation %s/%s of ippool %s", r.Namespace, r.Name, r.Spec.Pool)
+	}
+}
@@ -0,0 +1,22 @@
+package cron
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+var cleanedIPs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ipam_cleaned_stale_ips_total",
+	Help: "Number of stale ips released by CleanStaleIP",
+}, []string{"pool", "type"})
+
+func init() {
+	metrics.Registry.MustRegister(cleanedIPs)
+}
+
+// recordCleanedIPs counts n stale ips of type t released from pool
+func recordCleanedIPs(pool string, t v1alpha1.AllocateType, n int) {
+	cleanedIPs.WithLabelValues(pool, string(t)).Add(float64(n))
+}
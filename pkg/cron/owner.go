@@ -0,0 +1,84 @@
+package cron
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+var _ ProcessFun = cleanStaleIPForOwner
+
+func cleanStaleIPForOwner(ctx context.Context, k8sClient client.Client, k8sReader client.Reader) {
+	ippools := v1alpha1.IPPoolList{}
+	err := k8sClient.List(ctx, &ippools)
+	if err != nil {
+		klog.Errorf("Failed to list ippools, err: %v", err)
+		return
+	}
+	snapshots, err := v1alpha1.LoadAllocationsForList(ctx, k8sClient, &ippools)
+	if err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return
+	}
+
+	for i := range ippools.Items {
+		ippool := ippools.Items[i]
+		if ippool.Status.AllocatedIPs == nil {
+			continue
+		}
+		poolNsName := types.NamespacedName{
+			Namespace: ippool.GetNamespace(),
+			Name:      ippool.GetName(),
+		}
+		delIPs := make([]string, 0)
+		for ip, allo := range ippool.Status.AllocatedIPs {
+			if allo.Type != v1alpha1.AllocateTypeOwner {
+				continue
+			}
+			ownerNsName := utils.GetNsNameByAllocateOwner(allo.Owner)
+			gvk := utils.GetGVKByOwnerKind(allo.OwnerKind)
+			if ownerNsName.Name == "" || ownerNsName.Namespace == "" || gvk.Kind == "" {
+				klog.Errorf("Can't get owner kind, namespace and name for allocate info %v and ip %s in ippool %v", allo, ip, poolNsName)
+				continue
+			}
+			owner := &metav1.PartialObjectMetadata{}
+			owner.SetGroupVersionKind(gvk)
+			err := k8sReader.Get(ctx, ownerNsName, owner)
+			if err == nil {
+				continue
+			}
+			if !errors.IsNotFound(err) {
+				klog.Errorf("Failed to get %s %v for clean stale ip in ippool %v, err: %v", gvk.Kind, ownerNsName, poolNsName, err)
+				continue
+			}
+			klog.Infof("IP %s for pod %v owned by %s %v is stale, will cleanup from ippool %v", ip, allo.ID, gvk.Kind, ownerNsName, poolNsName)
+			delIPs = append(delIPs, ip)
+		}
+		if len(delIPs) == 0 {
+			continue
+		}
+		for _, ip := range delIPs {
+			delete(ippool.Status.AllocatedIPs, ip)
+			ippool.Quarantine(ip, time.Now())
+		}
+		if ippool.Status.Offset == constants.IPPoolOffsetFull {
+			ippool.Status.Offset = constants.IPPoolOffsetReset
+		}
+		ippool.UpdateIPUsageCounter()
+		err := v1alpha1.SyncAllocations(ctx, k8sClient, &ippool, snapshots[poolNsName], nil)
+		if err != nil {
+			klog.Errorf("Failed to update ippool %s status, err: %s", poolNsName, err)
+			continue
+		}
+		recordCleanedIPs(ippool.Name, v1alpha1.AllocateTypeOwner, len(delIPs))
+	}
+}
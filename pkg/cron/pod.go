@@ -2,6 +2,7 @@ package cron
 
 import (
 	"context"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -23,6 +24,10 @@ func cleanStaleIPForPod(ctx context.Context, k8sClient client.Client, k8sReader
 		klog.Errorf("Failed to list ippools, err: %v", err)
 		return
 	}
+	if _, err := v1alpha1.LoadAllocationsForList(ctx, k8sClient, &ippools); err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return
+	}
 
 	for i := range ippools.Items {
 		ippool := ippools.Items[i]
@@ -42,7 +47,10 @@ func cleanStaleIPForPod(ctx context.Context, k8sClient client.Client, k8sReader
 				klog.Errorf("Can't get pod namespace and name for allocate info %v and ip %s in ippool %v", allo, ip, poolNsName)
 				continue
 			}
-			used, err := isIPUsedByPod(ctx, ip, podNsName, k8sClient, k8sReader)
+			if ippool.Retained(ip, time.Now()) {
+				continue
+			}
+			used, err := isAllocationUsedByPod(ctx, ip, allo, podNsName, k8sClient, k8sReader)
 			if err != nil {
 				klog.Errorf("Failed to get pod %v for clean stale ip in ippool %v, err: %v", podNsName, poolNsName, err)
 				continue
@@ -51,7 +59,8 @@ func cleanStaleIPForPod(ctx context.Context, k8sClient client.Client, k8sReader
 				continue
 			}
 			poolNow := v1alpha1.IPPool{}
-			if err := k8sClient.Get(ctx, poolNsName, &poolNow); err != nil {
+			snapshot, err := v1alpha1.GetIPPool(ctx, k8sClient, poolNsName, &poolNow)
+			if err != nil {
 				klog.Errorf("Failed to get the latest ippool %s status, err: %s", poolNsName, err)
 				continue
 			}
@@ -64,26 +73,59 @@ func cleanStaleIPForPod(ctx context.Context, k8sClient client.Client, k8sReader
 				klog.Infof("Allocate info of stale ip %s in ippool %s has updated, old is %v, new is %v, skip update ippool status", ip, poolNsName, allo, alloNew)
 				continue
 			}
+			if poolNow.Retained(ip, time.Now()) {
+				klog.Infof("Stale ip %s in ippool %s is retained for pod %s, skip update ippool status", ip, poolNsName, podNsName)
+				continue
+			}
 			klog.Infof("IP %s for pod %s is stale, begin to cleanup from ippool %s", ip, podNsName, poolNsName)
 			delete(poolNow.Status.AllocatedIPs, ip)
+			poolNow.Quarantine(ip, time.Now())
+			poolNow.CleanRetention()
 			if poolNow.Status.Offset == constants.IPPoolOffsetFull {
 				poolNow.Status.Offset = constants.IPPoolOffsetReset
 			}
 			poolNow.UpdateIPUsageCounter()
-			err = k8sClient.Status().Update(ctx, &poolNow)
+			err = v1alpha1.SyncAllocations(ctx, k8sClient, &poolNow, snapshot, nil)
 			if err != nil {
 				klog.Errorf("Failed to cleanup ippool %s stale ip %s, update ippool status err: %s", poolNsName, ip, err)
+				continue
 			}
+			recordCleanedIPs(poolNow.Name, allo.Type, 1)
 			klog.Infof("Success to cleanup ippool %s stale ip %s for pod %s", poolNsName, ip, podNsName)
 		}
 	}
 }
 
+// isAllocationUsedByPod checks whether the ip allocated by allo is used by pod, ip of a secondary interface
+// isn't in pod status, so it is used until the pod is deleted
+func isAllocationUsedByPod(ctx context.Context, ip string, allo v1alpha1.AllocateInfo, podNsName types.NamespacedName,
+	k8sClient client.Client, k8sReader client.Reader) (bool, error) {
+	if allo.IfName == "" || allo.IfName == constants.DefaultIfName {
+		return isIPUsedByPod(ctx, ip, podNsName, k8sClient, k8sReader)
+	}
+
+	err := k8sClient.Get(ctx, podNsName, &corev1.Pod{})
+	if err == nil {
+		return true, nil
+	}
+	if !errors.IsNotFound(err) {
+		return true, err
+	}
+	err = k8sReader.Get(ctx, podNsName, &corev1.Pod{})
+	if err == nil {
+		return true, nil
+	}
+	if !errors.IsNotFound(err) {
+		return true, err
+	}
+	return false, nil
+}
+
 func isIPUsedByPod(ctx context.Context, ip string, podNsName types.NamespacedName, k8sClient client.Client, k8sReader client.Reader) (bool, error) {
 	p := corev1.Pod{}
 	err := k8sClient.Get(ctx, podNsName, &p)
 	if err == nil {
-		if p.Status.PodIP == ip {
+		if podHasIP(&p, ip) {
 			return true, nil
 		}
 	} else {
@@ -95,10 +137,10 @@ func isIPUsedByPod(ctx context.Context, ip string, podNsName types.NamespacedNam
 
 	err2 := k8sReader.Get(ctx, podNsName, &corev1.Pod{})
 	if err2 == nil {
-		if p.Status.PodIP == ip {
+		if podHasIP(&p, ip) {
 			return true, nil
 		}
-		if p.Status.PodIP == "" {
+		if p.Status.PodIP == "" && len(p.Status.PodIPs) == 0 {
 			klog.Infof("Can't get pod %s ip, keep ip %s allocate info in ippool", podNsName, ip)
 			return true, nil
 		}
@@ -110,3 +152,16 @@ func isIPUsedByPod(ctx context.Context, ip string, podNsName types.NamespacedNam
 	}
 	return false, nil
 }
+
+// podHasIP checks both PodIP and PodIPs, a dual-stack pod has one ip for each family in PodIPs
+func podHasIP(p *corev1.Pod, ip string) bool {
+	if p.Status.PodIP == ip {
+		return true
+	}
+	for i := range p.Status.PodIPs {
+		if p.Status.PodIPs[i].IP == ip {
+			return true
+		}
+	}
+	return false
+}
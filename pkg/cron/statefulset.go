@@ -2,6 +2,7 @@ package cron
 
 import (
 	"context"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -23,6 +24,11 @@ func cleanStaleIPForStatefulSet(ctx context.Context, k8sClient client.Client, k8
 		klog.Errorf("Failed to list ippools, err: %v", err)
 		return
 	}
+	snapshots, err := v1alpha1.LoadAllocationsForList(ctx, k8sClient, &ippools)
+	if err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return
+	}
 
 	for i := range ippools.Items {
 		ippool := ippools.Items[i]
@@ -59,14 +65,17 @@ func cleanStaleIPForStatefulSet(ctx context.Context, k8sClient client.Client, k8
 		}
 		for _, ip := range delIPs {
 			delete(ippool.Status.AllocatedIPs, ip)
+			ippool.Quarantine(ip, time.Now())
 		}
 		if ippool.Status.Offset == constants.IPPoolOffsetFull {
 			ippool.Status.Offset = constants.IPPoolOffsetReset
 		}
 		ippool.UpdateIPUsageCounter()
-		err := k8sClient.Status().Update(ctx, &ippool)
+		err := v1alpha1.SyncAllocations(ctx, k8sClient, &ippool, snapshots[poolNsName], nil)
 		if err != nil {
 			klog.Errorf("Failed to update ippool %s status, err: %s", poolNsName, err)
+			continue
 		}
+		recordCleanedIPs(ippool.Name, v1alpha1.AllocateTypeStatefulSet, len(delIPs))
 	}
 }
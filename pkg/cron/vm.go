@@ -0,0 +1,98 @@
+package cron
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+var _ ProcessFun = cleanStaleIPForVM
+
+func cleanStaleIPForVM(ctx context.Context, k8sClient client.Client, k8sReader client.Reader) {
+	ippools := v1alpha1.IPPoolList{}
+	err := k8sClient.List(ctx, &ippools)
+	if err != nil {
+		klog.Errorf("Failed to list ippools, err: %v", err)
+		return
+	}
+	snapshots, err := v1alpha1.LoadAllocationsForList(ctx, k8sClient, &ippools)
+	if err != nil {
+		klog.Errorf("Failed to load ipallocations, err: %v", err)
+		return
+	}
+
+	for i := range ippools.Items {
+		ippool := ippools.Items[i]
+		if ippool.Status.AllocatedIPs == nil {
+			continue
+		}
+		poolNsName := types.NamespacedName{
+			Namespace: ippool.GetNamespace(),
+			Name:      ippool.GetName(),
+		}
+		delIPs := make([]string, 0)
+		for ip, allo := range ippool.Status.AllocatedIPs {
+			if allo.Type != v1alpha1.AllocateTypeVM {
+				continue
+			}
+			vmNsName := utils.GetNsNameByAllocateOwner(allo.Owner)
+			if vmNsName.Name == "" || vmNsName.Namespace == "" {
+				klog.Errorf("Can't get VirtualMachine namespace and name for allocate info %v and ip %s in ippool %v", allo, ip, poolNsName)
+				continue
+			}
+			exist, err := isVMExist(ctx, k8sReader, vmNsName)
+			if err != nil {
+				klog.Errorf("Failed to get VirtualMachine %v for clean stale ip in ippool %v, err: %v", vmNsName, poolNsName, err)
+				continue
+			}
+			if exist {
+				continue
+			}
+			klog.Infof("IP %s for VirtualMachine %v is stale, will cleanup from ippool %v", ip, vmNsName, poolNsName)
+			delIPs = append(delIPs, ip)
+		}
+		if len(delIPs) == 0 {
+			continue
+		}
+		for _, ip := range delIPs {
+			delete(ippool.Status.AllocatedIPs, ip)
+			ippool.Quarantine(ip, time.Now())
+		}
+		if ippool.Status.Offset == constants.IPPoolOffsetFull {
+			ippool.Status.Offset = constants.IPPoolOffsetReset
+		}
+		ippool.UpdateIPUsageCounter()
+		err := v1alpha1.SyncAllocations(ctx, k8sClient, &ippool, snapshots[poolNsName], nil)
+		if err != nil {
+			klog.Errorf("Failed to update ippool %s status, err: %s", poolNsName, err)
+			continue
+		}
+		recordCleanedIPs(ippool.Name, v1alpha1.AllocateTypeVM, len(delIPs))
+	}
+}
+
+// isVMExist returns true when the VirtualMachine or its VirtualMachineInstance exists
+func isVMExist(ctx context.Context, k8sReader client.Reader, vmNsName types.NamespacedName) (bool, error) {
+	for _, kind := range []string{constants.KindVirtualMachine, constants.KindVirtualMachineInstance} {
+		obj := &metav1.PartialObjectMetadata{}
+		obj.SetGroupVersionKind(schema.GroupVersionKind{Group: constants.KubeVirtGroup, Version: "v1", Kind: kind})
+		err := k8sReader.Get(ctx, vmNsName, obj)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,238 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// BatchRequest requests Count ips for Conf, Count less than 1 means 1. Conf.IP is a static ip and requires
+// Count 1, it is set to the first allocated ip after ExecAddBatch
+type BatchRequest struct {
+	Conf  *NetConf
+	Count int
+}
+
+// ExecAddBatch allocates ips for all requests from ippool pool in a single status update, the results are
+// in the order of reqs. It either allocates all ips or leaves the ippool unchanged
+func (i *Ipam) ExecAddBatch(ctx context.Context, pool string, reqs []BatchRequest) ([]*cniv1.Result, error) {
+	if err := validBatch(pool, reqs); err != nil {
+		klog.Errorf("Invalid batch request for ippool %s, err: %v", pool, err)
+		return nil, err
+	}
+
+	req := k8stypes.NamespacedName{
+		Name:      pool,
+		Namespace: i.namespace,
+	}
+	var results []*cniv1.Result
+	err := retryOnError(i.updateBackoff, syncConflict, pool, "", func() error {
+		ipPool := &v1alpha1.IPPool{}
+		snapshot, err := v1alpha1.GetIPPool(ctx, i.reader, req, ipPool)
+		if err != nil {
+			klog.Errorf("get ip pool error, err %s", err)
+			return poolGetError(req, err)
+		}
+		if ipPool.BlockMode() {
+			return fmt.Errorf("%w: batch allocation doesn't support ippool %s in block mode", ErrInvalidRequest, pool)
+		}
+		reservations, err := i.listReservations(ctx, pool)
+		if err != nil {
+			return err
+		}
+
+		ips, err := i.allocateBatch(ipPool, reservations, reqs)
+		if err != nil {
+			klog.Errorf("Failed to allocate ips in ippool %s for batch request, err: %v", pool, err)
+			return err
+		}
+		owners := make(map[string]metav1.OwnerReference)
+		for index := range reqs {
+			for ip, ref := range i.allocationOwners(reqs[index].Conf, ips[index]...) {
+				owners[ip] = ref
+			}
+		}
+		// the batch only creates ipallocations, the counters are updated by the ipallocation controller
+		if err := v1alpha1.SyncAllocations(ctx, i.k8sClient, ipPool, snapshot, owners); err != nil {
+			klog.Errorf("update ipPool %v error: %v", req, err)
+			return err
+		}
+		var allocated []string
+		for index := range ips {
+			for _, ip := range ips[index] {
+				if _, ok := snapshot.Allocations[ip]; !ok {
+					allocated = append(allocated, ip)
+				}
+			}
+		}
+		i.indexes.update(ipPool, allocated, nil)
+
+		results = make([]*cniv1.Result, 0, len(reqs))
+		for index := range reqs {
+			res := i.ParseResult(ipPool, ips[index][0])
+			for _, ip := range ips[index][1:] {
+				res.IPs = append(res.IPs, i.ParseResult(ipPool, ip).IPs...)
+			}
+			reqs[index].Conf.Pool, reqs[index].Conf.IP = pool, ips[index][0]
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, claimedError(pool, err)
+	}
+	return results, nil
+}
+
+// ExecDelBatch releases all ips of confs in ippool pool in a single status update
+func (i *Ipam) ExecDelBatch(ctx context.Context, pool string, confs []*NetConf) error {
+	for _, conf := range confs {
+		if err := conf.Valid(); err != nil {
+			klog.Errorf("Invalid param %v, err: %v", *conf, err)
+			return err
+		}
+	}
+
+	req := k8stypes.NamespacedName{
+		Name:      pool,
+		Namespace: i.namespace,
+	}
+	return retryOnError(i.updateBackoff, apierrors.IsConflict, pool, "", func() error {
+		ipPool := &v1alpha1.IPPool{}
+		snapshot, err := v1alpha1.GetIPPool(ctx, i.k8sClient, req, ipPool)
+		if err != nil {
+			klog.Errorf("get ip pool error, err %s", err)
+			return poolGetError(req, err)
+		}
+
+		now := time.Now()
+		changed, released := false, false
+		for _, conf := range confs {
+			// sticky ips are retained like ExecDel
+			ips, ok := releaseIn(ipPool, conf, now)
+			changed = changed || ok
+			released = released || len(ips) != 0
+		}
+		if !changed {
+			return nil
+		}
+		if released && ipPool.Status.Offset == constants.IPPoolOffsetFull {
+			ipPool.Status.Offset = constants.IPPoolOffsetReset
+		}
+		ipPool.CleanQuarantine(now)
+		ipPool.CleanRetention()
+		ipPool.UpdateIPUsageCounter()
+		if err := v1alpha1.SyncAllocations(ctx, i.k8sClient, ipPool, snapshot, nil); err != nil {
+			klog.Errorf("update ipPool %v error: %v", req, err)
+			return err
+		}
+		return nil
+	})
+}
+
+func validBatch(pool string, reqs []BatchRequest) error {
+	if len(splitPools(pool)) != 1 {
+		return fmt.Errorf("%w: batch request must specify a single ippool", ErrInvalidRequest)
+	}
+	for index := range reqs {
+		conf := reqs[index].Conf
+		if conf == nil {
+			return fmt.Errorf("%w: batch request %d must set Conf", ErrInvalidRequest, index)
+		}
+		if err := conf.Valid(); err != nil {
+			return err
+		}
+		if conf.DualStack {
+			return fmt.Errorf("%w: batch request doesn't support dual stack", ErrInvalidRequest)
+		}
+		if conf.IP != "" && reqs[index].Count > 1 {
+			return fmt.Errorf("%w: batch request with static ip %s can't request %d ips", ErrInvalidRequest, conf.IP, reqs[index].Count)
+		}
+	}
+	return nil
+}
+
+// allocateBatch allocates ips for reqs in status of ipPool, ipPool isn't updated to k8s
+func (i *Ipam) allocateBatch(ipPool *v1alpha1.IPPool, reservations []v1alpha1.IPReservation, reqs []BatchRequest) ([][]string, error) {
+	if ipPool.Status.AllocatedIPs == nil {
+		ipPool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+	}
+	// the index is built once and marks ips allocated in the batch
+	free := i.indexes.freeIndex(ipPool)
+	excludeNets(free, ipPool, reservedNets(reservations))
+	use := func(ip string) {
+		if off, ok := utils.IPOffset(ipPool.StartIP(), net.ParseIP(ip)); ok && off < ipPool.Length() {
+			free.Use(off)
+		}
+	}
+	res := make([][]string, len(reqs))
+	for index := range reqs {
+		conf := reqs[index].Conf
+		if conf.IP != "" {
+			ip, err := allocateStaticInBatch(ipPool, reservations, conf)
+			if err != nil {
+				return nil, err
+			}
+			use(ip)
+			res[index] = []string{ip}
+			continue
+		}
+
+		for n := 0; n < reqs[index].Count || n == 0; n++ {
+			if err := checkQuota(ipPool, conf); err != nil {
+				return nil, err
+			}
+			newIP, newOffset := findNextIn(ipPool, free)
+			if newOffset == constants.IPPoolOffsetFull || newOffset == constants.IPPoolOffsetErr {
+				return nil, fmt.Errorf("%w: no enough ip in ippool %s for batch request", ErrPoolFull, ipPool.Name)
+			}
+			ipPool.Status.AllocatedIPs[newIP.String()] = conf.genAllocateInfo()
+			use(newIP.String())
+			if newOffset != constants.IPPoolOffsetIgnore {
+				ipPool.Status.Offset = newOffset
+			}
+			res[index] = append(res[index], newIP.String())
+		}
+	}
+	return res, nil
+}
+
+func allocateStaticInBatch(ipPool *v1alpha1.IPPool, reservations []v1alpha1.IPReservation, conf *NetConf) (string, error) {
+	ip := net.ParseIP(conf.IP)
+	if ip == nil {
+		return "", fmt.Errorf("%w: invalid static ip %s", ErrInvalidRequest, conf.IP)
+	}
+	c := *conf
+	c.IP = ip.String()
+	if !ipPool.Contains(ip) {
+		return "", fmt.Errorf("%w: static ip %s is not in target pool %s", ErrIPOutOfPool, c.IP, ipPool.Name)
+	}
+	if _, exist := ipPool.Status.UsedIps[c.IP]; exist {
+		return "", &IPInUseError{IP: c.IP, Pool: ipPool.Name, Holder: usedIPHolder(ipPool, c.IP)}
+	}
+	if a, exist := ipPool.Status.AllocatedIPs[c.IP]; exist {
+		if isSameAllocateInfo(a, &c) {
+			return c.IP, nil
+		}
+		return "", &IPInUseError{IP: c.IP, Pool: ipPool.Name, Holder: a}
+	}
+	if err := checkReservationIn(reservations, &c); err != nil {
+		return "", err
+	}
+	if err := checkQuota(ipPool, &c); err != nil {
+		return "", err
+	}
+	ipPool.Status.AllocatedIPs[c.IP] = c.genAllocateInfo()
+	return c.IP, nil
+}
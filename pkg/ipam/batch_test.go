@@ -0,0 +1,110 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func TestAllocateBatch(t *testing.T) {
+	newPool := func() *v1alpha1.IPPool {
+		return &v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:    "12.10.64.0/29",
+				Subnet:  "12.10.64.0/29",
+				Gateway: "12.10.64.1",
+			},
+			Status: v1alpha1.IPPoolStatus{
+				AllocatedIPs: makeAllocateStatus("12.10.64.3", "ns/pod", "pod", "cid"),
+			},
+		}
+	}
+	confA := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "a"}
+	confB := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "b", IP: "12.10.64.6"}
+	reservations := []v1alpha1.IPReservation{{Spec: v1alpha1.IPReservationSpec{Pool: "pool", IPs: []string{"12.10.64.4"}}}}
+
+	pool := newPool()
+	res, err := (&Ipam{}).allocateBatch(pool, reservations, []BatchRequest{{Conf: confA, Count: 2}, {Conf: confB}})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(res) != 2 || len(res[0]) != 2 || res[0][0] != "12.10.64.2" || res[0][1] != "12.10.64.5" || res[1][0] != "12.10.64.6" {
+		t.Errorf("unexpected batch result %v", res)
+	}
+	if len(pool.Status.AllocatedIPs) != 4 || pool.Status.Offset != 6 {
+		t.Errorf("unexpected pool status %+v", pool.Status)
+	}
+
+	pool = newPool()
+	if _, err := (&Ipam{}).allocateBatch(pool, reservations, []BatchRequest{{Conf: confA, Count: 3}, {Conf: confB}}); err == nil {
+		t.Errorf("batch request exceeds free ips should fail")
+	}
+
+	pool = newPool()
+	confC := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "c", IP: "12.10.64.4"}
+	if _, err := (&Ipam{}).allocateBatch(pool, reservations, []BatchRequest{{Conf: confC}}); err == nil {
+		t.Errorf("batch request with reserved static ip should fail")
+	}
+}
+
+func TestExecDelBatchSticky(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1"},
+	}
+	sticky := &NetConf{Type: v1alpha1.AllocateTypePod, K8sPodName: "pod", K8sPodNs: "ns", AllocateIdentify: "cid", StickySeconds: 60}
+	other := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "vm"}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(&v1alpha1.IPPool{}).
+		WithObjects(pool.DeepCopy(),
+			v1alpha1.NewIPAllocation(pool, "10.10.0.2", sticky.genAllocateInfo()),
+			v1alpha1.NewIPAllocation(pool, "10.10.0.3", other.genAllocateInfo())).
+		WithIndex(&v1alpha1.IPAllocation{}, v1alpha1.AllocationPoolIndex, v1alpha1.AllocationPool).Build()
+
+	i := InitIpam(k8sClient, "ipam")
+	if err := i.ExecDelBatch(context.Background(), "pool", []*NetConf{sticky, other}); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	res := v1alpha1.IPPool{}
+	if _, err := v1alpha1.GetIPPool(context.Background(), k8sClient, client.ObjectKeyFromObject(pool), &res); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Status.AllocatedIPs["10.10.0.2"]; !ok || !res.Retained("10.10.0.2", time.Now()) {
+		t.Errorf("the sticky ip should be retained, real status %+v", res.Status)
+	}
+	if _, ok := res.Status.AllocatedIPs["10.10.0.3"]; ok {
+		t.Errorf("the ip of vm should be released, real status %+v", res.Status)
+	}
+}
+
+func TestValidBatch(t *testing.T) {
+	conf := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "a"}
+	tests := []struct {
+		name string
+		pool string
+		reqs []BatchRequest
+		err  bool
+	}{
+		{name: "valid", pool: "pool", reqs: []BatchRequest{{Conf: conf, Count: 3}}},
+		{name: "pool list", pool: "pool1,pool2", reqs: []BatchRequest{{Conf: conf}}, err: true},
+		{name: "empty conf", pool: "pool", reqs: []BatchRequest{{Count: 1}}, err: true},
+		{name: "dual stack", pool: "pool", reqs: []BatchRequest{{Conf: &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "a", DualStack: true}}}, err: true},
+		{name: "multiple static ips", pool: "pool", reqs: []BatchRequest{{Conf: &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "a", IP: "10.0.0.1"}, Count: 2}}, err: true},
+	}
+	for _, item := range tests {
+		if err := validBatch(item.pool, item.reqs); (err != nil) != item.err {
+			t.Errorf("test %s expect err %v, real is %v", item.name, item.err, err)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package ipam
+
+import (
+	"hash/fnv"
+	"math/big"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// maxBitmapLength limits a bitmap to 2MiB, larger pools (e.g. ipv6 /80) are scanned by poolScanner, such pools
+// are sparse, so the scan ends quickly
+const maxBitmapLength int64 = 1 << 24
+
+// freeIndex finds unused offsets of an ippool, offset is relative to IPPool.StartIP()
+type freeIndex interface {
+	// NextFree returns the first free offset searching from offset from to the end and then wrapping around
+	NextFree(from int64) (int64, bool)
+	// PrevFree returns the last free offset searching from offset from to the start and then wrapping around
+	PrevFree(from int64) (int64, bool)
+	// Use marks offset off as used after the ip is allocated in the status of the ippool
+	Use(off int64)
+	// UseRange marks offsets in [from, to] as used, e.g. ips reserved by IPReservations
+	UseRange(from, to int64)
+}
+
+// newFreeIndex returns the freeIndex built from the spec and status of ipPool
+func newFreeIndex(ipPool *v1alpha1.IPPool) freeIndex {
+	if ipPool.Length() <= maxBitmapLength {
+		return newPoolBitmap(ipPool)
+	}
+	return newPoolScanner(ipPool)
+}
+
+// ipBitmap records used offsets, a set bit means the offset can't be allocated
+type ipBitmap struct {
+	length int64
+	words  []uint64
+	// bits set in under are regarded as set, it is shared by bitmaps of the same ippool spec
+	under *ipBitmap
+	// dirty is the changed words of a copy-on-write bitmap, words is shared and never changed when it isn't nil
+	dirty map[int64]uint64
+}
+
+func newIPBitmap(length int64) *ipBitmap {
+	return &ipBitmap{
+		length: length,
+		words:  make([]uint64, (length+63)/64),
+	}
+}
+
+// newPoolBitmap returns the bitmap of allocated ips of ipPool over the bitmap of its spec
+func newPoolBitmap(ipPool *v1alpha1.IPPool) *ipBitmap {
+	b := newStatusBitmap(ipPool)
+	b.under = newSpecBitmap(ipPool)
+	return b
+}
+
+// newSpecBitmap marks subnet network, broadcast, gateway and except nets of ipPool as used
+func newSpecBitmap(ipPool *v1alpha1.IPPool) *ipBitmap {
+	b := newIPBitmap(ipPool.Length())
+	start := ipPool.StartIP()
+
+	_, subnet, _ := net.ParseCIDR(ipPool.Spec.Subnet)
+	b.setIP(start, utils.FirstIP(subnet))
+	// ipv6 has no broadcast address
+	if utils.IsIPv4(subnet.IP) {
+		b.setIP(start, utils.LastIP(subnet))
+	}
+	b.setIP(start, net.ParseIP(ipPool.Spec.Gateway))
+
+	for i := range ipPool.Spec.Except {
+		_, ipNet, err := net.ParseCIDR(ipPool.Spec.Except[i])
+		if err != nil {
+			continue
+		}
+		if from, to, ok := rangeOffsets(start, b.length, utils.FirstIP(ipNet), utils.LastIP(ipNet)); ok {
+			b.SetRange(from, to)
+		}
+	}
+	return b
+}
+
+// newStatusBitmap marks allocated ips in status of ipPool as used
+func newStatusBitmap(ipPool *v1alpha1.IPPool) *ipBitmap {
+	b := newIPBitmap(ipPool.Length())
+	start := ipPool.StartIP()
+	for ip := range ipPool.Status.UsedIps {
+		b.setIP(start, net.ParseIP(ip))
+	}
+	for ip := range ipPool.Status.AllocatedIPs {
+		b.setIP(start, net.ParseIP(ip))
+	}
+	return b
+}
+
+// setIP sets the offset of ip relative to start, ip out of the bitmap is ignored
+func (b *ipBitmap) setIP(start, ip net.IP) {
+	if off, ok := utils.IPOffset(start, ip); ok && off < b.length {
+		b.Set(off)
+	}
+}
+
+// clearIP clears the offset of ip relative to start, ip out of the bitmap is ignored
+func (b *ipBitmap) clearIP(start, ip net.IP) {
+	if off, ok := utils.IPOffset(start, ip); ok && off < b.length {
+		b.Clear(off)
+	}
+}
+
+// rangeOffsets returns offsets of [first, last] relative to start and clamped in [0, length-1]
+func rangeOffsets(start net.IP, length int64, first, last net.IP) (int64, int64, bool) {
+	if utils.IsIPv4(start) != utils.IsIPv4(first) {
+		return 0, 0, false
+	}
+	base := utils.IPToBigInt(start)
+	from := new(big.Int).Sub(utils.IPToBigInt(first), base)
+	to := new(big.Int).Sub(utils.IPToBigInt(last), base)
+	if to.Sign() < 0 || from.Cmp(big.NewInt(length)) >= 0 {
+		return 0, 0, false
+	}
+	if from.Sign() < 0 {
+		from.SetInt64(0)
+	}
+	if to.Cmp(big.NewInt(length-1)) > 0 {
+		to.SetInt64(length - 1)
+	}
+	return from.Int64(), to.Int64(), true
+}
+
+func (b *ipBitmap) Set(off int64) {
+	b.setWord(off/64, b.own(off/64)|1<<uint(off%64))
+}
+
+func (b *ipBitmap) Clear(off int64) {
+	b.setWord(off/64, b.own(off/64)&^(1<<uint(off%64)))
+}
+
+func (b *ipBitmap) Use(off int64) {
+	b.Set(off)
+}
+
+func (b *ipBitmap) UseRange(from, to int64) {
+	b.SetRange(from, to)
+}
+
+func (b *ipBitmap) IsSet(off int64) bool {
+	return b.word(off/64)&(1<<uint(off%64)) != 0
+}
+
+// word returns the w-th word with bits of under
+func (b *ipBitmap) word(w int64) uint64 {
+	if b.under == nil {
+		return b.own(w)
+	}
+	return b.own(w) | b.under.words[w]
+}
+
+// own returns the w-th word without bits of under
+func (b *ipBitmap) own(w int64) uint64 {
+	if v, ok := b.dirty[w]; ok {
+		return v
+	}
+	return b.words[w]
+}
+
+func (b *ipBitmap) setWord(w int64, v uint64) {
+	if b.dirty != nil {
+		b.dirty[w] = v
+		return
+	}
+	b.words[w] = v
+}
+
+// overlay returns a copy-on-write bitmap over b, words and under of b are shared, so b must be copy-on-write
+// or never changed after that
+func (b *ipBitmap) overlay() *ipBitmap {
+	dirty := make(map[int64]uint64, len(b.dirty))
+	for w, v := range b.dirty {
+		dirty[w] = v
+	}
+	return &ipBitmap{
+		length: b.length,
+		words:  b.words,
+		under:  b.under,
+		dirty:  dirty,
+	}
+}
+
+// flatten returns a copy-on-write bitmap of b without dirty words, the words of b are copied once
+func (b *ipBitmap) flatten() *ipBitmap {
+	words := make([]uint64, len(b.words))
+	copy(words, b.words)
+	for w, v := range b.dirty {
+		words[w] = v
+	}
+	return &ipBitmap{
+		length: b.length,
+		words:  words,
+		under:  b.under,
+		dirty:  make(map[int64]uint64),
+	}
+}
+
+// SetRange sets offsets in [from, to]
+func (b *ipBitmap) SetRange(from, to int64) {
+	for off := from; off <= to; {
+		if off%64 == 0 && off+63 <= to {
+			b.setWord(off/64, ^uint64(0))
+			off += 64
+			continue
+		}
+		b.Set(off)
+		off++
+	}
+}
+
+func (b *ipBitmap) NextFree(from int64) (int64, bool) {
+	if off, ok := b.nextFreeIn(from, b.length); ok {
+		return off, true
+	}
+	return b.nextFreeIn(0, from)
+}
+
+// nextFreeIn returns the first free offset in [from, to), it skips a full word at a time
+func (b *ipBitmap) nextFreeIn(from, to int64) (int64, bool) {
+	for from < to {
+		w := from / 64
+		free := ^b.word(w) >> uint(from%64)
+		if free != 0 {
+			off := from + int64(bits.TrailingZeros64(free))
+			if off < to {
+				return off, true
+			}
+			return 0, false
+		}
+		from = (w + 1) * 64
+	}
+	return 0, false
+}
+
+func (b *ipBitmap) PrevFree(from int64) (int64, bool) {
+	if off, ok := b.prevFreeIn(0, from); ok {
+		return off, true
+	}
+	return b.prevFreeIn(from+1, b.length-1)
+}
+
+// prevFreeIn returns the last free offset in [from, to], it skips a full word at a time
+func (b *ipBitmap) prevFreeIn(from, to int64) (int64, bool) {
+	for to >= from {
+		w := to / 64
+		free := ^b.word(w) << uint(63-to%64)
+		if free != 0 {
+			off := to - int64(bits.LeadingZeros64(free))
+			if off >= from {
+				return off, true
+			}
+			return 0, false
+		}
+		to = w*64 - 1
+	}
+	return 0, false
+}
+
+// poolScanner is used for pools too large to build a bitmap, i.e. longer than maxBitmapLength. It jumps over
+// ranges which can't be allocated, e.g. except nets and reserved ips, and checks the other offsets one by one,
+// so a lookup costs O(n) of the ranges and used ips before the free one
+type poolScanner struct {
+	length int64
+	// ranges are sorted and merged offset ranges which can't be allocated
+	ranges [][2]int64
+	// used is offsets of allocated ips
+	used sets.Set[int64]
+}
+
+// maxScanSteps caps the steps of a lookup of poolScanner, the lookup returns not found when it is hit
+const maxScanSteps = 1 << 20
+
+func newPoolScanner(ipPool *v1alpha1.IPPool) *poolScanner {
+	s := &poolScanner{
+		length: ipPool.Length(),
+		used:   sets.New[int64](),
+	}
+	start := ipPool.StartIP()
+
+	_, subnet, _ := net.ParseCIDR(ipPool.Spec.Subnet)
+	specIPs := []net.IP{utils.FirstIP(subnet), net.ParseIP(ipPool.Spec.Gateway)}
+	// ipv6 has no broadcast address
+	if utils.IsIPv4(subnet.IP) {
+		specIPs = append(specIPs, utils.LastIP(subnet))
+	}
+	for _, ip := range specIPs {
+		if from, to, ok := rangeOffsets(start, s.length, ip, ip); ok {
+			s.UseRange(from, to)
+		}
+	}
+	for i := range ipPool.Spec.Except {
+		_, ipNet, err := net.ParseCIDR(ipPool.Spec.Except[i])
+		if err != nil {
+			continue
+		}
+		if from, to, ok := rangeOffsets(start, s.length, utils.FirstIP(ipNet), utils.LastIP(ipNet)); ok {
+			s.UseRange(from, to)
+		}
+	}
+
+	for ip := range ipPool.Status.UsedIps {
+		s.useIP(start, net.ParseIP(ip))
+	}
+	for ip := range ipPool.Status.AllocatedIPs {
+		s.useIP(start, net.ParseIP(ip))
+	}
+	return s
+}
+
+// useIP marks the offset of ip relative to start as used, ip out of the pool is ignored
+func (s *poolScanner) useIP(start, ip net.IP) {
+	if off, ok := utils.IPOffset(start, ip); ok && off < s.length {
+		s.used.Insert(off)
+	}
+}
+
+func (s *poolScanner) NextFree(from int64) (int64, bool) {
+	offset, scanned := from, int64(0)
+	for step := 0; step < maxScanSteps && scanned < s.length; step++ {
+		n := int64(1)
+		if r, ok := s.rangeOf(offset); ok {
+			n = r[1] - offset + 1
+		} else if !s.used.Has(offset) {
+			return offset, true
+		}
+		scanned += n
+		offset += n
+		if offset >= s.length {
+			offset -= s.length
+		}
+	}
+	return 0, false
+}
+
+func (s *poolScanner) PrevFree(from int64) (int64, bool) {
+	offset, scanned := from, int64(0)
+	for step := 0; step < maxScanSteps && scanned < s.length; step++ {
+		n := int64(1)
+		if r, ok := s.rangeOf(offset); ok {
+			n = offset - r[0] + 1
+		} else if !s.used.Has(offset) {
+			return offset, true
+		}
+		scanned += n
+		offset -= n
+		if offset < 0 {
+			offset += s.length
+		}
+	}
+	return 0, false
+}
+
+// rangeOf returns the range in ranges which contains offset
+func (s *poolScanner) rangeOf(offset int64) ([2]int64, bool) {
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i][1] >= offset })
+	if i < len(s.ranges) && s.ranges[i][0] <= offset {
+		return s.ranges[i], true
+	}
+	return [2]int64{}, false
+}
+
+func (s *poolScanner) Use(off int64) {
+	s.used.Insert(off)
+}
+
+func (s *poolScanner) UseRange(from, to int64) {
+	s.ranges = append(s.ranges, [2]int64{from, to})
+	sort.Slice(s.ranges, func(i, j int) bool { return s.ranges[i][0] < s.ranges[j][0] })
+	merged := s.ranges[:1]
+	for _, r := range s.ranges[1:] {
+		last := &merged[len(merged)-1]
+		// to+1 can't overflow, to is less than length
+		if r[0] <= last[1]+1 {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.ranges = merged
+}
+
+// excludeNets marks ips in nets as used in index of ipPool, ips out of ipPool are ignored
+func excludeNets(index freeIndex, ipPool *v1alpha1.IPPool, nets []*net.IPNet) {
+	for _, ipNet := range nets {
+		if from, to, ok := rangeOffsets(ipPool.StartIP(), ipPool.Length(), utils.FirstIP(ipNet), utils.LastIP(ipNet)); ok {
+			index.UseRange(from, to)
+		}
+	}
+}
+
+// skipIndex regards offsets in skip as used, skip is small, e.g. quarantined ips
+type skipIndex struct {
+	freeIndex
+	length int64
+	skip   sets.Set[int64]
+}
+
+// withSkip returns index which regards ips in skip as used
+func withSkip(index freeIndex, ipPool *v1alpha1.IPPool, skip []string) freeIndex {
+	offsets := sets.New[int64]()
+	for _, ip := range skip {
+		if off, ok := utils.IPOffset(ipPool.StartIP(), net.ParseIP(ip)); ok && off < ipPool.Length() {
+			offsets.Insert(off)
+		}
+	}
+	if offsets.Len() == 0 {
+		return index
+	}
+	return &skipIndex{freeIndex: index, length: ipPool.Length(), skip: offsets}
+}
+
+func (s *skipIndex) NextFree(from int64) (int64, bool) {
+	return s.find(from, s.freeIndex.NextFree, 1)
+}
+
+func (s *skipIndex) PrevFree(from int64) (int64, bool) {
+	return s.find(from, s.freeIndex.PrevFree, -1)
+}
+
+// find searches in the direction of step, a skipped offset found twice means all free offsets are skipped
+func (s *skipIndex) find(from int64, next func(int64) (int64, bool), step int64) (int64, bool) {
+	for skipped := 0; skipped <= s.skip.Len(); skipped++ {
+		off, ok := next(from)
+		if !ok || !s.skip.Has(off) {
+			return off, ok
+		}
+		from = (off + step + s.length) % s.length
+	}
+	return 0, false
+}
+
+// maxIndexEntries limits the number of cached bitmaps, the least recently used one is evicted, e.g. of a
+// deleted ippool
+const maxIndexEntries = 32
+
+// maxDirtyWords limits the changed words of a cached bitmap, the bitmap is flattened when it is exceeded
+const maxDirtyWords = 1024
+
+// indexCache caches bitmaps of ippools by uid. A cached bitmap is reused while the spec and the fingerprint of
+// the ips in the status of the ippool are unchanged, and it is updated by allocations and releases of the Ipam,
+// so finding a free ip doesn't rebuild the bitmap from the whole ippool each time. The resourceVersion of the
+// ippool isn't the key, allocations create ipallocations without changing the ippool. Cached bitmaps are copy-on-write, a lookup
+// returns an overlay of the cached one instead of copying it
+type indexCache struct {
+	lock    sync.Mutex
+	entries map[k8stypes.UID]*indexEntry
+	// tick orders lookups of entries
+	tick uint64
+}
+
+type indexEntry struct {
+	// spec is the spec the bitmap is built from
+	spec string
+	// fingerprint is the fingerprint of the ips marked by the status bitmap
+	fingerprint uint64
+	used        *ipBitmap
+	lastUsed    uint64
+}
+
+// specKey returns the fields of spec used by the spec bitmap
+func specKey(ipPool *v1alpha1.IPPool) string {
+	s := &ipPool.Spec
+	return strings.Join(append([]string{s.CIDR, s.Start, s.End, s.Subnet, s.Gateway}, s.Except...), ",")
+}
+
+// statusFingerprint returns the fingerprint of the ips marked by the status bitmap, it is the xor of the hashes
+// of the ips, so an ip allocated or released changes it by the hash of the ip
+func statusFingerprint(ipPool *v1alpha1.IPPool) uint64 {
+	var res uint64
+	for ip := range ipPool.Status.AllocatedIPs {
+		res ^= ipHash(ip)
+	}
+	for ip := range ipPool.Status.UsedIps {
+		if _, ok := ipPool.Status.AllocatedIPs[ip]; !ok {
+			res ^= ipHash(ip)
+		}
+	}
+	return res
+}
+
+func ipHash(ip string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(ip))
+	return h.Sum64()
+}
+
+// freeIndex returns the freeIndex of ipPool got from k8s, the returned index is owned by the caller
+func (c *indexCache) freeIndex(ipPool *v1alpha1.IPPool) freeIndex {
+	if ipPool.UID == "" || ipPool.ResourceVersion == "" || ipPool.Length() > maxBitmapLength {
+		return newFreeIndex(ipPool)
+	}
+	key := specKey(ipPool)
+	fingerprint := statusFingerprint(ipPool)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tick++
+	e, ok := c.entries[ipPool.UID]
+	if ok && e.spec == key && e.fingerprint == fingerprint {
+		e.lastUsed = c.tick
+		return e.used.overlay()
+	}
+	var spec *ipBitmap
+	if ok && e.spec == key {
+		spec = e.used.under
+	} else {
+		spec = newSpecBitmap(ipPool)
+	}
+	used := newStatusBitmap(ipPool)
+	used.under = spec
+	used.dirty = make(map[int64]uint64)
+	if c.entries == nil {
+		c.entries = make(map[k8stypes.UID]*indexEntry)
+	}
+	if _, ok := c.entries[ipPool.UID]; !ok && len(c.entries) >= maxIndexEntries {
+		c.evict()
+	}
+	c.entries[ipPool.UID] = &indexEntry{
+		spec:        key,
+		fingerprint: fingerprint,
+		used:        used,
+		lastUsed:    c.tick,
+	}
+	return used.overlay()
+}
+
+// evict removes the least recently used entry
+func (c *indexCache) evict() {
+	var oldest k8stypes.UID
+	for uid, e := range c.entries {
+		if oldest == "" || e.lastUsed < c.entries[oldest].lastUsed {
+			oldest = uid
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// update applies the ips allocated and released in ipPool to the cached bitmap, ipPool has been updated to k8s.
+// The cached bitmap is dropped if it isn't built on the ippool before the update, i.e. the ippool has been
+// changed by others
+func (c *indexCache) update(ipPool *v1alpha1.IPPool, allocated, released []string) {
+	fingerprint := statusFingerprint(ipPool)
+	changed := sets.New(allocated...).Union(sets.New(released...))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[ipPool.UID]
+	if !ok {
+		return
+	}
+	expect := e.fingerprint
+	for ip := range changed {
+		expect ^= ipHash(ip)
+	}
+	if expect != fingerprint {
+		delete(c.entries, ipPool.UID)
+		return
+	}
+	start := ipPool.StartIP()
+	for _, ip := range allocated {
+		e.used.setIP(start, net.ParseIP(ip))
+	}
+	for _, ip := range released {
+		e.used.clearIP(start, net.ParseIP(ip))
+	}
+	if len(e.used.dirty) > maxDirtyWords {
+		e.used = e.used.flatten()
+	}
+	e.fingerprint = fingerprint
+}
@@ -0,0 +1,266 @@
+package ipam
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+func TestIPBitmapNextFree(t *testing.T) {
+	b := newIPBitmap(200)
+	b.SetRange(0, 129)
+	b.Set(131)
+	b.SetRange(133, 199)
+
+	tests := []struct {
+		name    string
+		from    int64
+		exp     int64
+		expFind bool
+	}{
+		{name: "skip full words", from: 0, exp: 130, expFind: true},
+		{name: "from free offset", from: 132, exp: 132, expFind: true},
+		{name: "wrap around", from: 133, exp: 130, expFind: true},
+	}
+	for _, item := range tests {
+		res, ok := b.NextFree(item.from)
+		if ok != item.expFind || res != item.exp {
+			t.Errorf("test %s failed, expect is %d %v, real is %d %v", item.name, item.exp, item.expFind, res, ok)
+		}
+	}
+
+	b.Set(130)
+	b.Set(132)
+	if res, ok := b.NextFree(17); ok {
+		t.Errorf("full bitmap expect no free offset, real is %d", res)
+	}
+}
+
+func TestIPBitmapPrevFree(t *testing.T) {
+	b := newIPBitmap(200)
+	b.SetRange(0, 129)
+	b.Set(131)
+	b.SetRange(133, 199)
+
+	tests := []struct {
+		name    string
+		from    int64
+		exp     int64
+		expFind bool
+	}{
+		{name: "skip full words", from: 199, exp: 132, expFind: true},
+		{name: "from free offset", from: 130, exp: 130, expFind: true},
+		{name: "wrap around", from: 129, exp: 132, expFind: true},
+	}
+	for _, item := range tests {
+		res, ok := b.PrevFree(item.from)
+		if ok != item.expFind || res != item.exp {
+			t.Errorf("test %s failed, expect is %d %v, real is %d %v", item.name, item.exp, item.expFind, res, ok)
+		}
+	}
+
+	b.Set(130)
+	b.Set(132)
+	if res, ok := b.PrevFree(17); ok {
+		t.Errorf("full bitmap expect no free offset, real is %d", res)
+	}
+}
+
+func TestPoolBitmapMatchScanner(t *testing.T) {
+	pools := []v1alpha1.IPPool{
+		{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/22", Subnet: "10.10.0.0/22", Gateway: "10.10.0.1",
+			Except: []string{"10.10.1.0/26", "10.9.0.0/16", "10.10.3.250/31"}}},
+		{Spec: v1alpha1.IPPoolSpec{Start: "10.10.2.3", End: "10.10.3.201", Subnet: "10.10.0.0/16", Gateway: "10.10.2.100"}},
+		{Spec: v1alpha1.IPPoolSpec{CIDR: "fd00::/118", Subnet: "fd00::/118", Gateway: "fd00::1", Except: []string{"fd00::80/121"}}},
+	}
+
+	//nolint:gosec
+	r := rand.New(rand.NewSource(1))
+	for i := range pools {
+		pool := pools[i]
+		pool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+		pool.Status.UsedIps = make(map[string]string)
+		for n := 0; n < int(pool.Length())*9/10; n++ {
+			ip := utils.IPAddOffset(pool.StartIP(), r.Int63n(pool.Length())).String()
+			if n%2 == 0 {
+				pool.Status.AllocatedIPs[ip] = v1alpha1.AllocateInfo{ID: fmt.Sprint(n), Type: v1alpha1.AllocateTypeCNIUsed}
+			} else {
+				pool.Status.UsedIps[ip] = fmt.Sprint(n)
+			}
+		}
+
+		bitmap := newPoolBitmap(&pool)
+		scanner := newPoolScanner(&pool)
+		for from := int64(0); from < pool.Length(); from++ {
+			expOff, expOk := scanner.NextFree(from)
+			off, ok := bitmap.NextFree(from)
+			if off != expOff || ok != expOk {
+				t.Fatalf("pool %d from %d: bitmap returns %d %v, scanner returns %d %v", i, from, off, ok, expOff, expOk)
+			}
+			expOff, expOk = scanner.PrevFree(from)
+			off, ok = bitmap.PrevFree(from)
+			if off != expOff || ok != expOk {
+				t.Fatalf("pool %d prev from %d: bitmap returns %d %v, scanner returns %d %v", i, from, off, ok, expOff, expOk)
+			}
+		}
+	}
+}
+
+func TestPoolScannerLargePool(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "fd00::/66", Subnet: "fd00::/64", Gateway: "fd00::1",
+		Except: []string{"fd00::/68", "fd00:0:0:0:1000::/68"}}}
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"fd00:0:0:0:2000::": {ID: "ns/pod"}}
+	scanner := newPoolScanner(pool)
+
+	if off, ok := scanner.NextFree(0); !ok || utils.IPAddOffset(pool.StartIP(), off).String() != "fd00::2000:0:0:1" {
+		t.Errorf("expect next free ip after except nets, real is %s %v", utils.IPAddOffset(pool.StartIP(), off), ok)
+	}
+	if off, ok := scanner.PrevFree(1 << 61); !ok || off != pool.Length()-1 {
+		t.Errorf("expect prev free offset wraps around to %d, real is %d %v", pool.Length()-1, off, ok)
+	}
+
+	scanner.UseRange(1<<61, pool.Length()-1)
+	if off, ok := scanner.NextFree(1<<61 + 5); ok {
+		t.Errorf("full pool expect no free offset, real is %d", off)
+	}
+	if off, ok := scanner.PrevFree(0); ok {
+		t.Errorf("full pool expect no free offset, real is %d", off)
+	}
+}
+
+func TestSkipIndex(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/29", Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"}}
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"10.10.0.3": {ID: "ns/pod"}}
+	index := withSkip(newFreeIndex(pool), pool, []string{"10.10.0.2", "10.10.0.5", "10.10.1.1"})
+
+	if off, ok := index.NextFree(0); !ok || off != 4 {
+		t.Errorf("expect next free offset 4, real is %d %v", off, ok)
+	}
+	if off, ok := index.PrevFree(5); !ok || off != 4 {
+		t.Errorf("expect prev free offset 4, real is %d %v", off, ok)
+	}
+	index.Use(4)
+	index.Use(6)
+	index.Use(7)
+	if off, ok := index.NextFree(0); ok {
+		t.Errorf("expect no free offset, real is %d", off)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/29", Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"}}
+	pool.UID, pool.ResourceVersion = "uid", "1"
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"10.10.0.2": {ID: "ns/pod2"}}
+	c := indexCache{}
+
+	index := c.freeIndex(pool)
+	if off, ok := index.NextFree(0); !ok || off != 3 {
+		t.Errorf("expect next free offset 3, real is %d %v", off, ok)
+	}
+	index.Use(3)
+	if off, ok := c.freeIndex(pool).NextFree(0); !ok || off != 3 {
+		t.Errorf("index is owned by the caller, expect cached offset 3, real is %d %v", off, ok)
+	}
+
+	// allocations don't change the resourceVersion of the ippool
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"10.10.0.3": {ID: "ns/pod3"}}
+	c.update(pool, []string{"10.10.0.3"}, []string{"10.10.0.2"})
+	if e := c.entries[pool.UID]; e.fingerprint != statusFingerprint(pool) {
+		t.Errorf("expect cached bitmap updated to the ippool, real is %+v", e)
+	}
+	if off, ok := c.freeIndex(pool).NextFree(0); !ok || off != 2 {
+		t.Errorf("expect released offset 2 free, real is %d %v", off, ok)
+	}
+
+	// the ippool has been changed by others before the update
+	pool.Status.AllocatedIPs["10.10.0.4"] = v1alpha1.AllocateInfo{ID: "ns/pod4"}
+	pool.Status.AllocatedIPs["10.10.0.5"] = v1alpha1.AllocateInfo{ID: "ns/pod5"}
+	c.update(pool, []string{"10.10.0.5"}, nil)
+	if _, ok := c.entries[pool.UID]; ok {
+		t.Errorf("cached bitmap built on other status should be dropped")
+	}
+
+	// the ippool has been changed by others
+	c.freeIndex(pool)
+	pool.Status.AllocatedIPs["10.10.0.2"] = v1alpha1.AllocateInfo{ID: "ns/pod2"}
+	if off, ok := c.freeIndex(pool).NextFree(0); !ok || off != 6 {
+		t.Errorf("expect rebuilt next free offset 6, real is %d %v", off, ok)
+	}
+}
+
+func TestIndexCacheCopyOnWrite(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/24", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1"}}
+	pool.UID, pool.ResourceVersion = "uid", "1"
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"10.10.0.2": {ID: "ns/pod2"}}
+	c := indexCache{}
+
+	index := c.freeIndex(pool)
+	index.Use(3)
+	pool.Status.AllocatedIPs["10.10.0.4"] = v1alpha1.AllocateInfo{ID: "ns/pod4"}
+	c.update(pool, []string{"10.10.0.4"}, nil)
+	if off, ok := index.NextFree(4); !ok || off != 4 {
+		t.Errorf("the index got before isn't changed by the cache, expect offset 4 free, real is %d %v", off, ok)
+	}
+	if off, ok := c.freeIndex(pool).NextFree(0); !ok || off != 3 {
+		t.Errorf("the cache isn't changed by the index, expect next free offset 3, real is %d %v", off, ok)
+	}
+	if e := c.entries[pool.UID]; len(e.used.dirty) != 1 {
+		t.Errorf("expect the allocation kept in dirty words, real is %v", e.used.dirty)
+	}
+}
+
+func TestIndexCacheEvict(t *testing.T) {
+	c := indexCache{}
+	newPool := func(n int) *v1alpha1.IPPool {
+		pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/29", Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"}}
+		pool.UID, pool.ResourceVersion = k8stypes.UID(fmt.Sprint(n)), "1"
+		return pool
+	}
+	c.freeIndex(newPool(0))
+	for n := 1; n <= maxIndexEntries; n++ {
+		c.freeIndex(newPool(n))
+		// the first pool is still in use
+		c.freeIndex(newPool(0))
+	}
+	if len(c.entries) != maxIndexEntries {
+		t.Errorf("expect %d cached entries, real is %d", maxIndexEntries, len(c.entries))
+	}
+	if _, ok := c.entries["0"]; !ok {
+		t.Errorf("the recently used entry shouldn't be evicted")
+	}
+	if _, ok := c.entries["1"]; ok {
+		t.Errorf("the least recently used entry should be evicted")
+	}
+}
+
+func TestExcludeNets(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"}}
+	pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{"10.10.0.2": {ID: "ns/pod"}}
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.10.0.3/32", "10.10.0.4/30", "10.10.1.0/24", "fd00::/64"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+
+	var c indexCache
+	pool.UID, pool.ResourceVersion = "uid", "1"
+	for _, index := range []freeIndex{newPoolBitmap(pool), newPoolScanner(pool), c.freeIndex(pool)} {
+		excludeNets(index, pool, nets)
+		if off, ok := index.NextFree(0); !ok || off != 8 {
+			t.Errorf("%T expect next free offset 8, real is %d %v", index, off, ok)
+		}
+		if off, ok := index.PrevFree(7); !ok || off != 15 {
+			t.Errorf("%T expect prev free offset 15, real is %d %v", index, off, ok)
+		}
+	}
+	// the cached index isn't changed by the excluded nets
+	if off, ok := c.freeIndex(pool).NextFree(0); !ok || off != 3 {
+		t.Errorf("expect next free offset 3 of the cached index, real is %d %v", off, ok)
+	}
+}
@@ -0,0 +1,340 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+// allocateFromBlock allocates ip from IPBlocks of conf.NodeName, claims a new IPBlock when all of them are full
+func (i *Ipam) allocateFromBlock(ctx context.Context, conf *NetConf, ipPool *v1alpha1.IPPool) (*cniv1.Result, error) {
+	if conf.NodeName == "" {
+		return nil, fmt.Errorf("%w: must set NodeName to allocate ip from ippool %s in block mode", ErrInvalidRequest, ipPool.Name)
+	}
+
+	var res *cniv1.Result
+	attempt := 0
+	err := retryOnError(i.findBackoff, ipClaimed, ipPool.Name, conf.Type, func() error {
+		// the ip found has been claimed in the ippool, reload the ippool to skip it
+		if attempt++; attempt > 1 {
+			req := k8stypes.NamespacedName{Namespace: i.namespace, Name: ipPool.Name}
+			ipPool = &v1alpha1.IPPool{}
+			if _, err := v1alpha1.GetIPPool(ctx, i.k8sClient, req, ipPool); err != nil {
+				klog.Errorf("Failed to get ippool %s, err: %v", req, err)
+				return poolGetError(req, err)
+			}
+		}
+		// claim a new block when all blocks of the node are full, then allocate in the new block
+		for claimed := false; ; claimed = true {
+			blocks, err := i.listBlocks(ctx, ipPool.Name, conf.NodeName)
+			if err != nil {
+				return err
+			}
+			reservations, err := i.listReservations(ctx, ipPool.Name)
+			if err != nil {
+				return err
+			}
+			ip, err := i.allocateInBlocks(ctx, conf, ipPool, reservedNets(reservations), blocks)
+			if err != nil {
+				klog.Errorf("Failed to allocate ip in ipblocks of node %s, err: %v", conf.NodeName, err)
+				return err
+			}
+			if ip != "" {
+				conf.IP = ip
+				res = i.ParseResult(ipPool, ip)
+				return nil
+			}
+			if claimed {
+				return fmt.Errorf("%w: find valid ip error in pool %s", ErrPoolFull, conf.Pool)
+			}
+			if err := i.claimBlock(ctx, ipPool, conf.NodeName); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// allocateInBlocks returns an empty ip when all blocks are full, ips in reserved are skipped
+func (i *Ipam) allocateInBlocks(ctx context.Context, conf *NetConf, ipPool *v1alpha1.IPPool, reserved []*net.IPNet,
+	blocks []v1alpha1.IPBlock) (string, error) {
+	for index := range blocks {
+		ip, err := i.allocateInBlock(ctx, conf, ipPool, reserved, &blocks[index])
+		if err != nil {
+			return "", err
+		}
+		if ip == "" {
+			continue
+		}
+		if err := i.checkClaimInPool(ctx, ipPool, blocks[index].Name, ip, conf.genAllocateInfo()); err != nil {
+			return "", err
+		}
+		return ip, nil
+	}
+	return "", nil
+}
+
+// allocateInBlock claims a free ip in block, it returns an empty ip when the block is full. The block is reloaded
+// and the ip is found again when the block has been changed by others
+func (i *Ipam) allocateInBlock(ctx context.Context, conf *NetConf, ipPool *v1alpha1.IPPool, reserved []*net.IPNet,
+	block *v1alpha1.IPBlock) (string, error) {
+	var ip string
+	attempt := 0
+	err := retryOnError(i.updateBackoff, apierrors.IsConflict, ipPool.Name, conf.Type, func() error {
+		ip = ""
+		if attempt++; attempt > 1 {
+			req := k8stypes.NamespacedName{Namespace: block.Namespace, Name: block.Name}
+			*block = v1alpha1.IPBlock{}
+			if err := i.k8sClient.Get(ctx, req, block); err != nil {
+				return err
+			}
+		}
+		view := block.ToIPPool(ipPool)
+		free := newFreeIndex(view)
+		excludeNets(free, view, reserved)
+		newIP, newOffset := findNextIn(view, free)
+		if newOffset == constants.IPPoolOffsetFull || newOffset == constants.IPPoolOffsetErr {
+			return nil
+		}
+		if block.Status.AllocatedIPs == nil {
+			block.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
+		}
+		block.Status.AllocatedIPs[newIP.String()] = conf.genAllocateInfo()
+		delete(block.Status.QuarantinedIPs, newIP.String())
+		if newOffset != constants.IPPoolOffsetIgnore {
+			block.Status.Offset = newOffset
+		}
+		patch, err := utils.StatusPatch(block, block.Status)
+		if err != nil {
+			return err
+		}
+		if err := i.k8sClient.Status().Patch(ctx, block, patch); err != nil {
+			return err
+		}
+		ip = newIP.String()
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("update ipblock %s failed, err: %w", block.Name, err)
+	}
+	return ip, nil
+}
+
+// checkClaimInBlocks checks ip of conf claimed in the ippool status against ipblocks after the claim, and rolls
+// back the claim when an ipblock has allocated the ip concurrently. The two claims are written to different
+// objects, allocation in ipblock checks the ippool after its claim too, so at least one of them finds the other
+func (i *Ipam) checkClaimInBlocks(ctx context.Context, ipPool *v1alpha1.IPPool, conf *NetConf) error {
+	inBlock, err := i.allocatedInBlocks(ctx, ipPool, conf.IP)
+	if err == nil && !inBlock {
+		return nil
+	}
+	if relErr := i.releasePoolIP(ctx, ipPool.Name, conf.IP, conf.genAllocateInfo()); relErr != nil {
+		klog.Errorf("Failed to roll back ip %s in ippool %s claimed by ipblock, err: %v", conf.IP, ipPool.Name, relErr)
+	}
+	if err != nil {
+		return err
+	}
+	return &IPInUseError{IP: conf.IP, Pool: ipPool.Name}
+}
+
+// checkClaimInPool checks ip claimed in ipblock name against the ipallocation of the ippool after the claim,
+// and rolls back the claim when the ippool has allocated the ip concurrently, see checkClaimInBlocks
+func (i *Ipam) checkClaimInPool(ctx context.Context, ipPool *v1alpha1.IPPool, name, ip string, a v1alpha1.AllocateInfo) error {
+	allocation := v1alpha1.IPAllocation{}
+	req := k8stypes.NamespacedName{Namespace: i.namespace, Name: utils.GenAllocationName(ipPool.Name, ip)}
+	err := i.k8sClient.Get(ctx, req, &allocation)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if relErr := i.releaseBlockIP(ctx, ipPool, name, ip, a, false); relErr != nil {
+		klog.Errorf("Failed to roll back ip %s in ipblock %s claimed by ippool, err: %v", ip, name, relErr)
+	}
+	if err != nil {
+		return err
+	}
+	return &IPInUseError{IP: ip, Pool: ipPool.Name, Holder: allocation.Spec.AllocateInfo}
+}
+
+// claimBlock creates the first unclaimed IPBlock of ipPool for node, the IPBlock name is deterministic,
+// so only one node can create it successfully
+func (i *Ipam) claimBlock(ctx context.Context, ipPool *v1alpha1.IPPool, node string) error {
+	blocks, err := i.listBlocks(ctx, ipPool.Name, "")
+	if err != nil {
+		return err
+	}
+	claimed := sets.New[string]()
+	for index := range blocks {
+		claimed.Insert(blocks[index].Spec.CIDR)
+	}
+
+	for index, total := int64(0), blockCount(ipPool); index < total; index++ {
+		ipNet := blockCIDR(ipPool, index)
+		if claimed.Has(ipNet.String()) {
+			continue
+		}
+		block := v1alpha1.IPBlock{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: i.namespace,
+				Name:      utils.GenBlockName(ipPool.Name, ipNet),
+				Labels:    v1alpha1.BlockLabels(ipPool.Name, node),
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: v1alpha1.SchemeGroupVersion.String(),
+					Kind:       "IPPool",
+					Name:       ipPool.Name,
+					UID:        ipPool.UID,
+				}},
+			},
+			Spec: v1alpha1.IPBlockSpec{
+				Pool: ipPool.Name,
+				Node: node,
+				CIDR: ipNet.String(),
+			},
+		}
+		// skip block has no ip to allocate, e.g. all ip in spec.except
+		if _, offset := i.FindNext(block.ToIPPool(ipPool)); offset == constants.IPPoolOffsetFull {
+			continue
+		}
+		err := i.k8sClient.Create(ctx, &block)
+		if err == nil {
+			klog.Infof("Node %s claims ipblock %s %s in ippool %s", node, block.Name, block.Spec.CIDR, ipPool.Name)
+			return nil
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("create ipblock %s error, err: %w", block.Name, err)
+		}
+	}
+
+	return fmt.Errorf("%w: no free ipblock in ippool %s", ErrPoolFull, ipPool.Name)
+}
+
+// releaseFromBlocks releases ip of conf in all IPBlocks of ipPool
+func (i *Ipam) releaseFromBlocks(ctx context.Context, conf *NetConf, ipPool *v1alpha1.IPPool) error {
+	blocks, err := i.listBlocks(ctx, ipPool.Name, "")
+	if err != nil {
+		return err
+	}
+	for index := range blocks {
+		for ip, a := range blocks[index].Status.AllocatedIPs {
+			if a.Type.HeldByOwner() || !isSameAllocateInfo(a, conf) {
+				continue
+			}
+			if err := i.releaseBlockIP(ctx, ipPool, blocks[index].Name, ip, a, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseBlockIP releases ip from ipblock name when it is still allocated with a, the ip is quarantined if quarantine
+func (i *Ipam) releaseBlockIP(ctx context.Context, ipPool *v1alpha1.IPPool, name, ip string, a v1alpha1.AllocateInfo, quarantine bool) error {
+	req := k8stypes.NamespacedName{
+		Name:      name,
+		Namespace: i.namespace,
+	}
+	err := retryOnError(i.updateBackoff, apierrors.IsConflict, ipPool.Name, a.Type, func() error {
+		block := v1alpha1.IPBlock{}
+		if err := i.k8sClient.Get(ctx, req, &block); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			klog.Errorf("get ipblock error, err %s", err)
+			return err
+		}
+		if cur, ok := block.Status.AllocatedIPs[ip]; !ok || cur != a {
+			return nil
+		}
+		delete(block.Status.AllocatedIPs, ip)
+		if quarantine {
+			block.Quarantine(ipPool, ip, time.Now())
+		}
+		patch, err := utils.StatusPatch(&block, block.Status)
+		if err != nil {
+			return err
+		}
+		if err := i.k8sClient.Status().Patch(ctx, &block, patch); err != nil {
+			klog.Errorf("update ipblock %v error: %v", req, err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update ipblock %v failed, err: %w", req, err)
+	}
+	return nil
+}
+
+// allocatedInBlocks checks whether ip has been allocated in any IPBlock of ipPool
+func (i *Ipam) allocatedInBlocks(ctx context.Context, ipPool *v1alpha1.IPPool, ip string) (bool, error) {
+	blocks, err := i.listBlocks(ctx, ipPool.Name, "")
+	if err != nil {
+		return false, err
+	}
+	for index := range blocks {
+		if _, ok := blocks[index].Status.AllocatedIPs[ip]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// excludeBlocks marks ips of all claimed IPBlocks of ipPool as used in index
+func (i *Ipam) excludeBlocks(ctx context.Context, ipPool *v1alpha1.IPPool, index freeIndex) error {
+	blocks, err := i.listBlocks(ctx, ipPool.Name, "")
+	if err != nil {
+		return err
+	}
+	nets := make([]*net.IPNet, 0, len(blocks))
+	for n := range blocks {
+		if _, ipNet, err := net.ParseCIDR(blocks[n].Spec.CIDR); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	excludeNets(index, ipPool, nets)
+	return nil
+}
+
+// listBlocks lists IPBlocks of pool sorted by name, only blocks of node are listed if node isn't empty
+func (i *Ipam) listBlocks(ctx context.Context, pool, node string) ([]v1alpha1.IPBlock, error) {
+	blocks, err := v1alpha1.ListBlocks(ctx, i.k8sClient, i.namespace, pool, node)
+	if err != nil {
+		klog.Errorf("list ipblocks of ippool %s error, err: %s", pool, err)
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// blockCount returns the number of blocks in ipPool spec.cidr, it saturates at math.MaxInt64
+func blockCount(ipPool *v1alpha1.IPPool) int64 {
+	_, ipNet, _ := net.ParseCIDR(ipPool.Spec.CIDR)
+	ones, _ := ipNet.Mask.Size()
+	return utils.SaturatedInt64(new(big.Int).Lsh(big.NewInt(1), uint(int(ipPool.Spec.BlockSize)-ones)))
+}
+
+// blockCIDR returns the index-th block of ipPool spec.cidr
+func blockCIDR(ipPool *v1alpha1.IPPool, index int64) *net.IPNet {
+	_, ipNet, _ := net.ParseCIDR(ipPool.Spec.CIDR)
+	_, bits := ipNet.Mask.Size()
+	n := new(big.Int).Lsh(big.NewInt(index), uint(bits-int(ipPool.Spec.BlockSize)))
+	n.Add(n, utils.IPToBigInt(ipNet.IP))
+	return &net.IPNet{
+		IP:   utils.BigIntToIP(n, utils.IsIPv4(ipNet.IP)).Mask(net.CIDRMask(int(ipPool.Spec.BlockSize), bits)),
+		Mask: net.CIDRMask(int(ipPool.Spec.BlockSize), bits),
+	}
+}
@@ -0,0 +1,78 @@
+package ipam
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/utils"
+)
+
+func TestBlockCIDR(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidr      string
+		blockSize int32
+		index     int64
+		expCount  int64
+		expCIDR   string
+		expName   string
+	}{
+		{name: "first ipv4 block", cidr: "10.10.0.0/20", blockSize: 28, index: 0, expCount: 256, expCIDR: "10.10.0.0/28", expName: "pool-10-10-0-0-28"},
+		{name: "last ipv4 block", cidr: "10.10.0.0/20", blockSize: 28, index: 255, expCount: 256, expCIDR: "10.10.15.240/28", expName: "pool-10-10-15-240-28"},
+		{name: "block equals cidr", cidr: "10.10.0.0/24", blockSize: 24, index: 0, expCount: 1, expCIDR: "10.10.0.0/24", expName: "pool-10-10-0-0-24"},
+		{name: "ipv6 block", cidr: "fd00::/112", blockSize: 120, index: 3, expCount: 256, expCIDR: "fd00::300/120", expName: "pool-fd00--300-120"},
+		{name: "huge ipv6 block count", cidr: "fd00::/32", blockSize: 122, index: 1, expCount: math.MaxInt64, expCIDR: "fd00::40/122", expName: "pool-fd00--40-122"},
+	}
+
+	for _, item := range tests {
+		pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{CIDR: item.cidr, BlockSize: item.blockSize}}
+		if count := blockCount(pool); count != item.expCount {
+			t.Errorf("test %s failed, expect block count is %d, real is %d", item.name, item.expCount, count)
+		}
+		ipNet := blockCIDR(pool, item.index)
+		if ipNet.String() != item.expCIDR {
+			t.Errorf("test %s failed, expect block cidr is %s, real is %s", item.name, item.expCIDR, ipNet)
+		}
+		if name := utils.GenBlockName("pool", ipNet); name != item.expName {
+			t.Errorf("test %s failed, expect block name is %s, real is %s", item.name, item.expName, name)
+		}
+	}
+}
+
+func TestClaimBlockLongName(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: strings.Repeat("p", 100)},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/24", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1", BlockSize: 28},
+	}
+	node := strings.Repeat("n", 100)
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool.DeepCopy()).Build()
+	i := InitIpam(k8sClient, "ipam")
+
+	if err := i.claimBlock(context.Background(), pool, node); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := i.listBlocks(context.Background(), pool.Name, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Spec.Node != node || blocks[0].Spec.CIDR != "10.10.0.0/28" {
+		t.Fatalf("expect the claimed ipblock 10.10.0.0/28 of node, real is %v", blocks)
+	}
+	for _, value := range blocks[0].Labels {
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			t.Errorf("ipblock label %s should be a valid label value, real errs: %v", value, errs)
+		}
+	}
+}
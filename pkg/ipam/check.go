@@ -0,0 +1,167 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+// ExecCheck verifies the allocation of conf still exists and is consistent with its ippool, it is ExecCheckResult
+// without prevResult
+func (i *Ipam) ExecCheck(conf *NetConf) error {
+	return i.ExecCheckResult(context.Background(), conf, nil)
+}
+
+// ExecCheckResult verifies the allocation of conf still exists and is consistent with its ippool, prevResult is the
+// result returned by ExecAdd and is compared with the ippool when it isn't nil
+func (i *Ipam) ExecCheckResult(ctx context.Context, conf *NetConf, prevResult *cniv1.Result) error {
+	if err := conf.Valid(); err != nil {
+		klog.Errorf("Invalid param %v, err: %v", *conf, err)
+		return err
+	}
+
+	if !conf.DualStack {
+		return i.execCheck(ctx, conf, "", prevResult)
+	}
+	for _, family := range []v1alpha1.IPFamily{v1alpha1.IPFamilyIPv4, v1alpha1.IPFamilyIPv6} {
+		if err := i.execCheck(ctx, conf.familyConf(family), family, prevResult); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Ipam) execCheck(ctx context.Context, conf *NetConf, family v1alpha1.IPFamily, prevResult *cniv1.Result) error {
+	pools, err := i.checkPools(ctx, conf, family)
+	if err != nil {
+		return err
+	}
+
+	var mismatch error
+	for _, pool := range pools {
+		ip, err := i.findAllocation(ctx, pool, conf)
+		if err != nil {
+			mismatch = err
+			continue
+		}
+		if ip == "" {
+			continue
+		}
+		if !pool.Contains(net.ParseIP(ip)) {
+			return fmt.Errorf("%w: ip %s isn't in ippool %s after spec changes", ErrIPOutOfPool, ip, pool.Name)
+		}
+		if prevResult != nil {
+			return checkIPConfig(prevResult, i.ParseResult(pool, ip).IPs[0])
+		}
+		return nil
+	}
+
+	if mismatch != nil {
+		return mismatch
+	}
+	return fmt.Errorf("%w: no ip allocated to %s in ippools", ErrAllocationNotFound, conf.getAllocateID())
+}
+
+// checkPools returns ippools specified by conf.Pool, or all ippools of family when conf.Pool is empty
+func (i *Ipam) checkPools(ctx context.Context, conf *NetConf, family v1alpha1.IPFamily) ([]*v1alpha1.IPPool, error) {
+	var pools []*v1alpha1.IPPool
+	if conf.Pool != "" {
+		for _, name := range splitPools(conf.Pool) {
+			pool := v1alpha1.IPPool{}
+			req := k8stypes.NamespacedName{Namespace: i.namespace, Name: name}
+			if _, err := v1alpha1.GetIPPool(ctx, i.k8sClient, req, &pool); err != nil {
+				return nil, poolGetError(req, err)
+			}
+			pools = append(pools, &pool)
+		}
+		return pools, nil
+	}
+
+	ipPools := v1alpha1.IPPoolList{}
+	if err := i.k8sClient.List(ctx, &ipPools, client.InNamespace(i.namespace)); err != nil {
+		klog.Errorf("list ipPool error, err:%s", err)
+		return nil, err
+	}
+	if _, err := v1alpha1.LoadAllocationsForList(ctx, i.k8sClient, &ipPools, client.InNamespace(i.namespace)); err != nil {
+		klog.Errorf("load ipallocations error, err:%s", err)
+		return nil, err
+	}
+	for index := range ipPools.Items {
+		if family != "" && ipPools.Items[index].IPFamily() != family {
+			continue
+		}
+		pools = append(pools, &ipPools.Items[index])
+	}
+	return pools, nil
+}
+
+// findAllocation returns the ip allocated to conf in ipPool, the ip is empty if not found. An error is returned when
+// the ip is allocated to the same id but the allocate info mismatch the request
+func (i *Ipam) findAllocation(ctx context.Context, ipPool *v1alpha1.IPPool, conf *NetConf) (string, error) {
+	allocated := ipPool.Status.AllocatedIPs
+	if ipPool.BlockMode() {
+		blocks, err := i.listBlocks(ctx, ipPool.Name, "")
+		if err != nil {
+			return "", err
+		}
+		allocated = make(map[string]v1alpha1.AllocateInfo, len(ipPool.Status.AllocatedIPs))
+		for ip, a := range ipPool.Status.AllocatedIPs {
+			allocated[ip] = a
+		}
+		for index := range blocks {
+			for ip, a := range blocks[index].Status.AllocatedIPs {
+				allocated[ip] = a
+			}
+		}
+	}
+
+	var mismatch error
+	for ip, a := range allocated {
+		if conf.IP != "" && ip != conf.IP {
+			continue
+		}
+		if a.Type != conf.Type || a.ID != conf.getAllocateID() {
+			continue
+		}
+		if !isSameAllocateInfo(a, conf) {
+			mismatch = fmt.Errorf("%w: ip %s in ippool %s is allocated to %+v", ErrAllocationMismatch, ip, ipPool.Name, a)
+			continue
+		}
+		return ip, nil
+	}
+
+	// UsedIps is the legacy status of type cniused
+	if conf.Type == v1alpha1.AllocateTypeCNIUsed {
+		for ip, id := range ipPool.Status.UsedIps {
+			if id == conf.AllocateIdentify && (conf.IP == "" || ip == conf.IP) {
+				return ip, nil
+			}
+		}
+	}
+	return "", mismatch
+}
+
+// checkIPConfig checks ip config in prevResult is the same as exp
+func checkIPConfig(prevResult *cniv1.Result, exp *cniv1.IPConfig) error {
+	expOnes, _ := exp.Address.Mask.Size()
+	for _, c := range prevResult.IPs {
+		if c == nil || !c.Address.IP.Equal(exp.Address.IP) {
+			continue
+		}
+		if ones, _ := c.Address.Mask.Size(); ones != expOnes {
+			return fmt.Errorf("%w: ip %s mask is %s, expect is %s", ErrIPConfigMismatch, c.Address.IP, c.Address.Mask, exp.Address.Mask)
+		}
+		if !c.Gateway.Equal(exp.Gateway) {
+			return fmt.Errorf("%w: ip %s gateway is %s, expect is %s", ErrIPConfigMismatch, c.Address.IP, c.Gateway, exp.Gateway)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: ip %s isn't in prevResult", ErrIPConfigMismatch, exp.Address.IP)
+}
@@ -0,0 +1,72 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func TestCheckIPConfig(t *testing.T) {
+	newIPConfig := func(cidr, gw string) *cniv1.IPConfig {
+		ip, ipNet, _ := net.ParseCIDR(cidr)
+		return &cniv1.IPConfig{
+			Address: net.IPNet{IP: ip, Mask: ipNet.Mask},
+			Gateway: net.ParseIP(gw),
+		}
+	}
+	exp := newIPConfig("10.10.65.2/20", "10.10.64.1")
+
+	tests := []struct {
+		name   string
+		result *cniv1.Result
+		expErr error
+	}{
+		{
+			name:   "same ip config",
+			result: &cniv1.Result{IPs: []*cniv1.IPConfig{newIPConfig("fd00::2/64", "fd00::1"), newIPConfig("10.10.65.2/20", "10.10.64.1")}},
+			expErr: nil,
+		},
+		{
+			name:   "mask changed",
+			result: &cniv1.Result{IPs: []*cniv1.IPConfig{newIPConfig("10.10.65.2/24", "10.10.64.1")}},
+			expErr: ErrIPConfigMismatch,
+		},
+		{
+			name:   "gateway changed",
+			result: &cniv1.Result{IPs: []*cniv1.IPConfig{newIPConfig("10.10.65.2/20", "10.10.64.2")}},
+			expErr: ErrIPConfigMismatch,
+		},
+		{
+			name:   "ip not in result",
+			result: &cniv1.Result{IPs: []*cniv1.IPConfig{newIPConfig("10.10.65.3/20", "10.10.64.1")}},
+			expErr: ErrIPConfigMismatch,
+		},
+	}
+	for _, item := range tests {
+		err := checkIPConfig(item.result, exp)
+		if item.expErr == nil && err != nil {
+			t.Errorf("test %s failed, expect no error, real is %s", item.name, err)
+		}
+		if item.expErr != nil && !errors.Is(err, item.expErr) {
+			t.Errorf("test %s failed, expect error %s, real is %v", item.name, item.expErr, err)
+		}
+	}
+}
+
+func TestExecCheckPoolNotFound(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	i := InitIpam(fake.NewClientBuilder().WithScheme(scheme).Build(), "ipam")
+	conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod", K8sPodNs: "ns", AllocateIdentify: "cid"}
+	if err := i.ExecCheck(&conf); !errors.Is(err, ErrPoolNotFound) {
+		t.Errorf("expect error wraps ErrPoolNotFound for missing ippool, real is %v", err)
+	}
+}
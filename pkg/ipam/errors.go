@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+// errors returned by ExecAdd, ExecDel, ExecCheck, ExecCheckResult, the batch requests and NetConf.Complete, they are
+// wrapped with details and can be checked by errors.Is
+var (
+	// ErrAllocationNotFound is returned by ExecCheck when the ip isn't allocated to the request
+	ErrAllocationNotFound = errors.New("ip allocation not found")
+	// ErrAllocationMismatch is returned by ExecCheck when the ip is allocated to others
+	ErrAllocationMismatch = errors.New("ip allocation info mismatch")
+	// ErrIPOutOfPool is returned when the ip to check or the static ip to allocate is out of the ippool
+	ErrIPOutOfPool = errors.New("ip is out of ippool")
+	// ErrIPConfigMismatch is returned by ExecCheck when the ip config differs from the ippool
+	ErrIPConfigMismatch = errors.New("ip config mismatch with ippool")
+	// ErrQuotaExceeded is returned when the namespace of the request holds spec.namespaceQuotas ips in the ippool
+	ErrQuotaExceeded = errors.New("ip quota exceeded")
+	// ErrPoolNotFound is returned when the ippool of the request doesn't exist
+	ErrPoolNotFound = errors.New("ippool not found")
+	// ErrPoolFull is returned when the ippool has no free ip for the request
+	ErrPoolFull = errors.New("ippool has no ip to allocate")
+	// ErrIPInUse is returned when the ip has been used or allocated to others, it is wrapped in *IPInUseError
+	ErrIPInUse = errors.New("ip address in use")
+	// ErrInvalidRequest is returned when the request or its annotations are invalid
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrConflictRetriesExhausted is returned when the request still conflicts after all retries
+	ErrConflictRetriesExhausted = errors.New("conflict retries exhausted")
+)
+
+// IPInUseError is returned when the ip to allocate has been used or allocated to others, Holder is the
+// allocate info of the ip, its ID is the container id for ip in status.usedips, it is empty when the holder
+// is unknown, e.g. ip allocated in ipblocks or reserved by ipreservations
+type IPInUseError struct {
+	IP     string
+	Pool   string
+	Holder v1alpha1.AllocateInfo
+}
+
+func (e *IPInUseError) Error() string {
+	if e.Holder == (v1alpha1.AllocateInfo{}) {
+		return fmt.Sprintf("ip %s in ippool %s is already in use", e.IP, e.Pool)
+	}
+	return fmt.Sprintf("ip %s in ippool %s is already in use by %+v", e.IP, e.Pool, e.Holder)
+}
+
+func (e *IPInUseError) Unwrap() error {
+	return ErrIPInUse
+}
+
+// usedIPHolder returns the holder of ip in status.usedips of ipPool
+func usedIPHolder(ipPool *v1alpha1.IPPool, ip string) v1alpha1.AllocateInfo {
+	return v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeCNIUsed, ID: ipPool.Status.UsedIps[ip]}
+}
+
+// claimedError returns *IPInUseError of ippool pool when err is the *v1alpha1.AllocationClaimedError of SyncAllocations
+func claimedError(pool string, err error) error {
+	var claimed *v1alpha1.AllocationClaimedError
+	if errors.As(err, &claimed) {
+		return &IPInUseError{IP: claimed.IP, Pool: pool, Holder: claimed.Holder}
+	}
+	return err
+}
+
+// syncConflict returns whether err is a conflict or an ip claimed by others in SyncAllocations, the batch request
+// allocates all ips again on the latest ippool for it
+func syncConflict(err error) bool {
+	var claimed *v1alpha1.AllocationClaimedError
+	return apierrors.IsConflict(err) || errors.As(err, &claimed)
+}
+
+// inUseIP returns the ip of *IPInUseError in err, it is empty for other errors
+func inUseIP(err error) string {
+	var inUse *IPInUseError
+	if errors.As(err, &inUse) {
+		return inUse.IP
+	}
+	return ""
+}
+
+// poolGetError wraps the error of getting ippool key, it wraps ErrPoolNotFound when the ippool doesn't exist
+func poolGetError(key k8stypes.NamespacedName, err error) error {
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrPoolNotFound, key)
+	}
+	return fmt.Errorf("get ip pool %s error, err: %w", key, err)
+}
+
+// ipClaimed returns whether the ip to allocate has been claimed by others, ExecAdd retries with another ip for it.
+// Conflicts are retried by the update of ippool or ipblock itself, they aren't retried again with another ip
+func ipClaimed(err error) bool {
+	return errors.Is(err, ErrIPInUse)
+}
+
+// retryOnError retries fn with backoff while the error is retriable, the error is wrapped with
+// ErrConflictRetriesExhausted when the backoff is exhausted. Retries and retriable errors are counted
+// by pool and allocate type t
+func retryOnError(backoff wait.Backoff, retriable func(error) bool, pool string, t v1alpha1.AllocateType, fn func() error) error {
+	attempt := 0
+	err := retry.OnError(backoff, retriable, func() error {
+		if attempt++; attempt > 1 {
+			retries.WithLabelValues(pool, string(t)).Inc()
+		}
+		err := fn()
+		if err != nil && retriable(err) {
+			conflicts.WithLabelValues(pool, string(t)).Inc()
+		}
+		return err
+	})
+	if err != nil && retriable(err) {
+		return fmt.Errorf("%w: %w", ErrConflictRetriesExhausted, err)
+	}
+	return err
+}
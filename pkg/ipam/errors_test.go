@@ -0,0 +1,116 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func TestIPClaimed(t *testing.T) {
+	conflict := apierrors.NewConflict(v1alpha1.Resource("ippools"), "pool", fmt.Errorf("changed"))
+	tests := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{name: "conflict", err: conflict, exp: false},
+		{name: "conflict retries exhausted", err: fmt.Errorf("update ipPool failed, err: %w",
+			fmt.Errorf("%w: %w", ErrConflictRetriesExhausted, conflict)), exp: false},
+		{name: "ip in use", err: &IPInUseError{IP: "10.10.0.2", Pool: "pool"}, exp: true},
+		{name: "not found", err: apierrors.NewNotFound(v1alpha1.Resource("ippools"), "pool"), exp: false},
+		{name: "quota exceeded", err: ErrQuotaExceeded, exp: false},
+	}
+	for _, item := range tests {
+		if res := ipClaimed(item.err); res != item.exp {
+			t.Errorf("test %s failed, expect %v, real %v", item.name, item.exp, res)
+		}
+	}
+}
+
+func TestBackoffOption(t *testing.T) {
+	i := InitIpam(nil, "ns")
+	if i.updateBackoff != DefaultUpdateBackoff || i.findBackoff != DefaultFindBackoff {
+		t.Errorf("expect default backoff, real update %+v, find %+v", i.updateBackoff, i.findBackoff)
+	}
+
+	update := wait.Backoff{Steps: 10, Duration: 1, Factor: 1.5, Jitter: 0.2}
+	i = InitIpam(nil, "ns", WithUpdateBackoff(update), WithFindBackoff(wait.Backoff{}))
+	if i.updateBackoff != update {
+		t.Errorf("expect update backoff %+v, real %+v", update, i.updateBackoff)
+	}
+	if i.findBackoff.Steps != 1 {
+		t.Errorf("find backoff should try at least once, real %+v", i.findBackoff)
+	}
+}
+
+func TestIPInUseError(t *testing.T) {
+	holder := v1alpha1.AllocateInfo{ID: "ns/pod", Type: v1alpha1.AllocateTypePod, CID: "cid"}
+	err := fmt.Errorf("update ipPool failed, err: %w", &IPInUseError{IP: "10.10.0.2", Pool: "pool", Holder: holder})
+	if !errors.Is(err, ErrIPInUse) {
+		t.Errorf("error %v should be ErrIPInUse", err)
+	}
+	inUse := &IPInUseError{}
+	if !errors.As(err, &inUse) || inUse.IP != "10.10.0.2" || inUse.Pool != "pool" || inUse.Holder != holder {
+		t.Errorf("can't get holder from error %v", err)
+	}
+	if msg := (&IPInUseError{IP: "10.10.0.2", Pool: "pool"}).Error(); msg != "ip 10.10.0.2 in ippool pool is already in use" {
+		t.Errorf("unexpected error message %s", msg)
+	}
+}
+
+func TestPoolGetError(t *testing.T) {
+	key := k8stypes.NamespacedName{Namespace: "ns", Name: "pool"}
+	if err := poolGetError(key, apierrors.NewNotFound(v1alpha1.Resource("ippools"), "pool")); !errors.Is(err, ErrPoolNotFound) {
+		t.Errorf("error %v should be ErrPoolNotFound", err)
+	}
+	if err := poolGetError(key, fmt.Errorf("timeout")); errors.Is(err, ErrPoolNotFound) {
+		t.Errorf("error %v shouldn't be ErrPoolNotFound", err)
+	}
+}
+
+func TestRetryOnError(t *testing.T) {
+	backoff := wait.Backoff{Steps: 3}
+	conflict := apierrors.NewConflict(v1alpha1.Resource("ippools"), "pool", fmt.Errorf("changed"))
+	retried := retries.WithLabelValues("pool", string(v1alpha1.AllocateTypePod))
+	conflicted := conflicts.WithLabelValues("pool", string(v1alpha1.AllocateTypePod))
+	retriedBefore, conflictedBefore := testutil.ToFloat64(retried), testutil.ToFloat64(conflicted)
+
+	tries := 0
+	err := retryOnError(backoff, apierrors.IsConflict, "pool", v1alpha1.AllocateTypePod, func() error {
+		tries++
+		return conflict
+	})
+	if tries != 3 || !errors.Is(err, ErrConflictRetriesExhausted) || !apierrors.IsConflict(err) {
+		t.Errorf("expect 3 tries and exhausted conflict, real %d tries and error %v", tries, err)
+	}
+	if r, c := testutil.ToFloat64(retried)-retriedBefore, testutil.ToFloat64(conflicted)-conflictedBefore; r != 2 || c != 3 {
+		t.Errorf("expect 2 retries and 3 conflicts counted, real %v retries and %v conflicts", r, c)
+	}
+
+	tries = 0
+	err = retryOnError(backoff, apierrors.IsConflict, "pool", v1alpha1.AllocateTypePod, func() error {
+		tries++
+		return ErrPoolFull
+	})
+	if tries != 1 || err != ErrPoolFull {
+		t.Errorf("non-conflict error should return immediately, real %d tries and error %v", tries, err)
+	}
+
+	tries = 0
+	err = retryOnError(backoff, apierrors.IsConflict, "pool", v1alpha1.AllocateTypePod, func() error {
+		if tries++; tries < 2 {
+			return conflict
+		}
+		return nil
+	})
+	if tries != 2 || err != nil {
+		t.Errorf("expect success after 2 tries, real %d tries and error %v", tries, err)
+	}
+}
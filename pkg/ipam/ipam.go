@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
+	cnitypes "github.com/containernetworking/cni/pkg/types"
 	cniv1 "github.com/containernetworking/cni/pkg/types/100"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -17,9 +22,10 @@ import (
 	"github.com/everoute/ipam/pkg/utils"
 )
 
-const (
-	UpdateRetryCount = 5
-	FindRetryCount   = 5
+// DefaultUpdateBackoff and DefaultFindBackoff are the default retry budgets of Ipam, see WithUpdateBackoff and WithFindBackoff
+var (
+	DefaultUpdateBackoff = wait.Backoff{Steps: 5, Duration: 10 * time.Millisecond, Factor: 2.0, Jitter: 0.5}
+	DefaultFindBackoff   = wait.Backoff{Steps: 5, Duration: 10 * time.Millisecond, Factor: 2.0, Jitter: 0.5}
 )
 
 type OP int
@@ -30,35 +36,157 @@ const (
 )
 
 type Ipam struct {
-	k8sClient client.Client
-	namespace string
+	k8sClient     client.Client
+	reader        client.Reader
+	namespace     string
+	poolSelector  PoolSelector
+	updateBackoff wait.Backoff
+	findBackoff   wait.Backoff
+	indexes       indexCache
+}
+
+// Option customizes Ipam in InitIpam
+type Option func(*Ipam)
+
+// WithPoolSelector sets the PoolSelector used when the request doesn't specify an ippool, default is FirstPoolSelector
+func WithPoolSelector(s PoolSelector) Option {
+	return func(i *Ipam) {
+		i.poolSelector = s
+	}
+}
+
+// WithUpdateBackoff sets the retry budget of ippool and ipblock status writes, a write is retried with the backoff
+// only when it conflicts with others, default is DefaultUpdateBackoff
+func WithUpdateBackoff(b wait.Backoff) Option {
+	return func(i *Ipam) {
+		i.updateBackoff = validBackoff(b)
+	}
+}
+
+// WithFindBackoff sets the retry budget of ExecAdd, ExecAdd finds another ip with the backoff only when the ip
+// found has been claimed by others, default is DefaultFindBackoff
+func WithFindBackoff(b wait.Backoff) Option {
+	return func(i *Ipam) {
+		i.findBackoff = validBackoff(b)
+	}
+}
+
+// WithCache makes Ipam read ippools and ipallocations to allocate ips through reader, e.g. the cached client of a
+// manager, v1alpha1.IndexAllocations must have been registered to its cache. The cache may lag behind k8s, ips are
+// still claimed on k8s so an ip claimed by others is never allocated, and ips are released on the ippools and
+// ipallocations read from k8s so that an ip allocated just now is released too
+func WithCache(reader client.Reader) Option {
+	return func(i *Ipam) {
+		i.reader = v1alpha1.IndexedReader{Reader: reader}
+	}
+}
+
+// validBackoff makes sure the backoff tries at least once
+func validBackoff(b wait.Backoff) wait.Backoff {
+	if b.Steps < 1 {
+		b.Steps = 1
+	}
+	return b
 }
 
 // InitIpam returns a Ipam, param k8sClient that must add ippool scheme
-func InitIpam(k8sClient client.Client, namespace string) *Ipam {
+func InitIpam(k8sClient client.Client, namespace string, opts ...Option) *Ipam {
 	ipam := &Ipam{
-		k8sClient: k8sClient,
-		namespace: namespace,
+		k8sClient:     k8sClient,
+		reader:        k8sClient,
+		namespace:     namespace,
+		poolSelector:  &FirstPoolSelector{},
+		updateBackoff: DefaultUpdateBackoff,
+		findBackoff:   DefaultFindBackoff,
+	}
+	for _, opt := range opts {
+		opt(ipam)
 	}
 
 	return ipam
 }
 
-//nolint:gocognit
-func (i *Ipam) ExecAdd(ctx context.Context, conf *NetConf) (*cniv1.Result, error) {
+func (i *Ipam) ExecAdd(ctx context.Context, conf *NetConf) (res *cniv1.Result, err error) {
+	start := time.Now()
+	defer func() { observeExec(opAdd, conf, start, err) }()
 	if err := conf.Valid(); err != nil {
 		klog.Errorf("Invalid param %v, err: %v", *conf, err)
 		return nil, err
 	}
 
-	ipPool, reallocIP, err := i.getTargetIPPool(ctx, conf)
+	if !conf.DualStack {
+		res, _, err := i.execAdd(ctx, conf, "")
+		return res, err
+	}
+	return i.execAddDualStack(ctx, conf)
+}
+
+func (i *Ipam) execAddDualStack(ctx context.Context, conf *NetConf) (*cniv1.Result, error) {
+	conf4 := conf.familyConf(v1alpha1.IPFamilyIPv4)
+	res, claimed, err := i.execAdd(ctx, conf4, v1alpha1.IPFamilyIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	conf6 := conf.familyConf(v1alpha1.IPFamilyIPv6)
+	res6, _, err := i.execAdd(ctx, conf6, v1alpha1.IPFamilyIPv6)
 	if err != nil {
-		klog.Errorf("Get target IPPool failed: %v", err)
+		// rollback ipv4 address claimed by this request, a dual-stack request gets both or nothing,
+		// the ipv4 address allocated before, e.g. a retained ip, is kept
+		if !claimed {
+			return nil, err
+		}
+		c := *conf4
+		c.StickySeconds = 0
+		if delErr := i.releaseFromPool(ctx, &c, c.Pool); delErr != nil {
+			klog.Errorf("Failed to release ipv4 %s in ippool %s for failed dual-stack request %v, err: %v", conf4.IP, conf4.Pool, *conf, delErr)
+		}
 		return nil, err
 	}
+
+	conf.Pool, conf.IP = conf4.Pool, conf4.IP
+	conf.IPv6Pool, conf.IPv6 = conf6.Pool, conf6.IP
+	mergeResult(res, res6)
+	return res, nil
+}
+
+// execAdd allocates one ip for conf, ippool is limited to the family if family isn't empty, claimed is false when
+// the ip has been allocated to the request before. When conf.Pool is a pool list, pools are tried in order and
+// conf.Pool is set to the pool which allocates the ip
+func (i *Ipam) execAdd(ctx context.Context, conf *NetConf, family v1alpha1.IPFamily) (*cniv1.Result, bool, error) {
+	pools := splitPools(conf.Pool)
+	if len(pools) <= 1 {
+		return i.execAddInPool(ctx, conf, family)
+	}
+
+	var errs []error
+	for _, pool := range pools {
+		c := *conf
+		c.Pool = pool
+		res, claimed, err := i.execAddInPool(ctx, &c, family)
+		if err == nil {
+			*conf = c
+			return res, claimed, nil
+		}
+		klog.Infof("Failed to allocate ip in ippool %s, try next ippool, err: %v", pool, err)
+		errs = append(errs, err)
+	}
+	return nil, false, fmt.Errorf("no IP address allocated in specified pools %s, err: %w", conf.Pool, errors.NewAggregate(errs))
+}
+
+// execAddInPool allocates one ip for conf, conf.Pool must be empty or a single ippool
+//
+//nolint:gocognit
+func (i *Ipam) execAddInPool(ctx context.Context, conf *NetConf, family v1alpha1.IPFamily) (*cniv1.Result, bool, error) {
+	ipPool, reallocIP, err := i.getTargetIPPool(ctx, conf, family)
+	if err != nil {
+		klog.Errorf("Get target IPPool failed: %v", err)
+		return nil, false, err
+	}
 	if reallocIP != "" {
 		klog.Infof("Reallocate ip %s to the same request %v", reallocIP, *conf)
-		return i.ParseResult(ipPool, reallocIP), nil
+		conf.Pool, conf.IP = ipPool.Name, reallocIP
+		return i.ParseResult(ipPool, reallocIP), false, nil
 	}
 
 	conf.Pool = ipPool.Name
@@ -70,87 +198,146 @@ func (i *Ipam) ExecAdd(ctx context.Context, conf *NetConf) (*cniv1.Result, error
 		klog.Infof("use static ip %s\n", conf.IP)
 		// check if valid
 		if ip == nil {
-			return nil, fmt.Errorf("invalid static ip %s", conf.IP)
+			return nil, false, fmt.Errorf("%w: invalid static ip %s", ErrInvalidRequest, conf.IP)
 		}
+		// ippool status is keyed by the canonical ip string
+		conf.IP = ip.String()
 		if !ipPool.Contains(ip) {
-			return nil, fmt.Errorf("static ip %s is not in target pool", conf.IP)
+			return nil, false, fmt.Errorf("%w: static ip %s is not in target pool %s", ErrIPOutOfPool, conf.IP, ipPool.Name)
 		}
 		if _, exist := ipPool.Status.UsedIps[conf.IP]; exist {
-			return nil, fmt.Errorf("static ip %s is already in use", conf.IP)
+			return nil, false, &IPInUseError{IP: conf.IP, Pool: ipPool.Name, Holder: usedIPHolder(ipPool, conf.IP)}
+		}
+		if allocateInfo, exist := ipPool.Status.AllocatedIPs[conf.IP]; exist && !conf.canTakeOver(allocateInfo) {
+			return nil, false, &IPInUseError{IP: conf.IP, Pool: ipPool.Name, Holder: allocateInfo}
+		}
+		if ipPool.BlockMode() {
+			inBlock, err := i.allocatedInBlocks(ctx, ipPool, conf.IP)
+			if err != nil {
+				return nil, false, err
+			}
+			if inBlock {
+				return nil, false, &IPInUseError{IP: conf.IP, Pool: ipPool.Name}
+			}
 		}
-		if allocateInfo, exist := ipPool.Status.AllocatedIPs[conf.IP]; exist {
-			return nil, fmt.Errorf("static ip %s is already in use by %v", conf.IP, allocateInfo)
+		if err := i.checkReservation(ctx, conf, ipPool); err != nil {
+			return nil, false, err
 		}
 
 		// update ip address into pool
 		if err := i.UpdatePool(ctx, conf, constants.IPPoolOffsetIgnore, IPAdd); err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		if ipPool.BlockMode() {
+			if err := i.checkClaimInBlocks(ctx, ipPool, conf); err != nil {
+				return nil, false, err
+			}
 		}
 
-		return i.ParseResult(ipPool, conf.IP), nil
+		return i.ParseResult(ipPool, conf.IP), true, nil
 	}
 
-	for retry := 0; retry < FindRetryCount; retry++ {
-		if retry > 0 {
+	// ip of statefulset or other owner is kept when pod moves to another node, so it is allocated from ippool directly
+	if ipPool.BlockMode() && !conf.Type.HeldByOwner() {
+		res, err := i.allocateFromBlock(ctx, conf, ipPool)
+		return res, err == nil, err
+	}
+
+	var res *cniv1.Result
+	var claimed []string
+	attempt := 0
+	err = retryOnError(i.findBackoff, ipClaimed, conf.Pool, conf.Type, func() error {
+		if attempt++; attempt > 1 {
 			req := k8stypes.NamespacedName{
 				Namespace: i.namespace,
 				Name:      ipPool.GetName(),
 			}
-			if err := i.k8sClient.Get(ctx, req, ipPool); err != nil {
-				klog.Errorf("Failed to get ippool %s, err: %v, continue", req, err)
-				continue
+			ipPool = &v1alpha1.IPPool{}
+			if _, err := v1alpha1.GetIPPool(ctx, i.reader, req, ipPool); err != nil {
+				klog.Errorf("Failed to get ippool %s, err: %v", req, err)
+				return poolGetError(req, err)
 			}
 			if ipPool.Status.Offset == constants.IPPoolOffsetFull {
-				break
+				return fmt.Errorf("%w: find valid ip error in pool %s", ErrPoolFull, conf.Pool)
+			}
+		}
+		if err := checkQuota(ipPool, conf); err != nil {
+			return err
+		}
+		index := i.indexes.freeIndex(ipPool)
+		if err := i.excludeReservations(ctx, ipPool, index); err != nil {
+			return err
+		}
+		if ipPool.BlockMode() {
+			if err := i.excludeBlocks(ctx, ipPool, index); err != nil {
+				return err
+			}
+		}
+		// ips claimed by others may not be in the cache yet
+		for _, ip := range claimed {
+			if off, ok := utils.IPOffset(ipPool.StartIP(), net.ParseIP(ip)); ok && off < ipPool.Length() {
+				index.Use(off)
 			}
 		}
-		newIP, newOffset := i.FindNext(ipPool)
+		newIP, newOffset := findNextIn(ipPool, index)
 		klog.Info(newIP, newOffset)
 		if newOffset == constants.IPPoolOffsetErr {
 			klog.Errorf("can't find next IP for offset err")
-			break
+			return fmt.Errorf("%w: find valid ip error in pool %s", ErrPoolFull, conf.Pool)
+		}
+		// ip outside ipblocks is exhausted, but ipblocks may still have free ip
+		if ipPool.BlockMode() && newOffset == constants.IPPoolOffsetFull {
+			return fmt.Errorf("%w: find valid ip error in pool %s", ErrPoolFull, conf.Pool)
 		}
 		conf.IP = newIP.String()
 		if err := i.UpdatePool(ctx, conf, newOffset, IPAdd); err != nil {
+			if ip := inUseIP(err); ip != "" {
+				claimed = append(claimed, ip)
+			}
 			klog.Error(err)
-			continue
+			return err
+		}
+		if ipPool.BlockMode() {
+			if err := i.checkClaimInBlocks(ctx, ipPool, conf); err != nil {
+				return err
+			}
 		}
 		if newOffset == constants.IPPoolOffsetFull {
-			break
+			return fmt.Errorf("%w: find valid ip error in pool %s", ErrPoolFull, conf.Pool)
 		}
-		return i.ParseResult(ipPool, newIP.String()), nil
+		res = i.ParseResult(ipPool, newIP.String())
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
 	}
-
-	return nil, fmt.Errorf("find valid ip error in pool %s", conf.Pool)
+	return res, true, nil
 }
 
-func (i *Ipam) ExecCheck(*NetConf) error {
-	return nil
-}
-
-func (i *Ipam) ExecDel(ctx context.Context, conf *NetConf) error {
+func (i *Ipam) ExecDel(ctx context.Context, conf *NetConf) (err error) {
+	start := time.Now()
+	defer func() { observeExec(opDel, conf, start, err) }()
 	if err := conf.Valid(); err != nil {
 		klog.Errorf("Invalid param %v, err: %v", *conf, err)
 		return nil
 	}
 
-	// for statefulset specify ip list, doesn't release ip when pod delete
-	if conf.Type == v1alpha1.AllocateTypeStatefulSet {
+	// for statefulset or other owner specify ip list, doesn't release ip when pod delete
+	if conf.Type.HeldByOwner() {
 		return nil
 	}
 
-	if conf.Pool != "" {
-		req := k8stypes.NamespacedName{
-			Name:      conf.Pool,
-			Namespace: i.namespace,
+	if conf.Pool != "" && (!conf.DualStack || conf.IPv6Pool != "") {
+		pools := splitPools(conf.Pool)
+		if conf.DualStack {
+			pools = append(pools, splitPools(conf.IPv6Pool)...)
 		}
-		if err := i.k8sClient.Get(ctx, req, &v1alpha1.IPPool{}); err != nil {
-			if apierrors.IsNotFound(err) {
-				klog.Warningf("Can't release ip to ippool %v for the ippool doesn't exists, param: %v", req, *conf)
-				return nil
+		for _, pool := range pools {
+			if err := i.releaseFromPool(ctx, conf, pool); err != nil {
+				return err
 			}
 		}
-		return i.UpdatePool(ctx, conf, constants.IPPoolOffsetReset, IPDel)
+		return nil
 	}
 
 	ipPools := v1alpha1.IPPoolList{}
@@ -160,12 +347,19 @@ func (i *Ipam) ExecDel(ctx context.Context, conf *NetConf) error {
 	}
 
 	var errs []error
-	for _, item := range ipPools.Items {
-		conf.Pool = item.Name
-		err := i.UpdatePool(ctx, conf, constants.IPPoolOffsetReset, IPDel)
+	for index := range ipPools.Items {
+		item := &ipPools.Items[index]
+		c := *conf
+		c.Pool = item.Name
+		err := i.UpdatePool(ctx, &c, constants.IPPoolOffsetReset, IPDel)
 		if err != nil {
 			errs = append(errs, err)
 		}
+		if item.BlockMode() {
+			if err := i.releaseFromBlocks(ctx, &c, item); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
 
 	if len(errs) > 0 {
@@ -175,62 +369,75 @@ func (i *Ipam) ExecDel(ctx context.Context, conf *NetConf) error {
 	return nil
 }
 
+func (i *Ipam) releaseFromPool(ctx context.Context, conf *NetConf, pool string) error {
+	req := k8stypes.NamespacedName{
+		Name:      pool,
+		Namespace: i.namespace,
+	}
+	ipPool := v1alpha1.IPPool{}
+	if err := i.k8sClient.Get(ctx, req, &ipPool); err != nil {
+		if apierrors.IsNotFound(err) {
+			klog.Warningf("Can't release ip to ippool %v for the ippool doesn't exists, param: %v", req, *conf)
+			return nil
+		}
+		klog.Errorf("get ip pool error, err %s", err)
+		return poolGetError(req, err)
+	}
+	c := *conf
+	c.Pool = pool
+	if err := i.UpdatePool(ctx, &c, constants.IPPoolOffsetReset, IPDel); err != nil {
+		return err
+	}
+	if ipPool.BlockMode() {
+		return i.releaseFromBlocks(ctx, &c, &ipPool)
+	}
+	return nil
+}
+
+// FindNext returns an unused ip chosen by spec.allocationStrategy and the next Status.Offset, the offset is
+// constants.IPPoolOffsetIgnore for the strategies which don't use it. Quarantined ips are skipped unless
+// all other ips are used, then the earliest released one is returned
 func (i *Ipam) FindNext(ipPool *v1alpha1.IPPool) (net.IP, int64) {
-	_, subnet, _ := net.ParseCIDR(ipPool.Spec.Subnet)
+	return findNextIn(ipPool, newFreeIndex(ipPool))
+}
 
-	start := utils.Ipv4ToUint32(ipPool.StartIP())
+// findNextIn is FindNext with the freeIndex of ipPool
+func findNextIn(ipPool *v1alpha1.IPPool, index freeIndex) (net.IP, int64) {
 	length := ipPool.Length()
 
-	oldOffset := ipPool.Status.Offset
-	if oldOffset >= length {
+	offset := ipPool.Status.Offset
+	if offset >= length {
 		return nil, constants.IPPoolOffsetErr
 	}
-	offset := ipPool.Status.Offset
-
-	firstIP := utils.FirstIP(subnet)
-	lastIP := utils.LastIP(subnet)
-
-	exceptNets := make([]*net.IPNet, 0, len(ipPool.Spec.Except))
-	for i := range ipPool.Spec.Except {
-		_, ipNet, _ := net.ParseCIDR(ipPool.Spec.Except[i])
-		exceptNets = append(exceptNets, ipNet)
+	if offset < 0 {
+		offset = constants.IPPoolOffsetReset
 	}
 
-	validIP := func(ip net.IP) bool {
-		if ip.Equal(firstIP) || ip.Equal(lastIP) {
-			return false
-		}
-		if ip.String() == ipPool.Spec.Gateway {
-			return false
-		}
-		_, usedIPExist := ipPool.Status.UsedIps[ip.String()]
-		_, allocateExist := ipPool.Status.AllocatedIPs[ip.String()]
-		if usedIPExist || allocateExist {
-			return false
-		}
-		for i := range exceptNets {
-			if exceptNets[i].Contains(ip) {
-				return false
-			}
-		}
-		return true
+	strategy := newAllocationStrategy(ipPool.Spec.AllocationStrategy)
+	quarantined := ipPool.QuarantinedIPsByAge(time.Now())
+	off, ok := strategy.Next(withSkip(index, ipPool, quarantined), length, offset)
+	if !ok && len(quarantined) != 0 {
+		off, ok = nextQuarantined(ipPool, index, quarantined)
 	}
+	if !ok {
+		return nil, constants.IPPoolOffsetFull
+	}
+	// get valid IP and set offset to next pos
+	return utils.IPAddOffset(ipPool.StartIP(), off), strategy.NextOffset(off, length)
+}
 
-	for {
-		ipNum := start + uint32(offset)
-		newIP := utils.Uint32ToIpv4(ipNum)
-		if validIP(newIP) {
-			// get valid IP and set offset to next pos
-			return newIP, (offset + 1) % length
+// nextQuarantined returns the offset of the first ip in quarantined which is still free in index
+func nextQuarantined(ipPool *v1alpha1.IPPool, index freeIndex, quarantined []string) (int64, bool) {
+	for _, ip := range quarantined {
+		off, ok := utils.IPOffset(ipPool.StartIP(), net.ParseIP(ip))
+		if !ok || off >= ipPool.Length() {
+			continue
 		}
-
-		offset = (offset + 1) % length
-		if offset == oldOffset {
-			break
+		if free, ok := index.NextFree(off); ok && free == off {
+			return off, true
 		}
 	}
-
-	return nil, constants.IPPoolOffsetFull
+	return 0, false
 }
 
 //nolint:gocognit
@@ -239,12 +446,18 @@ func (i *Ipam) UpdatePool(ctx context.Context, conf *NetConf, offset int64, op O
 		Name:      conf.Pool,
 		Namespace: i.namespace,
 	}
-	for retry := 0; retry < UpdateRetryCount; retry++ {
+	// releases read from k8s, the cache may not have the allocation made just now
+	reader := i.reader
+	if op == IPDel {
+		reader = i.k8sClient
+	}
+	err := retryOnError(i.updateBackoff, apierrors.IsConflict, conf.Pool, conf.Type, func() error {
 		// get up-to-date pool
 		pool := &v1alpha1.IPPool{}
-		if err := i.k8sClient.Get(ctx, req, pool); err != nil {
+		snapshot, err := v1alpha1.GetIPPool(ctx, reader, req, pool)
+		if err != nil {
 			klog.Errorf("get ip pool error,err %s", err)
-			continue
+			return poolGetError(req, err)
 		}
 
 		// init UsedIps
@@ -255,49 +468,41 @@ func (i *Ipam) UpdatePool(ctx context.Context, conf *NetConf, offset int64, op O
 			pool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 		}
 
+		now := time.Now()
 		statusUpdate := false
+		var allocated, released []string
+		var owners map[string]metav1.OwnerReference
 		switch op {
 		case IPAdd:
 			if _, exist := pool.Status.UsedIps[conf.IP]; exist {
-				return fmt.Errorf("ip address exist")
+				return &IPInUseError{IP: conf.IP, Pool: pool.Name, Holder: usedIPHolder(pool, conf.IP)}
 			}
 			if a, exist := pool.Status.AllocatedIPs[conf.IP]; exist {
 				if isSameAllocateInfo(a, conf) {
 					return nil
 				}
-				return fmt.Errorf("ip address exist")
-			}
-			if offset != constants.IPPoolOffsetFull {
+				if !conf.canTakeOver(a) {
+					return &IPInUseError{IP: conf.IP, Pool: pool.Name, Holder: a}
+				}
+				// the ip is still allocated to the same owner, so allocated ips and quota are unchanged
 				pool.Status.AllocatedIPs[conf.IP] = conf.genAllocateInfo()
+			} else if offset != constants.IPPoolOffsetFull {
+				if err := checkQuota(pool, conf); err != nil {
+					return err
+				}
+				pool.Status.AllocatedIPs[conf.IP] = conf.genAllocateInfo()
+				allocated = append(allocated, conf.IP)
+				owners = i.allocationOwners(conf, conf.IP)
 			}
+			// the offset is kept in the created ipallocation, the ippool status is updated only when it is full
 			if offset != constants.IPPoolOffsetIgnore {
 				pool.Status.Offset = offset
 			}
 			statusUpdate = true
 		case IPDel:
-			for k, v := range pool.Status.UsedIps {
-				if v == conf.AllocateIdentify {
-					delete(pool.Status.UsedIps, k)
-					if pool.Status.Offset == constants.IPPoolOffsetFull {
-						pool.Status.Offset = offset
-					}
-					statusUpdate = true
-					break
-				}
-			}
-			for k, v := range pool.Status.AllocatedIPs {
-				// for statefulset specify ip list, doesn't release ip when pod delete
-				if v.Type == v1alpha1.AllocateTypeStatefulSet {
-					continue
-				}
-				if isSameAllocateInfo(v, conf) {
-					delete(pool.Status.AllocatedIPs, k)
-					if pool.Status.Offset == constants.IPPoolOffsetFull {
-						pool.Status.Offset = offset
-					}
-					statusUpdate = true
-					break
-				}
+			released, statusUpdate = releaseIn(pool, conf, now)
+			if len(released) != 0 && pool.Status.Offset == constants.IPPoolOffsetFull {
+				pool.Status.Offset = offset
 			}
 		}
 
@@ -305,23 +510,121 @@ func (i *Ipam) UpdatePool(ctx context.Context, conf *NetConf, offset int64, op O
 			return nil
 		}
 
-		pool.UpdateIPUsageCounter()
+		// an allocation only creates the ipallocation, the counters are updated by the ipallocation controller
+		if op == IPDel {
+			pool.CleanQuarantine(now)
+			pool.CleanRetention()
+			pool.UpdateIPUsageCounter()
+		}
 
-		// update status
-		err := i.k8sClient.Status().Update(ctx, pool)
-		if err == nil {
-			return nil
+		// update ipallocations and status
+		err = v1alpha1.SyncAllocations(ctx, i.k8sClient, pool, snapshot, owners)
+		if err != nil {
+			klog.Errorf("update ipPool %v error: %v", req, err)
+			return claimedError(pool.Name, err)
+		}
+		i.indexes.update(pool, allocated, released)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update ipPool %v failed, err: %w", req, err)
+	}
+	return nil
+}
+
+// releaseIn releases all ips of conf in the status of pool, the ips are quarantined from now. The sticky ip of a
+// pod is retained for conf.StickySeconds instead of released, so the pod recreated with the same name gets it
+// back. It returns the released ips and whether the status is changed
+func releaseIn(pool *v1alpha1.IPPool, conf *NetConf, now time.Time) ([]string, bool) {
+	var released []string
+	changed := false
+	for k, v := range pool.Status.UsedIps {
+		if v == conf.AllocateIdentify {
+			delete(pool.Status.UsedIps, k)
+			pool.Quarantine(k, now)
+			released = append(released, k)
+			changed = true
+		}
+	}
+	for k, v := range pool.Status.AllocatedIPs {
+		// for statefulset or other owner specify ip list, doesn't release ip when pod delete
+		if v.Type.HeldByOwner() || !isSameAllocateInfo(v, conf) {
+			continue
+		}
+		// sticky ip keeps the allocation for the pod recreated with the same name
+		if v.Type == v1alpha1.AllocateTypePod && conf.StickySeconds > 0 {
+			if _, ok := pool.Status.RetainedIPs[k]; !ok {
+				pool.Retain(k, now.Add(time.Duration(conf.StickySeconds)*time.Second))
+				changed = true
+			}
+			continue
 		}
-		klog.Errorf("update ipPool %v error: %v", req, err)
+		delete(pool.Status.AllocatedIPs, k)
+		pool.Quarantine(k, now)
+		released = append(released, k)
+		changed = true
 	}
+	return released, changed
+}
+
+// allocationOwners returns the owner references of the ipallocations of ips claimed by conf. Only ips of pods without
+// sticky ip and statefulsets are released with their owners. Kubernetes gc only allows owners in the namespace of
+// ippools, so it is empty for owners in other namespaces, whose ips are released by the cron jobs and controllers.
+// Ips released by kubernetes gc are quarantined by the ipallocation controller
+func (i *Ipam) allocationOwners(conf *NetConf, ips ...string) map[string]metav1.OwnerReference {
+	if conf.OwnerReference == nil || conf.K8sPodNs != i.namespace {
+		return nil
+	}
+	switch {
+	case conf.Type == v1alpha1.AllocateTypePod && conf.StickySeconds == 0:
+	case conf.Type == v1alpha1.AllocateTypeStatefulSet:
+	default:
+		return nil
+	}
+	owners := make(map[string]metav1.OwnerReference, len(ips))
+	for _, ip := range ips {
+		owners[ip] = *conf.OwnerReference
+	}
+	return owners
+}
 
-	return fmt.Errorf("update ipPool %v failed", req)
+// releasePoolIP releases ip from ippool pool when it is still allocated with a, the ip isn't quarantined,
+// it rolls back a claim which is never returned to the caller
+func (i *Ipam) releasePoolIP(ctx context.Context, pool, ip string, a v1alpha1.AllocateInfo) error {
+	req := k8stypes.NamespacedName{
+		Name:      pool,
+		Namespace: i.namespace,
+	}
+	return retryOnError(i.updateBackoff, apierrors.IsConflict, pool, a.Type, func() error {
+		ipPool := &v1alpha1.IPPool{}
+		snapshot, err := v1alpha1.GetIPPool(ctx, i.k8sClient, req, ipPool)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if cur, ok := ipPool.Status.AllocatedIPs[ip]; !ok || cur != a {
+			return nil
+		}
+		delete(ipPool.Status.AllocatedIPs, ip)
+		if ipPool.Status.Offset == constants.IPPoolOffsetFull {
+			ipPool.Status.Offset = constants.IPPoolOffsetReset
+		}
+		ipPool.UpdateIPUsageCounter()
+		if err := v1alpha1.SyncAllocations(ctx, i.k8sClient, ipPool, snapshot, nil); err != nil {
+			klog.Errorf("Failed to release ip %s in ippool %v, err: %v", ip, req, err)
+			return err
+		}
+		i.indexes.update(ipPool, nil, []string{ip})
+		return nil
+	})
 }
 
 func (i *Ipam) ParseResult(ipPool *v1alpha1.IPPool, ip string) *cniv1.Result {
 	var ipNet *net.IPNet
 	_, ipNet, _ = net.ParseCIDR(ipPool.Spec.Subnet)
-	return &cniv1.Result{
+	res := &cniv1.Result{
 		IPs: []*cniv1.IPConfig{
 			{
 				Address: net.IPNet{
@@ -332,6 +635,47 @@ func (i *Ipam) ParseResult(ipPool *v1alpha1.IPPool, ip string) *cniv1.Result {
 			},
 		},
 	}
+
+	for _, r := range ipPool.Spec.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			klog.Errorf("Invalid route dst %s in ippool %s, err: %v", r.Dst, ipPool.Name, err)
+			continue
+		}
+		res.Routes = append(res.Routes, &cnitypes.Route{Dst: *dst, GW: net.ParseIP(r.GW)})
+	}
+	if ipPool.Spec.DNS != nil {
+		res.DNS = cnitypes.DNS{
+			Nameservers: ipPool.Spec.DNS.Nameservers,
+			Domain:      ipPool.Spec.DNS.Domain,
+			Search:      ipPool.Spec.DNS.Search,
+			Options:     ipPool.Spec.DNS.Options,
+		}
+	}
+	return res
+}
+
+// mergeResult appends ips, routes and dns of src to dst, the dns domain of dst is kept if it is set
+func mergeResult(dst, src *cniv1.Result) {
+	dst.IPs = append(dst.IPs, src.IPs...)
+	dst.Routes = append(dst.Routes, src.Routes...)
+	dst.DNS.Nameservers = mergeStrings(dst.DNS.Nameservers, src.DNS.Nameservers)
+	dst.DNS.Search = mergeStrings(dst.DNS.Search, src.DNS.Search)
+	dst.DNS.Options = mergeStrings(dst.DNS.Options, src.DNS.Options)
+	if dst.DNS.Domain == "" {
+		dst.DNS.Domain = src.DNS.Domain
+	}
+}
+
+func mergeStrings(a, b []string) []string {
+	exists := sets.New(a...)
+	for _, item := range b {
+		if !exists.Has(item) {
+			a = append(a, item)
+			exists.Insert(item)
+		}
+	}
+	return a
 }
 
 func (i *Ipam) FetchGwbyIP(ctx context.Context, ip net.IP) net.IP {
@@ -352,7 +696,7 @@ func (i *Ipam) GetNamespace() string {
 	return i.namespace
 }
 
-func (i *Ipam) getTargetIPPool(ctx context.Context, conf *NetConf) (*v1alpha1.IPPool, string, error) {
+func (i *Ipam) getTargetIPPool(ctx context.Context, conf *NetConf, family v1alpha1.IPFamily) (*v1alpha1.IPPool, string, error) {
 	ipPool := &v1alpha1.IPPool{}
 
 	if conf.Pool != "" {
@@ -361,57 +705,141 @@ func (i *Ipam) getTargetIPPool(ctx context.Context, conf *NetConf) (*v1alpha1.IP
 			Name:      conf.Pool,
 			Namespace: i.namespace,
 		}
-		if err := i.k8sClient.Get(ctx, req, ipPool); err != nil {
-			return nil, "", fmt.Errorf("get ip pool %s error, err: %s", req, err)
+		snapshot, err := v1alpha1.GetIPPool(ctx, i.reader, req, ipPool)
+		if err != nil {
+			return nil, "", poolGetError(req, err)
 		}
-		if conf.IP == "" {
-			if ipPool.Status.Offset == constants.IPPoolOffsetFull {
-				return nil, "", fmt.Errorf("the specified ippool %s has no IP to allocate", req)
-			}
-			return ipPool, "", nil
+		if family != "" && ipPool.IPFamily() != family {
+			return nil, "", fmt.Errorf("%w: the specified ippool %s isn't an %s ippool", ErrInvalidRequest, req, family)
 		}
-
 		if ip := reallocateIP(conf, ipPool); ip != "" {
-			err := i.updateRelocateIPStatus(ctx, conf, ip, ipPool)
+			err := i.updateRelocateIPStatus(ctx, conf, ip, ipPool, snapshot)
 			return ipPool, ip, err
 		}
+		if conf.IP == "" && ipPool.Status.Offset == constants.IPPoolOffsetFull {
+			return nil, "", fmt.Errorf("%w: the specified ippool %s has no IP to allocate", ErrPoolFull, req)
+		}
 		return ipPool, "", nil
 	}
 
 	// get target ip pool
 	ipPools := v1alpha1.IPPoolList{}
-	if err := i.k8sClient.List(ctx, &ipPools, client.InNamespace(i.namespace)); err != nil {
+	if err := i.reader.List(ctx, &ipPools, client.InNamespace(i.namespace)); err != nil {
 		klog.Errorf("list ipPool error, err:%s", err)
 		return nil, "", err
 	}
-	for index, item := range ipPools.Items {
-		if ipPools.Items[index].Spec.Private {
+	if _, err := v1alpha1.LoadAllocationsForList(ctx, i.reader, &ipPools, client.InNamespace(i.namespace)); err != nil {
+		klog.Errorf("load ipallocations error, err:%s", err)
+		return nil, "", err
+	}
+	candidates := candidatePools(ipPools.Items, conf, family)
+	// virtual machine and pod with retained ip keep the ip in any candidate pool
+	if conf.IP == "" {
+		for _, item := range candidates {
+			if ip := reallocateIP(conf, item); ip != "" {
+				return item, ip, nil
+			}
+		}
+	}
+	var available []*v1alpha1.IPPool
+	var quotaErr error
+	for _, item := range candidates {
+		if item.Status.Offset == constants.IPPoolOffsetFull || item.Name == "" {
 			continue
 		}
-		// get the first no-full ip pool
-		if item.Status.Offset != constants.IPPoolOffsetFull && item.Name != "" {
-			ipPool = &ipPools.Items[index]
+		// pools in which the namespace exceeds quota are skipped like full pools
+		if err := checkQuota(item, conf); err != nil {
+			quotaErr = err
+			continue
+		}
+		// pools without pod selector are used only when all pools with matched pod selector are full
+		if len(available) > 0 && available[0].HasPodSelector() != item.HasPodSelector() {
 			break
 		}
+		available = append(available, item)
+	}
+	if len(available) > 0 {
+		ipPool = i.poolSelector.Select(available, conf)
 	}
 	if ipPool.Name == "" {
-		return nil, "", fmt.Errorf("no IP address allocated in all public pools")
+		if quotaErr != nil {
+			return nil, "", fmt.Errorf("no IP address allocated in all public pools, err: %w", quotaErr)
+		}
+		// all candidate pools are full, or no pool is found for the request
+		sentinel := ErrPoolFull
+		if len(candidates) == 0 {
+			sentinel = ErrPoolNotFound
+		}
+		// never fallback to pools for other nodes
+		if len(candidates) > 0 && candidates[0].Spec.NodeSelector != nil {
+			return nil, "", fmt.Errorf("%w: no IP address allocated in all pools matching node %s", sentinel, conf.NodeName)
+		}
+		if family != "" {
+			return nil, "", fmt.Errorf("%w: no IP address allocated in all public %s pools", sentinel, family)
+		}
+		return nil, "", fmt.Errorf("%w: no IP address allocated in all public pools", sentinel)
 	}
 	return ipPool, "", nil
 }
 
-func (i *Ipam) updateRelocateIPStatus(ctx context.Context, conf *NetConf, ip string, ippool *v1alpha1.IPPool) error {
+// candidatePools returns public pools of family which match the selectors, pools with pod selectors are in the front.
+// When some pools match the node by node selector, only these pools are returned
+func candidatePools(pools []v1alpha1.IPPool, conf *NetConf, family v1alpha1.IPFamily) []*v1alpha1.IPPool {
+	var selected, others []*v1alpha1.IPPool
+	nodeMatched := false
+	allowed := sets.New(conf.AllowedPools...)
+	for index := range pools {
+		item := &pools[index]
+		if item.Spec.Private {
+			continue
+		}
+		if allowed.Len() > 0 && !allowed.Has(item.Name) {
+			continue
+		}
+		if family != "" && item.IPFamily() != family {
+			continue
+		}
+		if !item.MatchNode(conf.NodeLabels) || !item.MatchPod(conf.PodLabels, conf.NamespaceLabels) {
+			continue
+		}
+		if item.Spec.NodeSelector != nil {
+			nodeMatched = true
+		}
+		if item.HasPodSelector() {
+			selected = append(selected, item)
+		} else {
+			others = append(others, item)
+		}
+	}
+
+	res := append(selected, others...)
+	if !nodeMatched {
+		return res
+	}
+	nodePools := make([]*v1alpha1.IPPool, 0, len(res))
+	for _, item := range res {
+		if item.Spec.NodeSelector != nil {
+			nodePools = append(nodePools, item)
+		}
+	}
+	return nodePools
+}
+
+func (i *Ipam) updateRelocateIPStatus(ctx context.Context, conf *NetConf, ip string, ippool *v1alpha1.IPPool,
+	snapshot v1alpha1.AllocationSnapshot) error {
 	if conf.Type != v1alpha1.AllocateTypePod {
 		return nil
 	}
-	if conf.AllocateIdentify == ippool.Status.AllocatedIPs[ip].CID {
+	_, retained := ippool.Status.RetainedIPs[ip]
+	if conf.AllocateIdentify == ippool.Status.AllocatedIPs[ip].CID && !retained {
 		return nil
 	}
 	// update cid
 	newAllo := ippool.Status.AllocatedIPs[ip]
 	newAllo.CID = conf.AllocateIdentify
 	ippool.Status.AllocatedIPs[ip] = newAllo
-	if err := i.k8sClient.Status().Update(ctx, ippool); err != nil {
+	delete(ippool.Status.RetainedIPs, ip)
+	if err := v1alpha1.SyncAllocations(ctx, i.k8sClient, ippool, snapshot, nil); err != nil {
 		klog.Errorf("Failed to update ippool %s status for pod %v, err: %v", ippool.GetName(), *conf, err)
 		return err
 	}
@@ -422,6 +850,25 @@ func reallocateIP(conf *NetConf, ipPool *v1alpha1.IPPool) (ip string) {
 	if ipPool.Status.AllocatedIPs == nil {
 		return ""
 	}
+	// ip of virtual machine is kept across its launcher pods, e.g. the source and target pods of live migration
+	if conf.IP == "" && conf.Type == v1alpha1.AllocateTypeVM {
+		for ip, a := range ipPool.Status.AllocatedIPs {
+			if isSameAllocateInfoForReallocate(a, conf) {
+				return ip
+			}
+		}
+		return ""
+	}
+	// retained ip released by the pod with the same namespace and name
+	if conf.IP == "" && conf.Type == v1alpha1.AllocateTypePod {
+		now := time.Now()
+		for ip, a := range ipPool.Status.AllocatedIPs {
+			if a.Type == conf.Type && a.ID == conf.getAllocateID() && isSameIfName(a.IfName, conf.IfName) && ipPool.Retained(ip, now) {
+				return ip
+			}
+		}
+		return ""
+	}
 	if conf.IP == "" {
 		return ""
 	}
@@ -439,7 +886,21 @@ func reallocateIP(conf *NetConf, ipPool *v1alpha1.IPPool) (ip string) {
 
 func isSameAllocateInfoForReallocate(allocateInfo v1alpha1.AllocateInfo, conf *NetConf) bool {
 	allocateID := conf.getAllocateID()
-	return allocateInfo.Type == conf.Type && allocateInfo.ID == allocateID && allocateInfo.Owner == conf.Owner
+	return allocateInfo.Type == conf.Type && allocateInfo.ID == allocateID && allocateInfo.Owner == conf.Owner &&
+		isSameIfName(allocateInfo.IfName, conf.IfName)
+}
+
+// isSameIfName matches interface names of an allocation and a request, an empty interface name, e.g. of
+// allocations by old versions and requests without CNI_IFNAME, is the default interface
+func isSameIfName(a, b string) bool {
+	return ifNameOrDefault(a) == ifNameOrDefault(b)
+}
+
+func ifNameOrDefault(ifName string) string {
+	if ifName == "" {
+		return constants.DefaultIfName
+	}
+	return ifName
 }
 
 func isSameAllocateInfo(allocateInfo v1alpha1.AllocateInfo, conf *NetConf) bool {
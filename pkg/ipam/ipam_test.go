@@ -1,16 +1,30 @@
 package ipam
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 
 	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+	"github.com/everoute/ipam/pkg/utils"
 )
 
 func TestGenAllocateInfo(t *testing.T) {
@@ -44,6 +58,22 @@ func TestGenAllocateInfo(t *testing.T) {
 				ID:   "identify",
 			},
 		},
+		{
+			name: "type pod with ifname",
+			conf: NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				AllocateIdentify: "containerid",
+				K8sPodName:       "podname",
+				K8sPodNs:         "podns",
+				IfName:           "net1",
+			},
+			exp: v1alpha1.AllocateInfo{
+				Type:   v1alpha1.AllocateTypePod,
+				ID:     "podns/podname",
+				CID:    "containerid",
+				IfName: "net1",
+			},
+		},
 	}
 
 	for _, item := range tests {
@@ -54,6 +84,214 @@ func TestGenAllocateInfo(t *testing.T) {
 	}
 }
 
+func TestIsSameAllocateInfoIfName(t *testing.T) {
+	tests := []struct {
+		name   string
+		ifName string
+		confIf string
+		exp    bool
+	}{
+		{name: "same ifname", ifName: "net1", confIf: "net1", exp: true},
+		{name: "different ifname", ifName: "eth0", confIf: "net1", exp: false},
+		{name: "allocation without ifname", ifName: "", confIf: "net1", exp: false},
+		{name: "request without ifname", ifName: "net1", confIf: "", exp: false},
+		{name: "allocation without ifname is default interface", ifName: "", confIf: "eth0", exp: true},
+		{name: "request without ifname is default interface", ifName: "eth0", confIf: "", exp: true},
+		{name: "both without ifname", ifName: "", confIf: "", exp: true},
+	}
+	for _, item := range tests {
+		a := v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns/pod", CID: "cid", IfName: item.ifName}
+		conf := NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ns", K8sPodName: "pod", AllocateIdentify: "cid", IfName: item.confIf}
+		if res := isSameAllocateInfo(a, &conf); res != item.exp {
+			t.Errorf("test %s failed, expect is %v, real is %v", item.name, item.exp, res)
+		}
+	}
+}
+
+func TestAllocationOwners(t *testing.T) {
+	podRef := &metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: "pod", UID: "pod-uid"}
+	stsRef := &metav1.OwnerReference{APIVersion: "apps/v1", Kind: constants.KindStatefulSet, Name: "sts", UID: "sts-uid"}
+	tests := []struct {
+		name string
+		conf NetConf
+		exp  *metav1.OwnerReference
+	}{
+		{
+			name: "pod in namespace of ippools",
+			conf: NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ipam", OwnerReference: podRef},
+			exp:  podRef,
+		},
+		{
+			name: "statefulset in namespace of ippools",
+			conf: NetConf{Type: v1alpha1.AllocateTypeStatefulSet, K8sPodNs: "ipam", OwnerReference: stsRef},
+			exp:  stsRef,
+		},
+		{
+			name: "pod in other namespace",
+			conf: NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "default", OwnerReference: podRef},
+		},
+		{
+			name: "pod with sticky ip",
+			conf: NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ipam", StickySeconds: 60, OwnerReference: podRef},
+		},
+		{
+			name: "virtual machine",
+			conf: NetConf{Type: v1alpha1.AllocateTypeVM, K8sPodNs: "ipam", OwnerReference: podRef},
+		},
+		{
+			name: "cni used",
+			conf: NetConf{Type: v1alpha1.AllocateTypeCNIUsed, K8sPodNs: "ipam"},
+		},
+	}
+	i := &Ipam{namespace: "ipam"}
+	for _, item := range tests {
+		res := i.allocationOwners(&item.conf, "10.0.0.1", "10.0.0.2")
+		if item.exp == nil {
+			if len(res) != 0 {
+				t.Errorf("test %s failed, expect no owner, real is %v", item.name, res)
+			}
+			continue
+		}
+		if len(res) != 2 || res["10.0.0.1"] != *item.exp || res["10.0.0.2"] != *item.exp {
+			t.Errorf("test %s failed, expect is %v, real is %v", item.name, *item.exp, res)
+		}
+		if res["10.0.0.1"].Controller != nil {
+			t.Errorf("test %s failed, expect a non-controller owner", item.name)
+		}
+	}
+}
+
+func TestExecAddWithStaleCache(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1"},
+	}
+	first, _ := InitIpam(nil, "ipam").FindNext(pool)
+	holder := v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns/other", CID: "other"}
+	newClient := func(objs ...client.Object) client.Client {
+		return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).WithStatusSubresource(&v1alpha1.IPPool{}).
+			WithIndex(&v1alpha1.IPAllocation{}, v1alpha1.AllocationPoolIndex, v1alpha1.AllocationPool).Build()
+	}
+	// the first ip has been claimed by others, but the cache hasn't got the ipallocation yet
+	k8sClient := newClient(pool.DeepCopy(), v1alpha1.NewIPAllocation(pool, first.String(), holder))
+	cache := newClient(pool.DeepCopy())
+
+	i := InitIpam(k8sClient, "ipam", WithCache(cache))
+	conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod", K8sPodNs: "ns", AllocateIdentify: "cid"}
+	if _, err := i.ExecAdd(context.Background(), &conf); err != nil {
+		t.Fatalf("expect allocate another ip, real err: %v", err)
+	}
+	if conf.IP == "" || conf.IP == first.String() {
+		t.Errorf("expect an ip other than the claimed %s, real is %s", first, conf.IP)
+	}
+	a := v1alpha1.IPAllocation{}
+	if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: "ipam", Name: utils.GenAllocationName("pool", first.String())}, &a); err != nil || a.Spec.AllocateInfo != holder {
+		t.Errorf("the ipallocation of others should be kept, real is %+v, err: %v", a.Spec, err)
+	}
+}
+
+func TestReleaseFromPoolGetError(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1", BlockSize: 30},
+	}
+	// only the first get fails, the ip in ipblocks is leaked if the error is ignored
+	failed := false
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool).WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if !failed {
+				failed = true
+				return fmt.Errorf("timeout")
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	}).Build()
+
+	i := InitIpam(k8sClient, "ipam")
+	conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod", K8sPodNs: "ns", AllocateIdentify: "cid"}
+	if err := i.ExecDel(context.Background(), &conf); err == nil || errors.Is(err, ErrPoolNotFound) {
+		t.Errorf("expect the error to get ippool, real is %v", err)
+	}
+}
+
+func TestAllocateInBlockConflict(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1", BlockSize: 30},
+	}
+	// only the first ipblock status patch conflicts, it is retried by the ipblock update instead of the find loop
+	conflicted := false
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool).
+		WithStatusSubresource(&v1alpha1.IPPool{}, &v1alpha1.IPBlock{}).WithInterceptorFuncs(interceptor.Funcs{
+		SubResourcePatch: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+			if _, ok := obj.(*v1alpha1.IPBlock); ok && !conflicted {
+				conflicted = true
+				return apierrors.NewConflict(v1alpha1.Resource("ipblocks"), obj.GetName(), fmt.Errorf("changed"))
+			}
+			return c.SubResource(subResourceName).Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+
+	i := InitIpam(k8sClient, "ipam", WithFindBackoff(wait.Backoff{}))
+	conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod", K8sPodNs: "ns", AllocateIdentify: "cid", NodeName: "node"}
+	if _, err := i.ExecAdd(context.Background(), &conf); err != nil {
+		t.Fatalf("expect the conflict to be retried, real err is %v", err)
+	}
+	if !conflicted {
+		t.Errorf("expect the ipblock status patch to conflict")
+	}
+}
+
+func TestExecAddPoolStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1"},
+	}
+	var patches []string
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool).
+		WithStatusSubresource(&v1alpha1.IPPool{}).WithInterceptorFuncs(interceptor.Funcs{
+		SubResourcePatch: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+			data, _ := patch.Data(obj)
+			patches = append(patches, string(data))
+			return c.SubResource(subResourceName).Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+
+	i := InitIpam(k8sClient, "ipam")
+	for _, name := range []string{"pod1", "pod2"} {
+		conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: name, K8sPodNs: "ns", AllocateIdentify: "cid"}
+		if _, err := i.ExecAdd(context.Background(), &conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(patches) != 0 {
+		t.Errorf("allocations shouldn't update the ippool status, real patches are %v", patches)
+	}
+	res := v1alpha1.IPPool{}
+	if _, err := v1alpha1.GetIPPool(context.Background(), k8sClient, client.ObjectKeyFromObject(pool), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Status.AllocatedIPs) != 2 || res.Status.Offset != 4 {
+		t.Errorf("expect 2 ips allocated and offset 4, real is %+v", res.Status)
+	}
+}
+
 func TestReallocateIP(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -167,6 +405,72 @@ func TestReallocateIP(t *testing.T) {
 			},
 			exp: "10.1.1.3",
 		},
+		{
+			name: "reallocate IP of virtual machine without static IP",
+			conf: NetConf{
+				Pool:             "pool1",
+				Type:             v1alpha1.AllocateTypeVM,
+				AllocateIdentify: "cid2",
+				K8sPodName:       "virt-launcher-vm1-abcde",
+				K8sPodNs:         "podNs",
+				Owner:            "podNs/vm1",
+			},
+			ippool: v1alpha1.IPPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pool1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: map[string]v1alpha1.AllocateInfo{
+						"10.1.1.1": {Type: v1alpha1.AllocateTypeVM, ID: "podNs/vm2", Owner: "podNs/vm2"},
+						"10.1.1.4": {Type: v1alpha1.AllocateTypeVM, ID: "podNs/vm1", Owner: "podNs/vm1"},
+					},
+				},
+			},
+			exp: "10.1.1.4",
+		},
+		{
+			name: "reallocate retained IP of pod with the same name",
+			conf: NetConf{
+				Pool:             "pool1",
+				Type:             v1alpha1.AllocateTypePod,
+				AllocateIdentify: "cid2",
+				K8sPodName:       "podName",
+				K8sPodNs:         "podNs",
+			},
+			ippool: v1alpha1.IPPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pool1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: makeAllocateStatus("10.1.1.1", "podNs/podName", "pod", "cid1", "10.1.1.2", "podNs/podName2", "pod", "cid3"),
+					RetainedIPs: map[string]metav1.Time{
+						"10.1.1.1": metav1.NewTime(time.Now().Add(time.Minute)),
+						"10.1.1.2": metav1.NewTime(time.Now().Add(time.Minute)),
+					},
+				},
+			},
+			exp: "10.1.1.1",
+		},
+		{
+			name: "no reallocate expired retained IP",
+			conf: NetConf{
+				Pool:             "pool1",
+				Type:             v1alpha1.AllocateTypePod,
+				AllocateIdentify: "cid2",
+				K8sPodName:       "podName",
+				K8sPodNs:         "podNs",
+			},
+			ippool: v1alpha1.IPPool{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pool1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: makeAllocateStatus("10.1.1.1", "podNs/podName", "pod", "cid1"),
+					RetainedIPs:  map[string]metav1.Time{"10.1.1.1": metav1.NewTime(time.Now().Add(-time.Second))},
+				},
+			},
+			exp: "",
+		},
 	}
 
 	for _, item := range tests {
@@ -177,6 +481,343 @@ func TestReallocateIP(t *testing.T) {
 	}
 }
 
+func TestFindNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		ippool    v1alpha1.IPPool
+		expIP     string
+		expOffset int64
+	}{
+		{
+			name: "ipv4 skip subnet first IP and gateway",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:    "12.10.64.0/29",
+					Subnet:  "12.10.64.0/29",
+					Gateway: "12.10.64.1",
+				},
+			},
+			expIP:     "12.10.64.2",
+			expOffset: 3,
+		},
+		{
+			name: "ipv4 skip subnet last IP",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:    "12.10.64.0/29",
+					Subnet:  "12.10.64.0/29",
+					Gateway: "12.10.64.1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					Offset: 7,
+				},
+			},
+			expIP:     "12.10.64.2",
+			expOffset: 3,
+		},
+		{
+			name: "ipv6 last IP of subnet is valid",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:    "fd00::/125",
+					Subnet:  "fd00::/125",
+					Gateway: "fd00::1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					Offset: 7,
+				},
+			},
+			expIP:     "fd00::7",
+			expOffset: 0,
+		},
+		{
+			name: "ipv6 skip except and allocated IP",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					Start:   "fd00::1:0",
+					End:     "fd00::1:ff",
+					Subnet:  "fd00::/64",
+					Gateway: "fd00::1",
+					Except:  []string{"fd00::1:0/126"},
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: makeAllocateStatus("fd00::1:4", "ns/pod", "pod", "cid"),
+				},
+			},
+			expIP:     "fd00::1:5",
+			expOffset: 6,
+		},
+		{
+			name: "huge ipv6 pool",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:    "fd00::/64",
+					Subnet:  "fd00::/64",
+					Gateway: "fd00::1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					Offset: 1 << 40,
+				},
+			},
+			expIP:     "fd00::100:0:0",
+			expOffset: 1<<40 + 1,
+		},
+		{
+			name: "pool is full",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:    "fd00::/126",
+					Subnet:  "fd00::/126",
+					Gateway: "fd00::1",
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: makeAllocateStatus("fd00::2", "ns/pod", "pod", "cid", "fd00::3", "ns/pod2", "pod", "cid"),
+				},
+			},
+			expOffset: constants.IPPoolOffsetFull,
+		},
+		{
+			name: "skip quarantined ip",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:                   "12.10.64.0/29",
+					Subnet:                 "12.10.64.0/29",
+					Gateway:                "12.10.64.1",
+					ReleaseCooldownSeconds: 60,
+				},
+				Status: v1alpha1.IPPoolStatus{
+					QuarantinedIPs: map[string]metav1.Time{"12.10.64.2": metav1.Now()},
+				},
+			},
+			expIP:     "12.10.64.3",
+			expOffset: 4,
+		},
+		{
+			name: "quarantine expired",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:                   "12.10.64.0/29",
+					Subnet:                 "12.10.64.0/29",
+					Gateway:                "12.10.64.1",
+					ReleaseCooldownSeconds: 60,
+				},
+				Status: v1alpha1.IPPoolStatus{
+					QuarantinedIPs: map[string]metav1.Time{"12.10.64.2": metav1.NewTime(time.Now().Add(-2 * time.Minute))},
+				},
+			},
+			expIP:     "12.10.64.2",
+			expOffset: 3,
+		},
+		{
+			name: "reuse the oldest quarantined ip when pool is full",
+			ippool: v1alpha1.IPPool{
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:                   "12.10.64.0/29",
+					Subnet:                 "12.10.64.0/29",
+					Gateway:                "12.10.64.1",
+					ReleaseCooldownSeconds: 60,
+				},
+				Status: v1alpha1.IPPoolStatus{
+					AllocatedIPs: makeAllocateStatus("12.10.64.2", "ns/pod", "pod", "cid", "12.10.64.3", "ns/pod2", "pod", "cid",
+						"12.10.64.4", "ns/pod3", "pod", "cid"),
+					QuarantinedIPs: map[string]metav1.Time{
+						"12.10.64.5": metav1.NewTime(time.Now().Add(-10 * time.Second)),
+						"12.10.64.6": metav1.NewTime(time.Now().Add(-20 * time.Second)),
+					},
+				},
+			},
+			expIP:     "12.10.64.6",
+			expOffset: 7,
+		},
+	}
+
+	for _, item := range tests {
+		ip, offset := (&Ipam{}).FindNext(&item.ippool)
+		if offset != item.expOffset {
+			t.Errorf("test %s failed, exp offset is %d, real is %d", item.name, item.expOffset, offset)
+		}
+		if item.expIP != "" && !ip.Equal(net.ParseIP(item.expIP)) {
+			t.Errorf("test %s failed, exp ip is %s, real is %s", item.name, item.expIP, ip)
+		}
+	}
+}
+
+func TestCandidatePools(t *testing.T) {
+	newPool := func(name string, private bool, nsSelector, podSelector map[string]string) v1alpha1.IPPool {
+		p := v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:    "10.10.65.0/30",
+				Subnet:  "10.10.64.0/20",
+				Gateway: "10.10.64.1",
+				Private: private,
+			},
+		}
+		if nsSelector != nil {
+			p.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: nsSelector}
+		}
+		if podSelector != nil {
+			p.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: podSelector}
+		}
+		return p
+	}
+	pools := []v1alpha1.IPPool{
+		newPool("public", false, nil, nil),
+		newPool("private", true, nil, nil),
+		newPool("tenant-a", false, map[string]string{"tenant": "a"}, nil),
+		newPool("tenant-a-web", false, map[string]string{"tenant": "a"}, map[string]string{"app": "web"}),
+		newPool("tenant-b", false, map[string]string{"tenant": "b"}, nil),
+	}
+
+	tests := []struct {
+		name string
+		conf NetConf
+		exp  []string
+	}{
+		{
+			name: "pod without labels",
+			conf: NetConf{},
+			exp:  []string{"public"},
+		},
+		{
+			name: "namespace selector matched",
+			conf: NetConf{NamespaceLabels: map[string]string{"tenant": "a"}},
+			exp:  []string{"tenant-a", "public"},
+		},
+		{
+			name: "namespace and pod selector matched",
+			conf: NetConf{NamespaceLabels: map[string]string{"tenant": "a"}, PodLabels: map[string]string{"app": "web"}},
+			exp:  []string{"tenant-a", "tenant-a-web", "public"},
+		},
+		{
+			name: "pod selector matched but namespace selector not matched",
+			conf: NetConf{NamespaceLabels: map[string]string{"tenant": "b"}, PodLabels: map[string]string{"app": "web"}},
+			exp:  []string{"tenant-b", "public"},
+		},
+		{
+			name: "limited by allowed pools",
+			conf: NetConf{NamespaceLabels: map[string]string{"tenant": "a"}, AllowedPools: []string{"tenant-a", "private"}},
+			exp:  []string{"tenant-a"},
+		},
+	}
+
+	for _, item := range tests {
+		res := []string{}
+		for _, p := range candidatePools(pools, &item.conf, "") {
+			res = append(res, p.Name)
+		}
+		if fmt.Sprint(res) != fmt.Sprint(item.exp) {
+			t.Errorf("test %s failed, expect is %v, real is %v", item.name, item.exp, res)
+		}
+	}
+}
+
+func TestCandidatePoolsByNode(t *testing.T) {
+	newPool := func(name string, nodeSelector map[string]string) v1alpha1.IPPool {
+		p := v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:    "10.10.65.0/30",
+				Subnet:  "10.10.64.0/20",
+				Gateway: "10.10.64.1",
+			},
+		}
+		if nodeSelector != nil {
+			p.Spec.NodeSelector = &metav1.LabelSelector{MatchLabels: nodeSelector}
+		}
+		return p
+	}
+	pools := []v1alpha1.IPPool{
+		newPool("public", nil),
+		newPool("rack1", map[string]string{"rack": "rack1"}),
+		newPool("rack2", map[string]string{"rack": "rack2"}),
+		newPool("rack2-backup", map[string]string{"rack": "rack2"}),
+	}
+
+	tests := []struct {
+		name string
+		conf NetConf
+		exp  []string
+	}{
+		{
+			name: "node without labels",
+			conf: NetConf{},
+			exp:  []string{"public"},
+		},
+		{
+			name: "node matches no pool",
+			conf: NetConf{NodeLabels: map[string]string{"rack": "rack3"}},
+			exp:  []string{"public"},
+		},
+		{
+			name: "only pools matching node",
+			conf: NetConf{NodeLabels: map[string]string{"rack": "rack2"}},
+			exp:  []string{"rack2", "rack2-backup"},
+		},
+	}
+
+	for _, item := range tests {
+		res := []string{}
+		for _, p := range candidatePools(pools, &item.conf, "") {
+			res = append(res, p.Name)
+		}
+		if fmt.Sprint(res) != fmt.Sprint(item.exp) {
+			t.Errorf("test %s failed, expect is %v, real is %v", item.name, item.exp, res)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	pool := v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:    "10.10.65.0/24",
+			Subnet:  "10.10.64.0/20",
+			Gateway: "10.10.64.1",
+			Routes: []v1alpha1.Route{
+				{Dst: "192.168.0.0/16", GW: "10.10.64.254"},
+				{Dst: "172.16.0.0/12"},
+			},
+			DNS: &v1alpha1.DNS{
+				Nameservers: []string{"10.10.64.53"},
+				Domain:      "cluster.local",
+				Search:      []string{"ns.svc.cluster.local"},
+			},
+		},
+	}
+	pool6 := v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:    "fd00::100/120",
+			Subnet:  "fd00::/64",
+			Gateway: "fd00::1",
+			Routes:  []v1alpha1.Route{{Dst: "fd01::/64", GW: "fd00::fe"}},
+			DNS: &v1alpha1.DNS{
+				Nameservers: []string{"fd00::53"},
+				Domain:      "cluster6.local",
+				Search:      []string{"ns.svc.cluster.local"},
+			},
+		},
+	}
+
+	res := (&Ipam{}).ParseResult(&pool, "10.10.65.2")
+	if len(res.Routes) != 2 || res.Routes[0].Dst.String() != "192.168.0.0/16" || !res.Routes[0].GW.Equal(net.ParseIP("10.10.64.254")) {
+		t.Errorf("unexpected routes %v", res.Routes)
+	}
+	if res.Routes[1].GW != nil {
+		t.Errorf("route without gw should use the default gateway, real is %s", res.Routes[1].GW)
+	}
+	if fmt.Sprint(res.DNS.Nameservers) != "[10.10.64.53]" || res.DNS.Domain != "cluster.local" {
+		t.Errorf("unexpected dns %+v", res.DNS)
+	}
+
+	mergeResult(res, (&Ipam{}).ParseResult(&pool6, "fd00::100"))
+	if len(res.IPs) != 2 || len(res.Routes) != 3 {
+		t.Errorf("expect 2 ips and 3 routes for dual stack, real is %v %v", res.IPs, res.Routes)
+	}
+	if fmt.Sprint(res.DNS.Nameservers) != "[10.10.64.53 fd00::53]" || fmt.Sprint(res.DNS.Search) != "[ns.svc.cluster.local]" || res.DNS.Domain != "cluster.local" {
+		t.Errorf("unexpected dual stack dns %+v", res.DNS)
+	}
+}
+
 var _ = Describe("ipam", func() {
 	pool1mask := "255.255.240.0"
 	pool1GW := "10.10.64.1"
@@ -218,6 +859,7 @@ var _ = Describe("ipam", func() {
 	}
 	AfterEach(func() {
 		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
 	})
 
 	Context("allocate IP", func() {
@@ -241,7 +883,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -252,7 +894,7 @@ var _ = Describe("ipam", func() {
 				When("first allocate IP in ippool except", func() {
 					BeforeEach(func() {
 						p := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "pool1", Namespace: ns}, &p)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Name: "pool1", Namespace: ns}, &p)).Should(Succeed())
 						p.Spec.Except = []string{"10.10.65.0/32"}
 						Expect(k8sClient.Update(ctx, &p)).Should(Succeed())
 					})
@@ -269,7 +911,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 							g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -281,7 +923,7 @@ var _ = Describe("ipam", func() {
 				When("ippool has allocated some IP", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       1,
 							AllocatedIPs: makeAllocateStatus("10.10.65.0", "ns-exist/pod-exist", "pod", "cid"),
@@ -301,7 +943,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 							g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -314,7 +956,7 @@ var _ = Describe("ipam", func() {
 				When("ippool has allocated hole", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       1,
 							UsedIps:      makeUsedIPStatus("10.10.65.0", "containerID"),
@@ -336,7 +978,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 							g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -352,7 +994,7 @@ var _ = Describe("ipam", func() {
 			When("all pool fulled", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset: -1,
 					}
@@ -367,14 +1009,14 @@ var _ = Describe("ipam", func() {
 					}
 					res, err := ipam.ExecAdd(ctx, &c)
 					Expect(res).Should(BeNil())
-					Expect(err).Should(MatchError("no IP address allocated in all public pools"))
+					Expect(err).Should(MatchError(ErrPoolFull))
 				})
 			})
 
 			When("a pod request IP in a second time", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset:       2,
 						UsedIps:      makeUsedIPStatus("10.10.65.0", "containerID"),
@@ -395,7 +1037,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 						g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -427,7 +1069,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -438,7 +1080,7 @@ var _ = Describe("ipam", func() {
 				When("first allocate IP in ippool except", func() {
 					BeforeEach(func() {
 						p := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "pool3", Namespace: ns}, &p)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Name: "pool3", Namespace: ns}, &p)).Should(Succeed())
 						p.Spec.Except = []string{"10.10.65.0/32"}
 						Expect(k8sClient.Update(ctx, &p)).Should(Succeed())
 					})
@@ -455,7 +1097,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 							g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -467,7 +1109,7 @@ var _ = Describe("ipam", func() {
 				When("ippool has allocated some IP", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       1,
 							AllocatedIPs: makeAllocateStatus("10.10.65.0", "ns-exist/pod-exist", "pod", "cid"),
@@ -487,7 +1129,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 							g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -500,7 +1142,7 @@ var _ = Describe("ipam", func() {
 				When("ippool has allocated hole", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       1,
 							UsedIps:      makeUsedIPStatus("10.10.65.0", "containerID"),
@@ -522,7 +1164,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 							g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -538,7 +1180,7 @@ var _ = Describe("ipam", func() {
 			When("all pool fulled", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset: -1,
 					}
@@ -553,14 +1195,14 @@ var _ = Describe("ipam", func() {
 					}
 					res, err := ipam.ExecAdd(ctx, &c)
 					Expect(res).Should(BeNil())
-					Expect(err).Should(MatchError("no IP address allocated in all public pools"))
+					Expect(err).Should(MatchError(ErrPoolFull))
 				})
 			})
 
 			When("a pod request IP in a second time", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset:       2,
 						UsedIps:      makeUsedIPStatus("10.10.65.0", "containerID"),
@@ -581,7 +1223,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool3"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 						g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -611,7 +1253,7 @@ var _ = Describe("ipam", func() {
 				Expect(*res.IPs[0]).To(Equal(*exp))
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 					g.Expect(ippool.Status).ShouldNot(BeNil())
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 					g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -622,7 +1264,7 @@ var _ = Describe("ipam", func() {
 			When("next IP is gateway", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset:  2,
 						UsedIps: makeUsedIPStatus("12.10.64.1", "containerID"),
@@ -642,7 +1284,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(4)))
 						g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -655,7 +1297,7 @@ var _ = Describe("ipam", func() {
 			When("next IP is subnet last IP", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset:       7,
 						UsedIps:      makeUsedIPStatus("12.10.64.1", "containerID"),
@@ -672,7 +1314,7 @@ var _ = Describe("ipam", func() {
 					}
 					res, err := ipam.ExecAdd(ctx, &c)
 					Expect(res).Should(BeNil())
-					Expect(err).Should(MatchError("find valid ip error in pool pool2"))
+					Expect(err).Should(MatchError(ErrPoolFull))
 				})
 			})
 		})
@@ -686,7 +1328,7 @@ var _ = Describe("ipam", func() {
 			When("first pool fulled", func() {
 				BeforeEach(func() {
 					ippool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					ippool.Status = v1alpha1.IPPoolStatus{
 						Offset: -1,
 					}
@@ -705,7 +1347,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -729,7 +1371,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(2)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -740,7 +1382,7 @@ var _ = Describe("ipam", func() {
 				When("a pod request IP in a second time", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       4,
 							AllocatedIPs: makeAllocateStatus("12.10.64.3", "ns1/pod1", "pod", "cid"),
@@ -762,7 +1404,7 @@ var _ = Describe("ipam", func() {
 							Expect(*res.IPs[0]).To(Equal(*exp))
 							Eventually(func(g Gomega) {
 								ippool := v1alpha1.IPPool{}
-								g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+								g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 								g.Expect(ippool.Status).ShouldNot(BeNil())
 								g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 								g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -786,7 +1428,7 @@ var _ = Describe("ipam", func() {
 							Expect(*res.IPs[0]).To(Equal(*exp))
 							Eventually(func(g Gomega) {
 								ippool := v1alpha1.IPPool{}
-								g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+								g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 								g.Expect(ippool.Status).ShouldNot(BeNil())
 								g.Expect(ippool.Status.Offset).Should(Equal(int64(5)))
 								g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -828,7 +1470,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(0)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -853,7 +1495,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(0)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -864,7 +1506,7 @@ var _ = Describe("ipam", func() {
 				When("a pod request IP in a second time for type pod", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       6,
 							AllocatedIPs: makeAllocateStatus("12.10.64.5", "ns1/pod1", "pod", "cid"),
@@ -887,7 +1529,7 @@ var _ = Describe("ipam", func() {
 							Expect(*res.IPs[0]).To(Equal(*exp))
 							Eventually(func(g Gomega) {
 								ippool := v1alpha1.IPPool{}
-								g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+								g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 								g.Expect(ippool.Status).ShouldNot(BeNil())
 								g.Expect(ippool.Status.Offset).Should(Equal(int64(6)))
 								g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -913,7 +1555,7 @@ var _ = Describe("ipam", func() {
 							Expect(*res.IPs[0]).To(Equal(*exp))
 							Eventually(func(g Gomega) {
 								ippool := v1alpha1.IPPool{}
-								g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+								g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 								g.Expect(ippool.Status).ShouldNot(BeNil())
 								g.Expect(ippool.Status.Offset).Should(Equal(int64(6)))
 								g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -926,7 +1568,7 @@ var _ = Describe("ipam", func() {
 				When("a pod request IP in a second time for type statefulset", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset: 6,
 						}
@@ -950,7 +1592,7 @@ var _ = Describe("ipam", func() {
 						Expect(*res.IPs[0]).To(Equal(*exp))
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(6)))
 							g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -969,7 +1611,7 @@ var _ = Describe("ipam", func() {
 						}
 						_, err := ipam.ExecAdd(ctx, &c)
 						allocateInfo := v1alpha1.AllocateInfo{ID: "ns1/pod1", Type: v1alpha1.AllocateTypeStatefulSet, Owner: "ns1/sts1"}
-						Expect(err).Should(MatchError(fmt.Sprintf("static ip %s is already in use by %v", c.IP, allocateInfo)))
+						Expect(err).Should(MatchError(&IPInUseError{IP: c.IP, Pool: "pool2", Holder: allocateInfo}))
 					})
 					It("can't reallocate IP for owner different", func() {
 						c := NetConf{
@@ -982,13 +1624,13 @@ var _ = Describe("ipam", func() {
 						}
 						_, err := ipam.ExecAdd(ctx, &c)
 						allocateInfo := v1alpha1.AllocateInfo{ID: "ns1/pod1", Type: v1alpha1.AllocateTypeStatefulSet, Owner: "ns1/sts1"}
-						Expect(err).Should(MatchError(fmt.Sprintf("static ip %s is already in use by %v", c.IP, allocateInfo)))
+						Expect(err).Should(MatchError(&IPInUseError{IP: c.IP, Pool: "pool2", Holder: allocateInfo}))
 					})
 				})
 				When("specified static IP has been used", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:  6,
 							UsedIps: makeUsedIPStatus("12.10.64.5", "containerID"),
@@ -1006,13 +1648,14 @@ var _ = Describe("ipam", func() {
 						}
 						res, err := ipam.ExecAdd(ctx, &c)
 						Expect(res).Should(BeNil())
-						Expect(err).Should(MatchError("static ip 12.10.64.5 is already in use"))
+						Expect(err).Should(MatchError(&IPInUseError{IP: "12.10.64.5", Pool: "pool2",
+							Holder: v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeCNIUsed, ID: "containerID"}}))
 					})
 				})
 				When("specified static IP has been allocated", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 						ippool.Status = v1alpha1.IPPoolStatus{
 							Offset:       6,
 							AllocatedIPs: makeAllocateStatus("12.10.64.5", "ns-exist/pod-exist", "pod", "cid"),
@@ -1030,8 +1673,8 @@ var _ = Describe("ipam", func() {
 						}
 						res, err := ipam.ExecAdd(ctx, &c)
 						Expect(res).Should(BeNil())
-						Expect(err).Should(MatchError(fmt.Sprintf("static ip 12.10.64.5 is already in use by %v",
-							v1alpha1.AllocateInfo{ID: "ns-exist/pod-exist", Type: v1alpha1.AllocateTypePod, CID: "cid"})))
+						Expect(err).Should(MatchError(&IPInUseError{IP: "12.10.64.5", Pool: "pool2",
+							Holder: v1alpha1.AllocateInfo{ID: "ns-exist/pod-exist", Type: v1alpha1.AllocateTypePod, CID: "cid"}}))
 					})
 				})
 				When("specified static IP doesn't in pool", func() {
@@ -1046,13 +1689,13 @@ var _ = Describe("ipam", func() {
 						}
 						res, err := ipam.ExecAdd(ctx, &c)
 						Expect(res).Should(BeNil())
-						Expect(err).Should(MatchError("static ip 13.10.64.5 is not in target pool"))
+						Expect(err).Should(MatchError(ErrIPOutOfPool))
 					})
 				})
 				When("specified static IP in except", func() {
 					BeforeEach(func() {
 						p := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "pool2", Namespace: ns}, &p)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Name: "pool2", Namespace: ns}, &p)).Should(Succeed())
 						p.Spec.Except = []string{"12.10.64.5/32", "12.10.64.128/27"}
 						Expect(k8sClient.Update(ctx, &p)).Should(Succeed())
 					})
@@ -1067,7 +1710,7 @@ var _ = Describe("ipam", func() {
 						}
 						res, err := ipam.ExecAdd(ctx, &c)
 						Expect(res).Should(BeNil())
-						Expect(err).Should(MatchError("static ip 12.10.64.5 is not in target pool"))
+						Expect(err).Should(MatchError(ErrIPOutOfPool))
 					})
 				})
 				When("specified invalid IP", func() {
@@ -1082,7 +1725,7 @@ var _ = Describe("ipam", func() {
 						}
 						res, err := ipam.ExecAdd(ctx, &c)
 						Expect(res).Should(BeNil())
-						Expect(err).Should(MatchError("invalid static ip 13.10.64"))
+						Expect(err).Should(MatchError(ErrInvalidRequest))
 					})
 				})
 				When("specified ippool doesn't exist", func() {
@@ -1124,7 +1767,7 @@ var _ = Describe("ipam", func() {
 					Expect(*res.IPs[0]).To(Equal(*exp))
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(1)))
 						g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -1143,7 +1786,7 @@ var _ = Describe("ipam", func() {
 					}
 					res, err := ipam.ExecAdd(ctx, &c)
 					Expect(res).Should(BeNil())
-					Expect(err).Should(MatchError("no IP address allocated in all public pools"))
+					Expect(err).Should(MatchError(ErrPoolNotFound))
 				})
 			})
 		})
@@ -1154,7 +1797,7 @@ var _ = Describe("ipam", func() {
 			pool1Copy := pool1.DeepCopy()
 			Expect(k8sClient.Create(ctx, pool1Copy)).Should(Succeed())
 			ippool := v1alpha1.IPPool{}
-			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 			ippool.Status = v1alpha1.IPPoolStatus{
 				Offset:       3,
 				UsedIps:      makeUsedIPStatus("10.10.64.2", "containerID"),
@@ -1172,7 +1815,7 @@ var _ = Describe("ipam", func() {
 			_ = ipam.ExecDel(ctx, &c)
 			Eventually(func(g Gomega) {
 				ippool := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				g.Expect(ippool.Status).ShouldNot(BeNil())
 				g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 				g.Expect(len(ippool.Status.UsedIps)).Should(Equal(0))
@@ -1188,7 +1831,7 @@ var _ = Describe("ipam", func() {
 				_ = ipam.ExecDel(ctx, &c)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					g.Expect(ippool.Status).ShouldNot(BeNil())
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 					g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -1207,7 +1850,7 @@ var _ = Describe("ipam", func() {
 					_ = ipam.ExecDel(ctx, &c)
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 						g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -1226,7 +1869,7 @@ var _ = Describe("ipam", func() {
 					_ = ipam.ExecDel(ctx, &c)
 					Eventually(func(g Gomega) {
 						ippool := v1alpha1.IPPool{}
-						g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						g.Expect(ippool.Status).ShouldNot(BeNil())
 						g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 						g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -1239,7 +1882,7 @@ var _ = Describe("ipam", func() {
 				When("for allocate type statefulset", func() {
 					BeforeEach(func() {
 						ippool := v1alpha1.IPPool{}
-						Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+						Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 						ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeStatefulSet, ID: "ns1/pod1", Owner: "ns1/sts1"}
 						Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
 					})
@@ -1253,7 +1896,7 @@ var _ = Describe("ipam", func() {
 						_ = ipam.ExecDel(ctx, &c)
 						Eventually(func(g Gomega) {
 							ippool := v1alpha1.IPPool{}
-							g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+							g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 							g.Expect(ippool.Status).ShouldNot(BeNil())
 							g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 							g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -1275,7 +1918,7 @@ var _ = Describe("ipam", func() {
 			_ = ipam.ExecDel(ctx, &c)
 			Eventually(func(g Gomega) {
 				ippool := v1alpha1.IPPool{}
-				g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				g.Expect(ippool.Status).ShouldNot(BeNil())
 				g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 				g.Expect(len(ippool.Status.UsedIps)).Should(Equal(1))
@@ -1297,14 +1940,14 @@ var _ = Describe("ipam", func() {
 				pool2Copy := pool2.DeepCopy()
 				Expect(k8sClient.Create(ctx, pool2Copy)).Should(Succeed())
 				ippool := v1alpha1.IPPool{}
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 				ippool.Status = v1alpha1.IPPoolStatus{
 					Offset:       3,
 					AllocatedIPs: makeAllocateStatus("12.10.64.1", "ns1/pod1", "pod", "containerID"),
 				}
 				Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
 
-				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 				ippool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns1/pod1", CID: "containerID"}
 				Expect(k8sClient.Status().Update(ctx, &ippool)).Should(Succeed())
 			})
@@ -1318,7 +1961,7 @@ var _ = Describe("ipam", func() {
 				_ = ipam.ExecDel(ctx, &c)
 				Eventually(func(g Gomega) {
 					ippool := v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
 					g.Expect(ippool.Status).ShouldNot(BeNil())
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 					g.Expect(len(ippool.Status.UsedIps)).Should(Equal(0))
@@ -1326,7 +1969,7 @@ var _ = Describe("ipam", func() {
 					g.Expect(ippool.Status.AllocatedIPs).Should(HaveKeyWithValue("10.10.65.3", v1alpha1.AllocateInfo{ID: "cniusedID", Type: v1alpha1.AllocateTypeCNIUsed}))
 
 					ippool = v1alpha1.IPPool{}
-					g.Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
+					g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &ippool)).Should(Succeed())
 					g.Expect(ippool.Status).ShouldNot(BeNil())
 					g.Expect(ippool.Status.Offset).Should(Equal(int64(3)))
 					g.Expect(ippool.Status.UsedIps).Should(BeNil())
@@ -1335,4 +1978,723 @@ var _ = Describe("ipam", func() {
 			})
 		})
 	})
+
+	Context("dual stack", func() {
+		pool6 := v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pool6",
+				Namespace: ns,
+			},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:    "fd00::100/120",
+				Subnet:  "fd00::/64",
+				Gateway: "fd00::1",
+			},
+		}
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			Expect(k8sClient.Create(ctx, pool6.DeepCopy())).Should(Succeed())
+		})
+		It("allocate ipv4 and ipv6 in one request", func() {
+			c := NetConf{
+				DualStack:        true,
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(res.IPs)).Should(Equal(2))
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("10.10.65.0", pool1mask, pool1GW)))
+			Expect(res.IPs[1].Address.String()).Should(Equal("fd00::100/64"))
+			Expect(res.IPs[1].Gateway.String()).Should(Equal("fd00::1"))
+			Expect(c.Pool).Should(Equal("pool1"))
+			Expect(c.IPv6Pool).Should(Equal("pool6"))
+			Expect(c.IPv6).Should(Equal("fd00::100"))
+
+			By("release both ip")
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+			Eventually(func(g Gomega) {
+				ippool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(len(ippool.Status.AllocatedIPs)).Should(Equal(0))
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool6"}, &ippool)).Should(Succeed())
+				g.Expect(len(ippool.Status.AllocatedIPs)).Should(Equal(0))
+			}, timeout, interval).Should(Succeed())
+		})
+		It("can't use ipv4 pool as ipv6 pool", func() {
+			c := NetConf{
+				DualStack:        true,
+				IPv6Pool:         "pool1",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(res).Should(BeNil())
+			Expect(err).Should(HaveOccurred())
+			By("rollback ipv4 address")
+			Eventually(func(g Gomega) {
+				ippool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+				g.Expect(len(ippool.Status.AllocatedIPs)).Should(Equal(0))
+			}, timeout, interval).Should(Succeed())
+		})
+		It("keep ipv4 address allocated before when ipv6 fails", func() {
+			c := NetConf{
+				Pool:             "pool1",
+				IP:               "10.10.65.5",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			_, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+
+			c.DualStack, c.IPv6Pool = true, "pool1"
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(res).Should(BeNil())
+			Expect(err).Should(MatchError(ErrInvalidRequest))
+			ippool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &ippool)).Should(Succeed())
+			Expect(ippool.Status.AllocatedIPs).Should(HaveKey("10.10.65.5"))
+		})
+	})
+	Context("block mode", func() {
+		poolBlock := v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pool-block",
+				Namespace: ns,
+			},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:      "10.10.64.0/27",
+				Subnet:    "10.10.64.0/20",
+				Gateway:   pool1GW,
+				BlockSize: 28,
+			},
+		}
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, poolBlock.DeepCopy())).Should(Succeed())
+		})
+		AfterEach(func() {
+			Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPBlock{}, client.InNamespace(ns))).Should(Succeed())
+		})
+		It("allocate ip from the ipblock of node", func() {
+			c1 := NetConf{
+				Pool:             "pool-block",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				NodeName:         "node1",
+				AllocateIdentify: "cid1",
+			}
+			res, err := ipam.ExecAdd(ctx, &c1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("10.10.64.2", pool1mask, pool1GW)))
+
+			By("the other node claims the next ipblock")
+			c2 := NetConf{
+				Pool:             "pool-block",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod2",
+				K8sPodNs:         "ns1",
+				NodeName:         "node2",
+				AllocateIdentify: "cid2",
+			}
+			res, err = ipam.ExecAdd(ctx, &c2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("10.10.64.16", pool1mask, pool1GW)))
+
+			blocks := v1alpha1.IPBlockList{}
+			Expect(k8sClient.List(ctx, &blocks, client.InNamespace(ns), client.MatchingLabels{v1alpha1.LabelNode: "node1"})).Should(Succeed())
+			Expect(len(blocks.Items)).Should(Equal(1))
+			Expect(blocks.Items[0].Spec.CIDR).Should(Equal("10.10.64.0/28"))
+
+			By("no free ipblock for the third node")
+			c3 := NetConf{
+				Pool:             "pool-block",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod3",
+				K8sPodNs:         "ns1",
+				NodeName:         "node3",
+				AllocateIdentify: "cid3",
+			}
+			_, err = ipam.ExecAdd(ctx, &c3)
+			Expect(err).Should(HaveOccurred())
+
+			By("release ip in ipblock")
+			Expect(ipam.ExecDel(ctx, &c1)).Should(Succeed())
+			block := v1alpha1.IPBlock{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: blocks.Items[0].Name}, &block)).Should(Succeed())
+			Expect(len(block.Status.AllocatedIPs)).Should(Equal(0))
+		})
+		It("can't allocate ip without node name", func() {
+			c := NetConf{
+				Pool:             "pool-block",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid1",
+			}
+			_, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).Should(HaveOccurred())
+		})
+		It("roll back the claim of an ip claimed concurrently in ippool and ipblock", func() {
+			c1 := NetConf{
+				Pool:             "pool-block",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				NodeName:         "node1",
+				AllocateIdentify: "cid1",
+			}
+			_, err := ipam.ExecAdd(ctx, &c1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c1.IP).Should(Equal("10.10.64.2"))
+			blocks := v1alpha1.IPBlockList{}
+			Expect(k8sClient.List(ctx, &blocks, client.InNamespace(ns), client.MatchingLabels{v1alpha1.LabelNode: "node1"})).Should(Succeed())
+			Expect(len(blocks.Items)).Should(Equal(1))
+			blockKey := types.NamespacedName{Namespace: ns, Name: blocks.Items[0].Name}
+			poolKey := types.NamespacedName{Namespace: ns, Name: "pool-block"}
+
+			By("static ip claimed in ippool after the ipblock")
+			c2 := NetConf{
+				Pool:             "pool-block",
+				IP:               "10.10.64.2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod2",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid2",
+			}
+			Expect(ipam.UpdatePool(ctx, &c2, constants.IPPoolOffsetIgnore, IPAdd)).Should(Succeed())
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(poolKey, &pool)).Should(Succeed())
+			Expect(ipam.checkClaimInBlocks(ctx, &pool, &c2)).Should(MatchError(ErrIPInUse))
+			Expect(getIPPool(poolKey, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.64.2"))
+
+			By("ip claimed in ipblock after the ippool")
+			c3 := c2
+			c3.IP, c3.K8sPodName, c3.AllocateIdentify = "10.10.64.3", "pod3", "cid3"
+			Expect(ipam.UpdatePool(ctx, &c3, constants.IPPoolOffsetIgnore, IPAdd)).Should(Succeed())
+			info := v1alpha1.AllocateInfo{ID: "ns1/pod4", Type: v1alpha1.AllocateTypePod, CID: "cid4"}
+			block := v1alpha1.IPBlock{}
+			Expect(k8sClient.Get(ctx, blockKey, &block)).Should(Succeed())
+			block.Status.AllocatedIPs["10.10.64.3"] = info
+			Expect(k8sClient.Status().Update(ctx, &block)).Should(Succeed())
+			Expect(ipam.checkClaimInPool(ctx, &pool, block.Name, "10.10.64.3", info)).Should(MatchError(ErrIPInUse))
+			Expect(k8sClient.Get(ctx, blockKey, &block)).Should(Succeed())
+			Expect(block.Status.AllocatedIPs).ShouldNot(HaveKey("10.10.64.3"))
+			Expect(block.Status.AllocatedIPs).Should(HaveKey("10.10.64.2"))
+			Expect(getIPPool(poolKey, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveKey("10.10.64.3"))
+		})
+	})
+
+	Context("node selector", func() {
+		BeforeEach(func() {
+			pool := pool2.DeepCopy()
+			pool.Spec.NodeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"rack": "rack1"}}
+			Expect(k8sClient.Create(ctx, pool)).Should(Succeed())
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+		})
+		It("doesn't allocate IP from ippool for other nodes", func() {
+			c := NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				NodeName:         "node1",
+				NodeLabels:       map[string]string{"rack": "rack1"},
+				AllocateIdentify: "cid",
+			}
+			By("ippool for node1 is full")
+			Eventually(func(g Gomega) {
+				pool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+				pool.Status.Offset = constants.IPPoolOffsetFull
+				g.Expect(k8sClient.Status().Update(ctx, &pool)).Should(Succeed())
+			}, timeout, interval).Should(Succeed())
+
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(res).Should(BeNil())
+			Expect(err).Should(MatchError(ErrPoolFull))
+		})
+	})
+
+	Context("pool selector", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			pool := pool2.DeepCopy()
+			pool.Spec.Priority = 10
+			Expect(k8sClient.Create(ctx, pool)).Should(Succeed())
+		})
+		It("allocate IP from the pool with the highest priority", func() {
+			priorityIpam := InitIpam(k8sClient, ns, WithPoolSelector(&PriorityPoolSelector{}))
+			c := NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := priorityIpam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(c.Pool).Should(Equal("pool2"))
+		})
+	})
+
+	Context("pool list", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+			Eventually(func(g Gomega) {
+				pool := v1alpha1.IPPool{}
+				g.Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
+				pool.Status.Offset = constants.IPPoolOffsetFull
+				g.Expect(k8sClient.Status().Update(ctx, &pool)).Should(Succeed())
+			}, timeout, interval).Should(Succeed())
+		})
+		It("fall through to the next pool when the pool is full", func() {
+			c := NetConf{
+				Pool:             "pool1,pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(c.Pool).Should(Equal("pool2"))
+
+			By("release ip by pool list")
+			c.Pool = "pool1,pool2"
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(len(pool.Status.AllocatedIPs)).Should(Equal(0))
+		})
+		It("return error when all pools in list fail", func() {
+			c := NetConf{
+				Pool:             "pool1,pool-not-exist",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(res).Should(BeNil())
+			Expect(err).Should(HaveOccurred())
+			Expect(c.Pool).Should(Equal("pool1,pool-not-exist"))
+		})
+	})
+
+	Context("check", func() {
+		var c NetConf
+		var res *cniv1.Result
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			c = NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			var err error
+			res, err = ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("allocation is consistent", func() {
+			Expect(ipam.ExecCheckResult(ctx, &c, res)).Should(Succeed())
+			c.Pool = ""
+			Expect(ipam.ExecCheckResult(ctx, &c, nil)).Should(Succeed())
+		})
+		It("container id changed", func() {
+			c.AllocateIdentify = "cid2"
+			Expect(errors.Is(ipam.ExecCheckResult(ctx, &c, res), ErrAllocationMismatch)).Should(BeTrue())
+		})
+		It("allocation not found", func() {
+			c.K8sPodName = "pod2"
+			Expect(errors.Is(ipam.ExecCheckResult(ctx, &c, res), ErrAllocationNotFound)).Should(BeTrue())
+		})
+		It("ip isn't in pool after spec changes", func() {
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
+			pool.Spec.Except = []string{res.IPs[0].Address.IP.String() + "/32"}
+			Expect(k8sClient.Update(ctx, &pool)).Should(Succeed())
+			Expect(errors.Is(ipam.ExecCheckResult(ctx, &c, res), ErrIPOutOfPool)).Should(BeTrue())
+		})
+		It("gateway in result mismatch", func() {
+			res.IPs[0].Gateway = net.ParseIP("10.10.64.2")
+			Expect(errors.Is(ipam.ExecCheckResult(ctx, &c, res), ErrIPConfigMismatch)).Should(BeTrue())
+		})
+	})
+
+	Context("ip reservation", func() {
+		reservation := v1alpha1.IPReservation{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "reservation1",
+				Namespace: ns,
+			},
+			Spec: v1alpha1.IPReservationSpec{
+				Pool:  "pool2",
+				IPs:   []string{"12.10.64.1-12.10.64.3"},
+				Owner: "ns1/pod2",
+			},
+		}
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		AfterEach(func() {
+			Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPReservation{}, client.InNamespace(ns))).Should(Succeed())
+		})
+		It("skip reserved ip for dynamic allocation", func() {
+			Expect(k8sClient.Create(ctx, reservation.DeepCopy())).Should(Succeed())
+			c := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.4", pool2mask, pool2GW)))
+		})
+		It("allocate reserved ip as static ip only for the owner", func() {
+			Expect(k8sClient.Create(ctx, reservation.DeepCopy())).Should(Succeed())
+			c := NetConf{
+				Pool:             "pool2",
+				IP:               "12.10.64.1",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			_, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).Should(HaveOccurred())
+
+			c.K8sPodName = "pod2"
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+		})
+		It("ignore expired reservation", func() {
+			r := reservation.DeepCopy()
+			r.Spec.ExpireTime = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+			Expect(k8sClient.Create(ctx, r)).Should(Succeed())
+			c := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+		})
+	})
+
+	Context("release cooldown", func() {
+		BeforeEach(func() {
+			p := pool2.DeepCopy()
+			p.Spec.ReleaseCooldownSeconds = 300
+			Expect(k8sClient.Create(ctx, p)).Should(Succeed())
+		})
+		It("doesn't reuse released ip until the pool is full", func() {
+			c := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.QuarantinedIPs).Should(HaveKey("12.10.64.1"))
+
+			By("allocate all other ips")
+			for _, ip := range []string{"12.10.64.3", "12.10.64.4", "12.10.64.5", "12.10.64.6"} {
+				c := NetConf{
+					Pool:             "pool2",
+					Type:             v1alpha1.AllocateTypePod,
+					K8sPodName:       "pod-" + ip,
+					K8sPodNs:         "ns1",
+					AllocateIdentify: "cid",
+				}
+				res, err := ipam.ExecAdd(ctx, &c)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig(ip, pool2mask, pool2GW)))
+			}
+
+			By("reuse the quarantined ip")
+			c.K8sPodName = "pod2"
+			res, err = ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveKey("12.10.64.1"))
+
+			By("the allocated ip is removed from quarantine by the next release")
+			c.K8sPodName = "pod-12.10.64.3"
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.QuarantinedIPs).ShouldNot(HaveKey("12.10.64.1"))
+			Expect(pool.Status.QuarantinedIPs).Should(HaveKey("12.10.64.3"))
+		})
+	})
+
+	Context("batch", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("allocate and release ips in a single status update", func() {
+			confA := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "vm-a"}
+			confB := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "vm-b", IP: "12.10.64.6"}
+			res, err := ipam.ExecAddBatch(ctx, "pool2", []BatchRequest{{Conf: confA, Count: 3}, {Conf: confB}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).Should(HaveLen(2))
+			Expect(res[0].IPs).Should(HaveLen(3))
+			Expect(*res[1].IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.6", pool2mask, pool2GW)))
+			Expect(confA.Pool).Should(Equal("pool2"))
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveLen(4))
+
+			Expect(ipam.ExecDelBatch(ctx, "pool2", []*NetConf{confA, confB})).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(BeEmpty())
+		})
+		It("leave the pool unchanged when the batch fails", func() {
+			confA := &NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "vm-a"}
+			_, err := ipam.ExecAddBatch(ctx, "pool2", []BatchRequest{{Conf: confA, Count: 6}})
+			Expect(err).Should(HaveOccurred())
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(BeEmpty())
+		})
+	})
+
+	Context("multiple interfaces", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("allocate and release ip per interface", func() {
+			eth0 := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid",
+				IfName:           "eth0",
+			}
+			net1 := eth0
+			net1.IfName = "net1"
+			res, err := ipam.ExecAdd(ctx, &eth0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			res, err = ipam.ExecAdd(ctx, &net1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.3", pool2mask, pool2GW)))
+
+			By("release one interface")
+			Expect(ipam.ExecDel(ctx, &net1)).Should(Succeed())
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveLen(1))
+			Expect(pool.Status.AllocatedIPs["12.10.64.1"].IfName).Should(Equal("eth0"))
+
+			By("release without interface name only releases the default interface")
+			_, err = ipam.ExecAdd(ctx, &net1)
+			Expect(err).ToNot(HaveOccurred())
+			noIf := eth0
+			noIf.IfName = ""
+			Expect(ipam.ExecDel(ctx, &noIf)).Should(Succeed())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveLen(1))
+			for _, a := range pool.Status.AllocatedIPs {
+				Expect(a.IfName).Should(Equal("net1"))
+			}
+		})
+	})
+	Context("virtual machine", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("share ip between launcher pods and keep it after pod delete", func() {
+			src := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypeVM,
+				K8sPodName:       "virt-launcher-vm1-aaaaa",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid1",
+				Owner:            "ns1/vm1",
+			}
+			res, err := ipam.ExecAdd(ctx, &src)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+
+			By("target pod of live migration gets the same ip")
+			dst := src
+			dst.K8sPodName, dst.AllocateIdentify = "virt-launcher-vm1-bbbbb", "cid2"
+			res, err = ipam.ExecAdd(ctx, &dst)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+
+			By("release source pod")
+			Expect(ipam.ExecDel(ctx, &src)).Should(Succeed())
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveKeyWithValue("12.10.64.1",
+				v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeVM, ID: "ns1/vm1", Owner: "ns1/vm1"}))
+		})
+	})
+	Context("sticky ip", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("recreated pod gets the retained ip back", func() {
+			c := NetConf{
+				Pool:             "pool2",
+				Type:             v1alpha1.AllocateTypePod,
+				K8sPodName:       "pod1",
+				K8sPodNs:         "ns1",
+				AllocateIdentify: "cid1",
+				StickySeconds:    300,
+			}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveKey("12.10.64.1"))
+			Expect(pool.Status.RetainedIPs).Should(HaveKey("12.10.64.1"))
+
+			By("another pod doesn't get the retained ip")
+			other := NetConf{Pool: "pool2", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod2", K8sPodNs: "ns1", AllocateIdentify: "cid2"}
+			res, err = ipam.ExecAdd(ctx, &other)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.3", pool2mask, pool2GW)))
+
+			By("recreate the pod")
+			c.AllocateIdentify = "cid3"
+			res, err = ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs["12.10.64.1"].CID).Should(Equal("cid3"))
+			Expect(pool.Status.RetainedIPs).ShouldNot(HaveKey("12.10.64.1"))
+		})
+	})
+	Context("namespace quota", func() {
+		BeforeEach(func() {
+			p := pool2.DeepCopy()
+			p.Spec.NamespaceQuotas = []v1alpha1.NamespaceQuota{{Namespaces: []string{"ns1"}, Max: 2}}
+			Expect(k8sClient.Create(ctx, p)).Should(Succeed())
+		})
+		It("reject the request when the namespace exceeds quota", func() {
+			newConf := func(podNs, podName string) *NetConf {
+				return &NetConf{Pool: "pool2", Type: v1alpha1.AllocateTypePod, K8sPodName: podName, K8sPodNs: podNs, AllocateIdentify: "cid"}
+			}
+			for _, name := range []string{"pod1", "pod2"} {
+				_, err := ipam.ExecAdd(ctx, newConf("ns1", name))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			_, err := ipam.ExecAdd(ctx, newConf("ns1", "pod3"))
+			Expect(err).Should(MatchError(ErrQuotaExceeded))
+			_, err = ipam.ExecAdd(ctx, newConf("ns2", "pod1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.NamespaceIPCount("ns1")).Should(Equal(int64(2)))
+			Expect(pool.NamespaceIPCount("ns2")).Should(Equal(int64(1)))
+
+			By("allocate after release")
+			Expect(ipam.ExecDel(ctx, newConf("ns1", "pod1"))).Should(Succeed())
+			_, err = ipam.ExecAdd(ctx, newConf("ns1", "pod3"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+	Context("ipallocation", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("store allocated ip as ipallocation and migrate allocations in status", func() {
+			pool := v1alpha1.IPPool{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			version := pool.ResourceVersion
+			c := NetConf{Pool: "pool2", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod1", K8sPodNs: "ns1", AllocateIdentify: "cid"}
+			res, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*res.IPs[0]).To(Equal(*makeCNIIPconfig("12.10.64.1", pool2mask, pool2GW)))
+
+			a := v1alpha1.IPAllocation{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2-12-10-64-1"}, &a)).Should(Succeed())
+			Expect(a.Spec.Pool).Should(Equal("pool2"))
+			Expect(a.Spec.AllocateInfo).Should(Equal(v1alpha1.AllocateInfo{ID: "ns1/pod1", Type: v1alpha1.AllocateTypePod, CID: "cid"}))
+			By("the allocation doesn't update the ippool")
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(BeEmpty())
+			Expect(pool.ResourceVersion).Should(Equal(version))
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.Offset).Should(Equal(int64(2)))
+
+			By("allocations in status are migrated by the next update")
+			pool.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{
+				"12.10.64.3": {ID: "ns1/pod2", Type: v1alpha1.AllocateTypePod, CID: "cid2"},
+			}
+			Expect(k8sClient.Status().Update(ctx, &pool)).Should(Succeed())
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2-12-10-64-1"}, &a)).ShouldNot(Succeed())
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2-12-10-64-3"}, &a)).Should(Succeed())
+			Expect(a.Spec.AllocateInfo.ID).Should(Equal("ns1/pod2"))
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(BeEmpty())
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveLen(1))
+		})
+	})
+	Context("concurrent allocation", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool2.DeepCopy())).Should(Succeed())
+		})
+		It("allocate different ips for concurrent requests", func() {
+			var wg sync.WaitGroup
+			errs := make([]error, 4)
+			ips := make([]string, 4)
+			for index := range ips {
+				wg.Add(1)
+				go func(index int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					c := NetConf{Pool: "pool2", Type: v1alpha1.AllocateTypePod, K8sPodName: fmt.Sprintf("pod%d", index), K8sPodNs: "ns1", AllocateIdentify: "cid"}
+					_, errs[index] = ipam.ExecAdd(ctx, &c)
+					ips[index] = c.IP
+				}(index)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(sets.New(ips...).Len()).Should(Equal(len(ips)))
+
+			pool := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool2"}, &pool)).Should(Succeed())
+			Expect(pool.Status.AllocatedIPs).Should(HaveLen(len(ips)))
+		})
+	})
 })
@@ -0,0 +1,56 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// metric operation labels of execDuration
+const (
+	opAdd = "add"
+	opDel = "del"
+)
+
+// metric result labels of execDuration
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	execDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipam_exec_duration_seconds",
+		Help:    "Latency of ExecAdd and ExecDel in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"operation", "pool", "type", "result"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipam_retries_total",
+		Help: "Number of retries of ippool and ipblock status writes and ip finding",
+	}, []string{"pool", "type"})
+	conflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipam_conflicts_total",
+		Help: "Number of conflicts with others when writing ippool and ipblock status or claiming ip",
+	}, []string{"pool", "type"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(execDuration, retries, conflicts)
+}
+
+// observeExec records the latency of operation op for conf since start with the result err. It is recorded once
+// for each call, labeled with the pool resolved for conf, i.e. the pool which allocates the ip after ExecAdd
+// succeeds, or the ipv4 pool of a dual-stack request. The pool label is empty when no pool is resolved, e.g. a
+// candidate list which fails in all pools or ExecDel searching all pools
+func observeExec(op string, conf *NetConf, start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	pool := ""
+	if pools := splitPools(conf.Pool); len(pools) == 1 {
+		pool = pools[0]
+	}
+	execDuration.WithLabelValues(op, pool, string(conf.Type), result).Observe(time.Since(start).Seconds())
+}
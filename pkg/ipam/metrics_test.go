@@ -0,0 +1,48 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func TestObserveExec(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   NetConf
+		err    error
+		result string
+		pool   string
+	}{
+		{name: "single pool", conf: NetConf{Pool: "pool1", Type: v1alpha1.AllocateTypePod}, result: resultSuccess, pool: "pool1"},
+		{name: "failure", conf: NetConf{Pool: "pool1", Type: v1alpha1.AllocateTypePod}, err: ErrPoolFull, result: resultFailure, pool: "pool1"},
+		{name: "dual-stack", conf: NetConf{Pool: "pool4", IPv6Pool: "pool6", DualStack: true, Type: v1alpha1.AllocateTypePod},
+			result: resultSuccess, pool: "pool4"},
+		{name: "candidate list", conf: NetConf{Pool: "pool1, pool2", Type: v1alpha1.AllocateTypePod}, err: errors.New("failed"),
+			result: resultFailure, pool: ""},
+		{name: "candidate list resolved", conf: NetConf{Pool: "pool2", Type: v1alpha1.AllocateTypePod}, result: resultSuccess, pool: "pool2"},
+		{name: "no pool", conf: NetConf{Type: v1alpha1.AllocateTypePod}, result: resultSuccess, pool: ""},
+	}
+
+	for _, item := range tests {
+		execDuration.Reset()
+		observeExec(opAdd, &item.conf, time.Now(), item.err)
+		if !execDuration.DeleteLabelValues(opAdd, item.pool, string(v1alpha1.AllocateTypePod), item.result) {
+			t.Errorf("test %s failed, expect latency of pool %q with result %s observed", item.name, item.pool, item.result)
+		}
+		if n := countSeries(); n != 0 {
+			t.Errorf("test %s failed, expect no other latency observed, real is %d", item.name, n)
+		}
+	}
+}
+
+func countSeries() int {
+	ch := make(chan prometheus.Metric, 16)
+	execDuration.Collect(ch)
+	close(ch)
+	return len(ch)
+}
@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -18,16 +23,47 @@ import (
 	"github.com/everoute/ipam/pkg/utils"
 )
 
+// maxOwnerDepth limits the owner references walked from a pod, e.g. pod -> ReplicaSet -> Deployment
+const maxOwnerDepth = 5
+
 type NetConf struct {
+	// Pool is an ippool or an ordered ippool list separated by comma, e.g. "pool1,pool2",
+	// it is set to the ippool which allocates the ip after ExecAdd
 	Pool string
 	IP   string
+	// DualStack allocates an ipv4 address by Pool and IP and an ipv6 address by IPv6Pool and IPv6 in one request
+	DualStack bool
+	IPv6Pool  string
+	IPv6      string
 	// default is containerID, type=cniused, defined by the cni
 	AllocateIdentify string
-	K8sPodName       string
-	K8sPodNs         string
-	Owner            string
+	// IfName is CNI_IFNAME, a pod with multiple interfaces, e.g. attached by multus, allocates an ip
+	// for each interface
+	IfName     string
+	K8sPodName string
+	K8sPodNs   string
+	// NodeName is required by ippool in block mode, default is the node of K8sPodNs/K8sPodName
+	NodeName string
+	// PodLabels, NamespaceLabels and NodeLabels are matched with ippool selectors when select ippool automatically,
+	// NamespaceLabels is also matched with ippool namespace quotas
+	PodLabels       map[string]string
+	NamespaceLabels map[string]string
+	NodeLabels      map[string]string
+	Owner           string
+	// OwnerKind is apiVersion/kind of Owner for type owner, e.g. apps/v1/Deployment
+	OwnerKind string
+	// AllowedPools limits the ippools selected automatically, empty means all public ippools
+	AllowedPools []string
+	// StickySeconds retains the ip released by the pod for the seconds, a pod with the same namespace and name
+	// gets the ip back in the period
+	StickySeconds int32
+	// OwnerReference is the pod or statefulset holding the ip, it is set to the ipallocation of the ip as a
+	// non-controller owner reference, see Ipam.allocationOwners
+	OwnerReference *metav1.OwnerReference
 	// default is allocate IP to Pod
 	Type v1alpha1.AllocateType
+	// takeOver is the allocate info of IP held by a deleted pod of the same owner, the ip is reassigned to the request
+	takeOver *v1alpha1.AllocateInfo
 }
 
 // Complete add ippool and static ip info to NetConf, param k8sClient must add corev1 scheme and appsv1 scheme
@@ -36,14 +72,14 @@ func (c *NetConf) Complete(ctx context.Context, k8sClient client.Client, poolNs
 	if c.Type != v1alpha1.AllocateTypePod {
 		return nil
 	}
-	// has been specify pool, return
+	// has been specify pool, only complete namespace labels for ippool namespace quotas
 	if c.Pool != "" {
-		return nil
+		return c.completeNamespaceLabels(ctx, k8sClient)
 	}
 
 	if c.K8sPodNs == "" || c.K8sPodName == "" {
 		klog.Errorf("netconf %v must set K8sPodNs and K8sPodName for type %s", *c, v1alpha1.AllocateTypePod)
-		return fmt.Errorf("must set K8sPodNs and K8sPodName for type %s", v1alpha1.AllocateTypePod)
+		return fmt.Errorf("%w: must set K8sPodNs and K8sPodName for type %s", ErrInvalidRequest, v1alpha1.AllocateTypePod)
 	}
 
 	// complete by pod
@@ -54,78 +90,235 @@ func (c *NetConf) Complete(ctx context.Context, k8sClient client.Client, poolNs
 		klog.Errorf("Failed to get pod %v, err: %v", podNsName, err)
 		return err
 	}
-	if pool, ok := pod.Annotations[constants.IpamAnnotationPool]; ok {
+	if c.NodeName == "" {
+		c.NodeName = pod.Spec.NodeName
+	}
+	c.OwnerReference = &metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: pod.GetName(), UID: pod.GetUID()}
+	// ip of virt-launcher pod is kept by the virtual machine across restart and live migration
+	if vm := virtualMachineOf(&pod); vm != "" {
+		c.Type = v1alpha1.AllocateTypeVM
+		c.Owner = utils.GenOwner(c.K8sPodNs, vm)
+	}
+	if pool, ok := c.podAnnotation(pod.Annotations, constants.IpamAnnotationPool); ok {
 		c.Pool = pool
 	}
-	if ip, ok := pod.Annotations[constants.IpamAnnotationStaticIP]; ok {
+	if ip, ok := c.podAnnotation(pod.Annotations, constants.IpamAnnotationStaticIP); ok {
 		if c.Pool == "" {
 			klog.Errorf("Pod %v can't only specify static IP but no pool", pod)
-			return fmt.Errorf("can't only specify static IP but no pool")
+			return fmt.Errorf("%w: can't only specify static IP but no pool", ErrInvalidRequest)
 		}
 		c.IP = ip
 	}
-	if c.Pool != "" {
-		return nil
+	if pool, ok := c.podAnnotation(pod.Annotations, constants.IpamAnnotationIPv6Pool); ok {
+		c.DualStack = true
+		c.IPv6Pool = pool
+	}
+	if ip, ok := c.podAnnotation(pod.Annotations, constants.IpamAnnotationIPv6StaticIP); ok {
+		if c.IPv6Pool == "" {
+			klog.Errorf("Pod %v can't only specify static IPv6 but no ipv6 pool", pod)
+			return fmt.Errorf("%w: can't only specify static IPv6 but no ipv6 pool", ErrInvalidRequest)
+		}
+		c.IPv6 = ip
+	}
+	if v, ok := c.podAnnotation(pod.Annotations, constants.IpamAnnotationStickyIPSeconds); ok {
+		seconds, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || seconds < 0 {
+			klog.Errorf("Pod %v has invalid sticky ip seconds %s", podNsName, v)
+			return fmt.Errorf("%w: invalid sticky ip seconds %s", ErrInvalidRequest, v)
+		}
+		c.StickySeconds = int32(seconds)
 	}
 
-	// complete by statefulset
-	if len(pod.OwnerReferences) > 0 {
+	// complete by statefulset, ip list of statefulset only applies to the default interface
+	if c.Pool == "" && len(pod.OwnerReferences) > 0 && c.isDefaultIf() {
 		for i := range pod.OwnerReferences {
 			if pod.OwnerReferences[i].Kind == constants.KindStatefulSet {
 				if err := c.completeByStatefulSet(ctx, k8sClient, pod.OwnerReferences[i].Name, poolNs); err != nil {
 					klog.Errorf("Failed to get pod %v specified ip or pool from statefulset, err: %v", podNsName, err)
 					return err
 				}
-				return nil
+				break
 			}
 		}
 	}
 
+	// complete by other owners, e.g. ReplicaSet and Deployment
+	if c.Pool == "" && c.isDefaultIf() && c.Type != v1alpha1.AllocateTypeVM {
+		if err := c.completeByOwner(ctx, k8sClient, &pod, poolNs); err != nil {
+			klog.Errorf("Failed to get pod %v specified ip or pool from owners, err: %v", podNsName, err)
+			return err
+		}
+	}
+
+	// complete by namespace
+	namespace := corev1.Namespace{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: c.K8sPodNs}, &namespace); err != nil {
+		klog.Errorf("Failed to get namespace %s, err: %v", c.K8sPodNs, err)
+		return err
+	}
+	if err := c.completeByNamespace(&namespace); err != nil {
+		klog.Errorf("Failed to complete pod %v by namespace, err: %v", podNsName, err)
+		return err
+	}
+	// namespace labels are also matched with ippool namespace quotas
+	c.NamespaceLabels = namespace.Labels
+	if c.Pool != "" {
+		return nil
+	}
+
+	// complete labels for ippool auto selection
+	c.PodLabels = pod.Labels
+	if c.NodeName != "" {
+		node := corev1.Node{}
+		if err := k8sClient.Get(ctx, types.NamespacedName{Name: c.NodeName}, &node); err != nil {
+			klog.Errorf("Failed to get node %s, err: %v", c.NodeName, err)
+			return err
+		}
+		c.NodeLabels = node.Labels
+	}
+
 	return nil
 }
 
+// completeNamespaceLabels sets NamespaceLabels by the namespace of the pod when they aren't set
+func (c *NetConf) completeNamespaceLabels(ctx context.Context, k8sClient client.Client) error {
+	if c.NamespaceLabels != nil || c.K8sPodNs == "" {
+		return nil
+	}
+	namespace := corev1.Namespace{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: c.K8sPodNs}, &namespace); err != nil {
+		klog.Errorf("Failed to get namespace %s, err: %v", c.K8sPodNs, err)
+		return err
+	}
+	c.NamespaceLabels = namespace.Labels
+	return nil
+}
+
+// completeByNamespace sets the default pool of namespace when pool isn't specified by pod or its owner,
+// and checks pools are in the allowed pools of namespace
+func (c *NetConf) completeByNamespace(namespace *corev1.Namespace) error {
+	if c.Pool == "" {
+		if pool, ok := c.podAnnotation(namespace.Annotations, constants.IpamAnnotationPool); ok {
+			c.Pool = pool
+		}
+	}
+
+	allowed := splitPools(namespace.Annotations[constants.IpamAnnotationAllowedPools])
+	if len(allowed) == 0 {
+		return nil
+	}
+	allowedSet := sets.New(allowed...)
+	for _, pool := range append(splitPools(c.Pool), splitPools(c.IPv6Pool)...) {
+		if !allowedSet.Has(pool) {
+			return fmt.Errorf("%w: ippool %s isn't allowed in namespace %s", ErrInvalidRequest, pool, namespace.GetName())
+		}
+	}
+	c.AllowedPools = allowed
+	return nil
+}
+
+// podAnnotation returns the value of annotation key for interface c.IfName, the annotation without interface
+// suffix only applies to the default interface
+func (c *NetConf) podAnnotation(annotations map[string]string, key string) (string, bool) {
+	if c.IfName != "" {
+		if v, ok := annotations[key+"-"+c.IfName]; ok {
+			return v, true
+		}
+	}
+	if !c.isDefaultIf() {
+		return "", false
+	}
+	v, ok := annotations[key]
+	return v, ok
+}
+
+// virtualMachineOf returns the KubeVirt virtual machine name of virt-launcher pod, the VirtualMachineInstance
+// has the same name as its VirtualMachine
+func virtualMachineOf(pod *corev1.Pod) string {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || ref.Kind != constants.KindVirtualMachineInstance {
+		return ""
+	}
+	if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || gv.Group != constants.KubeVirtGroup {
+		return ""
+	}
+	return ref.Name
+}
+
+// isDefaultIf returns true when the request is for the default interface or doesn't set interface name
+func (c *NetConf) isDefaultIf() bool {
+	return c.IfName == "" || c.IfName == constants.DefaultIfName
+}
+
+// Valid returns ErrInvalidRequest wrapped with the reason when the request is invalid
 func (c *NetConf) Valid() error {
 	if c.Type == "" {
-		return fmt.Errorf("must set Type")
+		return fmt.Errorf("%w: must set Type", ErrInvalidRequest)
 	}
 
 	if c.Type == v1alpha1.AllocateTypeCNIUsed || c.Type == v1alpha1.AllocateTypePod {
 		if c.AllocateIdentify == "" {
-			return fmt.Errorf("type %s must set AllocatedIdentify", c.Type)
+			return fmt.Errorf("%w: type %s must set AllocatedIdentify", ErrInvalidRequest, c.Type)
 		}
 	}
 
-	if c.Type == v1alpha1.AllocateTypePod || c.Type == v1alpha1.AllocateTypeStatefulSet {
+	if c.Type == v1alpha1.AllocateTypePod || c.Type.HeldByOwner() {
 		if c.K8sPodName == "" || c.K8sPodNs == "" {
-			return fmt.Errorf("type %s must set K8sPodNs and K8sPodName", c.Type)
+			return fmt.Errorf("%w: type %s must set K8sPodNs and K8sPodName", ErrInvalidRequest, c.Type)
 		}
 	}
 
-	if c.Type == v1alpha1.AllocateTypeStatefulSet {
+	if !c.DualStack && (c.IPv6Pool != "" || c.IPv6 != "") {
+		return fmt.Errorf("%w: must set DualStack when set IPv6Pool or IPv6", ErrInvalidRequest)
+	}
+
+	if c.Type == v1alpha1.AllocateTypeStatefulSet || c.Type == v1alpha1.AllocateTypeOwner {
+		if c.DualStack {
+			return fmt.Errorf("%w: type %s doesn't support dual stack", ErrInvalidRequest, c.Type)
+		}
+		if len(splitPools(c.Pool)) > 1 {
+			return fmt.Errorf("%w: type %s doesn't support pool list", ErrInvalidRequest, c.Type)
+		}
 		if c.Owner == "" {
-			return fmt.Errorf("type %s must set Owner", c.Type)
+			return fmt.Errorf("%w: type %s must set Owner", ErrInvalidRequest, c.Type)
 		}
 		if c.Pool == "" || c.IP == "" {
-			return fmt.Errorf("type %s must set Pool and IP", c.Type)
+			return fmt.Errorf("%w: type %s must set Pool and IP", ErrInvalidRequest, c.Type)
 		}
 	}
+	if c.Type == v1alpha1.AllocateTypeOwner && c.OwnerKind == "" {
+		return fmt.Errorf("%w: type %s must set OwnerKind", ErrInvalidRequest, c.Type)
+	}
+	if c.Type == v1alpha1.AllocateTypeVM && c.Owner == "" {
+		return fmt.Errorf("%w: type %s must set Owner", ErrInvalidRequest, c.Type)
+	}
 
 	return nil
 }
 
 func (c *NetConf) getAllocateID() string {
 	allocatedID := c.AllocateIdentify
-	if c.Type == v1alpha1.AllocateTypePod || c.Type == v1alpha1.AllocateTypeStatefulSet {
+	if c.Type == v1alpha1.AllocateTypeVM {
+		return c.Owner
+	}
+	if c.Type == v1alpha1.AllocateTypePod || c.Type.HeldByOwner() {
 		allocatedID = utils.GenAllocateIDFromPod(c.K8sPodNs, c.K8sPodName)
 	}
 	return allocatedID
 }
 
+// canTakeOver returns whether the ip allocated to a can be reassigned to the request
+func (c *NetConf) canTakeOver(a v1alpha1.AllocateInfo) bool {
+	return c.takeOver != nil && *c.takeOver == a
+}
+
 func (c *NetConf) genAllocateInfo() v1alpha1.AllocateInfo {
 	a := v1alpha1.AllocateInfo{
-		Type:  c.Type,
-		ID:    c.getAllocateID(),
-		Owner: c.Owner,
+		Type:      c.Type,
+		ID:        c.getAllocateID(),
+		Owner:     c.Owner,
+		OwnerKind: c.OwnerKind,
+		IfName:    c.IfName,
 	}
 	if a.Type == v1alpha1.AllocateTypePod {
 		a.CID = c.AllocateIdentify
@@ -133,6 +326,28 @@ func (c *NetConf) genAllocateInfo() v1alpha1.AllocateInfo {
 	return a
 }
 
+// familyConf returns a single-stack copy of the dual-stack conf for the ip family
+func (c *NetConf) familyConf(family v1alpha1.IPFamily) *NetConf {
+	conf := *c
+	conf.DualStack = false
+	conf.IPv6Pool, conf.IPv6 = "", ""
+	if family == v1alpha1.IPFamilyIPv6 {
+		conf.Pool, conf.IP = c.IPv6Pool, c.IPv6
+	}
+	return &conf
+}
+
+// splitPools splits the ippool list separated by comma
+func splitPools(pools string) []string {
+	res := []string{}
+	for _, p := range strings.Split(pools, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
 func (c *NetConf) podStr() string {
 	return c.K8sPodNs + "/" + c.K8sPodName
 }
@@ -153,7 +368,7 @@ func (c *NetConf) completeByStatefulSet(ctx context.Context, k8sClient client.Cl
 	if ips, ok := sts.Annotations[constants.IpamAnnotationIPList]; ok {
 		if c.Pool == "" {
 			klog.Errorf("statefulset %v can't only specify IP list but no pool", sts)
-			return fmt.Errorf("can't only specify IP list but no pool")
+			return fmt.Errorf("%w: can't only specify IP list but no pool", ErrInvalidRequest)
 		}
 		ipList = strings.Split(ips, ",")
 	} else {
@@ -162,15 +377,120 @@ func (c *NetConf) completeByStatefulSet(ctx context.Context, k8sClient client.Cl
 
 	c.Type = v1alpha1.AllocateTypeStatefulSet
 	c.Owner = utils.GenOwner(sts.GetNamespace(), sts.GetName())
+	c.OwnerReference = &metav1.OwnerReference{APIVersion: "apps/v1", Kind: constants.KindStatefulSet, Name: sts.GetName(), UID: sts.GetUID()}
+	if sts.Annotations[constants.IpamAnnotationIPListMode] == constants.IPListModeOrdinal {
+		return c.completeByOrdinal(ctx, k8sClient, &sts, ipList, poolNs)
+	}
+	return c.completeByIPList(ctx, k8sClient, ipList, poolNs, fmt.Sprintf("statefulset %v", stsNsName))
+}
+
+// completeByOrdinal sets c.IP to the ip in ipList at the ordinal of the pod, pod sts-N always gets the Nth ip
+func (c *NetConf) completeByOrdinal(ctx context.Context, k8sClient client.Client, sts *appsv1.StatefulSet, ipList []string, poolNs string) error {
+	stsNsName := types.NamespacedName{Namespace: sts.GetNamespace(), Name: sts.GetName()}
+	ordinal, err := statefulSetOrdinal(sts.GetName(), c.K8sPodName)
+	if err != nil {
+		klog.Errorf("Failed to get ordinal of pod %s in statefulset %v, err: %v", c.podStr(), stsNsName, err)
+		return err
+	}
+	if ordinal >= len(ipList) {
+		var replicas int32 = 1
+		if sts.Spec.Replicas != nil {
+			replicas = *sts.Spec.Replicas
+		}
+		klog.Errorf("Statefulset %v ip list %v is shorter than its %d replicas, no ip for pod %s", stsNsName, ipList, replicas, c.podStr())
+		return fmt.Errorf("%w: statefulset %v ip list has %d ips but %d replicas, no ip for ordinal %d of pod %s",
+			ErrInvalidRequest, stsNsName, len(ipList), replicas, ordinal, c.podStr())
+	}
 
 	pool := v1alpha1.IPPool{}
 	poolNsName := types.NamespacedName{Namespace: poolNs, Name: c.Pool}
-	if err := k8sClient.Get(ctx, poolNsName, &pool); err != nil {
+	if _, err := v1alpha1.GetIPPool(ctx, k8sClient, poolNsName, &pool); err != nil {
 		klog.Errorf("Failed to get specified ippool %v by pod %s owner statefulset %v, err: %v", poolNsName, c.podStr(), stsNsName, err)
-		return err
+		return poolGetError(poolNsName, err)
+	}
+	ipStr := strings.TrimSpace(ipList[ordinal])
+	ip := net.ParseIP(ipStr)
+	if ip == nil || !pool.Contains(ip) {
+		klog.Errorf("IP %s for ordinal %d of statefulset %v isn't a valid ip in pool %v", ipStr, ordinal, stsNsName, poolNsName)
+		return fmt.Errorf("%w: ip %s for ordinal %d of statefulset %v isn't a valid ip in pool %v", ErrIPOutOfPool, ipStr, ordinal, stsNsName, poolNsName)
+	}
+	if _, exist := pool.Status.UsedIps[ipStr]; exist {
+		return &IPInUseError{IP: ipStr, Pool: pool.Name, Holder: usedIPHolder(&pool, ipStr)}
+	}
+	if a, exist := pool.Status.AllocatedIPs[ipStr]; exist {
+		if a.Type != c.Type || a.ID != c.getAllocateID() || a.Owner != c.Owner {
+			return &IPInUseError{IP: ipStr, Pool: pool.Name, Holder: a}
+		}
+	}
+	c.IP = ipStr
+	return nil
+}
+
+// statefulSetOrdinal returns the ordinal of pod podName in statefulset stsName, the pod name is stsName-ordinal
+func statefulSetOrdinal(stsName, podName string) (int, error) {
+	prefix := stsName + "-"
+	if !strings.HasPrefix(podName, prefix) {
+		return 0, fmt.Errorf("%w: pod %s doesn't belong to statefulset %s", ErrInvalidRequest, podName, stsName)
+	}
+	ordinal, err := strconv.Atoi(podName[len(prefix):])
+	if err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("%w: pod %s has invalid ordinal in statefulset %s", ErrInvalidRequest, podName, stsName)
+	}
+	return ordinal, nil
+}
+
+// completeByOwner completes pool and ip by the ip list of the outermost controller owner of pod which has ip list annotation,
+// e.g. the Deployment of the pod ReplicaSet, a pod without such owner is unchanged
+func (c *NetConf) completeByOwner(ctx context.Context, k8sClient client.Client, pod *corev1.Pod, poolNs string) error {
+	var target *metav1.PartialObjectMetadata
+	var obj metav1.Object = pod
+	for depth := 0; depth < maxOwnerDepth; depth++ {
+		ref := metav1.GetControllerOf(obj)
+		if ref == nil {
+			break
+		}
+		owner := &metav1.PartialObjectMetadata{}
+		owner.SetGroupVersionKind(schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind))
+		ownerNsName := types.NamespacedName{Namespace: c.K8sPodNs, Name: ref.Name}
+		if err := k8sClient.Get(ctx, ownerNsName, owner); err != nil {
+			// owners which can't be read don't specify ip list
+			klog.Infof("Failed to get %s %v of pod %s, stop walking owners, err: %v", ref.Kind, ownerNsName, c.podStr(), err)
+			break
+		}
+		if _, ok := owner.Annotations[constants.IpamAnnotationIPList]; ok {
+			target = owner
+		}
+		obj = owner
+	}
+	if target == nil {
+		return nil
+	}
+
+	ownerStr := fmt.Sprintf("%s %s/%s", target.Kind, target.GetNamespace(), target.GetName())
+	c.Pool = target.Annotations[constants.IpamAnnotationPool]
+	if c.Pool == "" {
+		klog.Errorf("%s can't only specify IP list but no pool", ownerStr)
+		return fmt.Errorf("%w: can't only specify IP list but no pool", ErrInvalidRequest)
+	}
+	c.Type = v1alpha1.AllocateTypeOwner
+	c.Owner = utils.GenOwner(target.GetNamespace(), target.GetName())
+	c.OwnerKind = utils.GenOwnerKind(target.APIVersion, target.Kind)
+	return c.completeByIPList(ctx, k8sClient, strings.Split(target.Annotations[constants.IpamAnnotationIPList], ","), poolNs, ownerStr)
+}
+
+// completeByIPList sets c.IP to the ip in ipList allocated to the pod, or a random unallocated ip in ipList,
+// c.Pool, c.Type and c.Owner must be set
+func (c *NetConf) completeByIPList(ctx context.Context, k8sClient client.Client, ipList []string, poolNs string, ownerStr string) error {
+	pool := v1alpha1.IPPool{}
+	poolNsName := types.NamespacedName{Namespace: poolNs, Name: c.Pool}
+	if _, err := v1alpha1.GetIPPool(ctx, k8sClient, poolNsName, &pool); err != nil {
+		klog.Errorf("Failed to get specified ippool %v by pod %s owner %s, err: %v", poolNsName, c.podStr(), ownerStr, err)
+		return poolGetError(poolNsName, err)
 	}
 	unUsedIPs := []string{}
+	ownerIPs := []string{}
 	for _, ipStr := range ipList {
+		ipStr = strings.TrimSpace(ipStr)
 		ip := net.ParseIP(ipStr)
 		// check if valid
 		if ip == nil {
@@ -185,10 +505,15 @@ func (c *NetConf) completeByStatefulSet(ctx context.Context, k8sClient client.Cl
 			continue
 		}
 		if allocateInfo, exist := pool.Status.AllocatedIPs[ipStr]; exist {
-			if allocateInfo.Type == v1alpha1.AllocateTypeStatefulSet && allocateInfo.ID == c.getAllocateID() && allocateInfo.Owner == c.Owner {
+			if allocateInfo.Type == c.Type && allocateInfo.ID == c.getAllocateID() && allocateInfo.Owner == c.Owner &&
+				allocateInfo.OwnerKind == c.OwnerKind {
 				c.IP = ipStr
 				return nil
 			}
+			if c.Type == v1alpha1.AllocateTypeOwner && allocateInfo.Type == c.Type && allocateInfo.Owner == c.Owner &&
+				allocateInfo.OwnerKind == c.OwnerKind {
+				ownerIPs = append(ownerIPs, ipStr)
+			}
 			continue
 		}
 
@@ -202,6 +527,24 @@ func (c *NetConf) completeByStatefulSet(ctx context.Context, k8sClient client.Cl
 		return nil
 	}
 
-	klog.Errorf("For statefulset %v ipList %v, no valid or unallocate ip in pool %v to allocate to pod %s", stsNsName, ipList, poolNsName, c.podStr())
-	return fmt.Errorf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)
+	// pods of deployments and jobs are recreated with new names, take over the ip of the deleted pod
+	for _, ipStr := range ownerIPs {
+		allocateInfo := pool.Status.AllocatedIPs[ipStr]
+		podNsName := utils.GetPodNsNameByAllocateID(allocateInfo.ID)
+		err := k8sClient.Get(ctx, podNsName, &corev1.Pod{})
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			klog.Errorf("Failed to get pod %v holding ip %s of %s, err: %v", podNsName, ipStr, ownerStr, err)
+			continue
+		}
+		klog.Infof("Pod %v holding ip %s of %s is deleted, reassign the ip to pod %s", podNsName, ipStr, ownerStr, c.podStr())
+		c.IP = ipStr
+		c.takeOver = &allocateInfo
+		return nil
+	}
+
+	klog.Errorf("For %s ipList %v, no valid or unallocate ip in pool %v to allocate to pod %s", ownerStr, ipList, poolNsName, c.podStr())
+	return fmt.Errorf("%w: no valid or unallocate ip in %s ip list %v", ErrPoolFull, ownerStr, ipList)
 }
@@ -1,6 +1,8 @@
 package ipam
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -9,8 +11,10 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
 	"github.com/everoute/ipam/api/ipam/v1alpha1"
 	"github.com/everoute/ipam/pkg/constants"
@@ -50,7 +54,10 @@ var _ = Describe("net_conf_complete", func() {
 	AfterEach(func() {
 		Expect(k8sClient.DeleteAllOf(ctx, &corev1.Pod{}, client.InNamespace(ns))).Should(Succeed())
 		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.StatefulSet{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.ReplicaSet{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &appsv1.Deployment{}, client.InNamespace(ns))).Should(Succeed())
 		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPPool{}, client.InNamespace(ns))).Should(Succeed())
+		Expect(k8sClient.DeleteAllOf(ctx, &v1alpha1.IPAllocation{}, client.InNamespace(ns))).Should(Succeed())
 	})
 
 	Context("type cniused", func() {
@@ -164,7 +171,7 @@ var _ = Describe("net_conf_complete", func() {
 					})
 					It("error for netconf is invalid", func() {
 						err := c.Complete(ctx, k8sClient, ns)
-						Expect(err).Should(MatchError(fmt.Sprintf("must set K8sPodNs and K8sPodName for type %s", v1alpha1.AllocateTypePod)))
+						Expect(err).Should(MatchError(fmt.Sprintf("invalid request: must set K8sPodNs and K8sPodName for type %s", v1alpha1.AllocateTypePod)))
 						Expect(c.Pool).Should(Equal(""))
 						Expect(c.IP).Should(Equal(""))
 					})
@@ -260,7 +267,7 @@ var _ = Describe("net_conf_complete", func() {
 						})
 						It("error for netconf is invalid", func() {
 							err := c.Complete(ctx, k8sClient, ns)
-							Expect(err).Should(MatchError(fmt.Sprintf("must set K8sPodNs and K8sPodName for type %s", v1alpha1.AllocateTypePod)))
+							Expect(err).Should(MatchError(fmt.Sprintf("invalid request: must set K8sPodNs and K8sPodName for type %s", v1alpha1.AllocateTypePod)))
 							Expect(c.Pool).Should(Equal(""))
 							Expect(c.IP).Should(Equal(""))
 						})
@@ -296,7 +303,7 @@ var _ = Describe("net_conf_complete", func() {
 						K8sPodNs:   ns,
 					}
 					err := c.Complete(ctx, k8sClient, ns)
-					Expect(err).Should(MatchError("can't only specify static IP but no pool"))
+					Expect(err).Should(MatchError("invalid request: can't only specify static IP but no pool"))
 				})
 			})
 		})
@@ -493,7 +500,7 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{"12.10.65.1"}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("ip-list is in ippool except", func() {
@@ -512,13 +519,13 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{"12.10.65.7"}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("ip-list is not in ippool start-end", func() {
 				BeforeEach(func() {
 					p := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: pool1.Name}, &p)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: pool1.Name}, &p)).Should(Succeed())
 					p.Spec.CIDR = ""
 					p.Spec.Except = nil
 					p.Spec.Start = "10.10.65.0"
@@ -538,7 +545,7 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{"10.10.65.9"}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("ip-list is empty string", func() {
@@ -558,7 +565,7 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{""}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("ip-list is invalid ip", func() {
@@ -578,13 +585,13 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{"10.1.2", "10.3.4"}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("ip-list has been allocated", func() {
 				BeforeEach(func() {
 					pool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
 					pool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 					pool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeCNIUsed, ID: "cniusedid"}
 					pool.Status.AllocatedIPs["10.10.65.2"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypePod, ID: "ns-unexist/pod-unexist"}
@@ -607,7 +614,7 @@ var _ = Describe("net_conf_complete", func() {
 					err := c.Complete(ctx, k8sClient, ns)
 					stsNsName := types.NamespacedName{Namespace: ns, Name: stsName}
 					ipList := []string{"10.10.65.1", "10.10.65.2", "10.10.65.3", "10.10.65.4"}
-					Expect(err).Should(MatchError(fmt.Sprintf("no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
+					Expect(err).Should(MatchError(fmt.Sprintf("ippool has no ip to allocate: no valid or unallocate ip in statefulset %v ip list %v", stsNsName, ipList)))
 				})
 			})
 			When("first allocate ip from ip-list", func() {
@@ -633,7 +640,7 @@ var _ = Describe("net_conf_complete", func() {
 			When("allocate ip from ip-list", func() {
 				BeforeEach(func() {
 					pool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
 					pool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 					pool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeCNIUsed, ID: "cniusedid"}
 					pool.Status.UsedIps = make(map[string]string)
@@ -661,7 +668,7 @@ var _ = Describe("net_conf_complete", func() {
 			When("reallocate ip from ip-list", func() {
 				BeforeEach(func() {
 					pool := v1alpha1.IPPool{}
-					Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
+					Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &pool)).Should(Succeed())
 					pool.Status.AllocatedIPs = make(map[string]v1alpha1.AllocateInfo)
 					pool.Status.AllocatedIPs["10.10.65.1"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeCNIUsed, ID: "cniusedid"}
 					pool.Status.AllocatedIPs["10.10.65.4"] = v1alpha1.AllocateInfo{Type: v1alpha1.AllocateTypeStatefulSet, ID: ns + "/" + podname, Owner: ns + "/" + stsName}
@@ -705,6 +712,246 @@ var _ = Describe("net_conf_complete", func() {
 			})
 		})
 	})
+
+	Context("type statefulset in ordinal mode", func() {
+		stsName := "sts1"
+		var replicas int32 = 3
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			sts := appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      stsName,
+					Namespace: ns,
+					Annotations: map[string]string{
+						constants.IpamAnnotationPool:       "pool1",
+						constants.IpamAnnotationIPList:     "10.10.65.3,10.10.65.1",
+						constants.IpamAnnotationIPListMode: constants.IPListModeOrdinal,
+					},
+				},
+				Spec: appsv1.StatefulSetSpec{
+					Replicas: &replicas,
+					Selector: &metav1.LabelSelector{MatchLabels: podLabel},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: podLabel},
+						Spec:       pod1.Spec,
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, &sts)).Should(Succeed())
+			for _, name := range []string{stsName + "-1", stsName + "-2"} {
+				pod := pod1.DeepCopy()
+				pod.Name = name
+				pod.OwnerReferences = []metav1.OwnerReference{{Kind: constants.KindStatefulSet, Name: stsName, UID: sts.GetUID(), APIVersion: "apps/v1"}}
+				Expect(k8sClient.Create(ctx, pod)).Should(Succeed())
+			}
+		})
+		It("netconf set ip at the pod ordinal", func() {
+			c := NetConf{
+				K8sPodName: stsName + "-1",
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c.Type).Should(Equal(v1alpha1.AllocateTypeStatefulSet))
+			Expect(c.Pool).Should(Equal("pool1"))
+			Expect(c.IP).Should(Equal("10.10.65.1"))
+		})
+		It("error for ordinal out of ip list", func() {
+			c := NetConf{
+				K8sPodName: stsName + "-2",
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			err := c.Complete(ctx, k8sClient, ns)
+			Expect(err).Should(MatchError(fmt.Sprintf("invalid request: statefulset %s/%s ip list has 2 ips but 3 replicas, no ip for ordinal 2 of pod %s/%s-2",
+				ns, stsName, ns, stsName)))
+		})
+		It("error for ip of the ordinal is used by others", func() {
+			p := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &p)).Should(Succeed())
+			p.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{
+				"10.10.65.1": {Type: v1alpha1.AllocateTypeCNIUsed, ID: "other"},
+			}
+			Expect(k8sClient.Status().Update(ctx, &p)).Should(Succeed())
+			c := NetConf{
+				K8sPodName: stsName + "-1",
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("type owner", func() {
+		podTemplate := corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: podLabel,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "test",
+						Image: "network",
+					},
+				},
+			},
+		}
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pool1.DeepCopy())).Should(Succeed())
+			deploy := appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "deploy1",
+					Namespace: ns,
+					Annotations: map[string]string{
+						constants.IpamAnnotationPool:   "pool1",
+						constants.IpamAnnotationIPList: "10.10.65.3, 10.10.65.4",
+					},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: podLabel},
+					Template: podTemplate,
+				},
+			}
+			Expect(k8sClient.Create(ctx, &deploy)).Should(Succeed())
+			rs := appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "deploy1-rs",
+					Namespace:       ns,
+					OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(&deploy, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+				},
+				Spec: appsv1.ReplicaSetSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: podLabel},
+					Template: podTemplate,
+				},
+			}
+			Expect(k8sClient.Create(ctx, &rs)).Should(Succeed())
+			pod := pod1.DeepCopy()
+			pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(&rs, appsv1.SchemeGroupVersion.WithKind("ReplicaSet"))}
+			Expect(k8sClient.Create(ctx, pod)).Should(Succeed())
+		})
+		It("netconf set ip specified by deployment of the replicaset", func() {
+			c := NetConf{
+				K8sPodName: podname,
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c.Type).Should(Equal(v1alpha1.AllocateTypeOwner))
+			Expect(c.Pool).Should(Equal("pool1"))
+			Expect(c.IP).Should(BeElementOf("10.10.65.3", "10.10.65.4"))
+			Expect(c.Owner).Should(Equal(ns + "/deploy1"))
+			Expect(c.OwnerKind).Should(Equal("apps/v1/Deployment"))
+		})
+		It("netconf keeps the ip allocated to the pod", func() {
+			p := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &p)).Should(Succeed())
+			p.Status.AllocatedIPs = map[string]v1alpha1.AllocateInfo{
+				"10.10.65.4": {Type: v1alpha1.AllocateTypeOwner, ID: ns + "/" + podname, Owner: ns + "/deploy1", OwnerKind: "apps/v1/Deployment"},
+			}
+			Expect(k8sClient.Status().Update(ctx, &p)).Should(Succeed())
+			c := NetConf{
+				K8sPodName: podname,
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c.IP).Should(Equal("10.10.65.4"))
+		})
+		It("pod recreated with a new name takes over the ip of the deleted pod", func() {
+			deploy := appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "deploy1"}, &deploy)).Should(Succeed())
+			deploy.Annotations[constants.IpamAnnotationIPList] = "10.10.65.3"
+			Expect(k8sClient.Update(ctx, &deploy)).Should(Succeed())
+			rs := appsv1.ReplicaSet{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "deploy1-rs"}, &rs)).Should(Succeed())
+
+			c := NetConf{K8sPodName: podname, K8sPodNs: ns, Type: v1alpha1.AllocateTypePod, AllocateIdentify: "cid1"}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			_, err := ipam.ExecAdd(ctx, &c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.IP).Should(Equal("10.10.65.3"))
+
+			By("the ip isn't taken over while the pod exists")
+			pod := pod1.DeepCopy()
+			pod.Name = "pod2"
+			pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(&rs, appsv1.SchemeGroupVersion.WithKind("ReplicaSet"))}
+			Expect(k8sClient.Create(ctx, pod)).Should(Succeed())
+			c2 := NetConf{K8sPodName: "pod2", K8sPodNs: ns, Type: v1alpha1.AllocateTypePod, AllocateIdentify: "cid2"}
+			Expect(c2.Complete(ctx, k8sClient, ns)).Should(MatchError(ErrPoolFull))
+
+			By("delete the pod and recreate it with a new name")
+			Expect(ipam.ExecDel(ctx, &c)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: podname}},
+				client.GracePeriodSeconds(0))).Should(Succeed())
+			c2 = NetConf{K8sPodName: "pod2", K8sPodNs: ns, Type: v1alpha1.AllocateTypePod, AllocateIdentify: "cid2"}
+			Expect(c2.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c2.IP).Should(Equal("10.10.65.3"))
+			_, err = ipam.ExecAdd(ctx, &c2)
+			Expect(err).ToNot(HaveOccurred())
+
+			p := v1alpha1.IPPool{}
+			Expect(getIPPool(types.NamespacedName{Namespace: ns, Name: "pool1"}, &p)).Should(Succeed())
+			Expect(p.Status.AllocatedIPs).Should(HaveKeyWithValue("10.10.65.3", v1alpha1.AllocateInfo{
+				Type: v1alpha1.AllocateTypeOwner, ID: ns + "/pod2", Owner: ns + "/deploy1", OwnerKind: "apps/v1/Deployment"}))
+			Expect(p.Status.AllocatedIPs).Should(HaveLen(1))
+		})
+	})
+
+	Context("pod doesn't specify ippool", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, pod1.DeepCopy())).Should(Succeed())
+		})
+		It("netconf set pod and namespace labels for ippool selection", func() {
+			c := NetConf{
+				K8sPodName: podname,
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c.Pool).Should(Equal(""))
+			Expect(c.PodLabels).Should(Equal(podLabel))
+			Expect(c.NamespaceLabels).Should(HaveKeyWithValue(corev1.LabelMetadataName, ns))
+		})
+	})
+
+	Context("namespace specify ippool", func() {
+		setNamespaceAnnotations := func(annotations map[string]string) {
+			namespace := corev1.Namespace{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: ns}, &namespace)).Should(Succeed())
+			namespace.Annotations = annotations
+			Expect(k8sClient.Update(ctx, &namespace)).Should(Succeed())
+		}
+		BeforeEach(func() {
+			setNamespaceAnnotations(map[string]string{
+				constants.IpamAnnotationPool:         "pool1",
+				constants.IpamAnnotationAllowedPools: "pool1,pool2",
+			})
+		})
+		AfterEach(func() {
+			setNamespaceAnnotations(nil)
+		})
+		It("netconf set the default ippool of namespace", func() {
+			Expect(k8sClient.Create(ctx, pod1.DeepCopy())).Should(Succeed())
+			c := NetConf{
+				K8sPodName: podname,
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(Succeed())
+			Expect(c.Pool).Should(Equal("pool1"))
+		})
+		It("error for pod specify ippool not allowed in namespace", func() {
+			pod := pod1.DeepCopy()
+			pod.Annotations = map[string]string{constants.IpamAnnotationPool: "pool3"}
+			Expect(k8sClient.Create(ctx, pod)).Should(Succeed())
+			c := NetConf{
+				K8sPodName: podname,
+				K8sPodNs:   ns,
+				Type:       v1alpha1.AllocateTypePod,
+			}
+			Expect(c.Complete(ctx, k8sClient, ns)).Should(MatchError(fmt.Sprintf("invalid request: ippool pool3 isn't allowed in namespace %s", ns)))
+		})
+	})
 })
 
 func TestValid(t *testing.T) {
@@ -838,6 +1085,68 @@ func TestValid(t *testing.T) {
 			},
 			isValid: false,
 		},
+		{
+			name: "valid for dual stack",
+			c: NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				AllocateIdentify: "cid",
+				K8sPodName:       "pod",
+				K8sPodNs:         "ns",
+				DualStack:        true,
+				IPv6Pool:         "pool6",
+				IPv6:             "fd00::10",
+			},
+			isValid: true,
+		},
+		{
+			name: "set ipv6 pool without dual stack",
+			c: NetConf{
+				Type:             v1alpha1.AllocateTypePod,
+				AllocateIdentify: "cid",
+				K8sPodName:       "pod",
+				K8sPodNs:         "ns",
+				IPv6Pool:         "pool6",
+			},
+			isValid: false,
+		},
+		{
+			name: "dual stack for type statefulset",
+			c: NetConf{
+				Type:       v1alpha1.AllocateTypeStatefulSet,
+				K8sPodName: "pod",
+				K8sPodNs:   "ns",
+				Owner:      "ns/ss",
+				Pool:       "pool1",
+				IP:         "10.10.1.1",
+				DualStack:  true,
+			},
+			isValid: false,
+		},
+		{
+			name: "valid for type owner",
+			c: NetConf{
+				Type:       v1alpha1.AllocateTypeOwner,
+				K8sPodName: "pod",
+				K8sPodNs:   "ns",
+				Owner:      "ns/deploy",
+				OwnerKind:  "apps/v1/Deployment",
+				Pool:       "pool1",
+				IP:         "10.10.1.1",
+			},
+			isValid: true,
+		},
+		{
+			name: "type owner without owner kind",
+			c: NetConf{
+				Type:       v1alpha1.AllocateTypeOwner,
+				K8sPodName: "pod",
+				K8sPodNs:   "ns",
+				Owner:      "ns/deploy",
+				Pool:       "pool1",
+				IP:         "10.10.1.1",
+			},
+			isValid: false,
+		},
 	}
 
 	for _, item := range tests {
@@ -847,3 +1156,193 @@ func TestValid(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitPools(t *testing.T) {
+	tests := []struct {
+		pools string
+		exp   []string
+	}{
+		{pools: "", exp: []string{}},
+		{pools: "pool1", exp: []string{"pool1"}},
+		{pools: "pool1,pool2", exp: []string{"pool1", "pool2"}},
+		{pools: " pool1, ,pool2 ,", exp: []string{"pool1", "pool2"}},
+	}
+	for _, item := range tests {
+		if res := splitPools(item.pools); fmt.Sprint(res) != fmt.Sprint(item.exp) {
+			t.Errorf("split pools %s failed, expect is %v, real is %v", item.pools, item.exp, res)
+		}
+	}
+}
+
+func TestPodAnnotation(t *testing.T) {
+	annotations := map[string]string{
+		constants.IpamAnnotationPool:           "pool1",
+		constants.IpamAnnotationPool + "-net1": "pool2",
+	}
+	tests := []struct {
+		ifName string
+		exp    string
+		expOk  bool
+	}{
+		{ifName: "", exp: "pool1", expOk: true},
+		{ifName: "eth0", exp: "pool1", expOk: true},
+		{ifName: "net1", exp: "pool2", expOk: true},
+		{ifName: "net2", exp: "", expOk: false},
+	}
+	for _, item := range tests {
+		c := NetConf{IfName: item.ifName}
+		res, ok := c.podAnnotation(annotations, constants.IpamAnnotationPool)
+		if res != item.exp || ok != item.expOk {
+			t.Errorf("interface %s failed, expect is %s %v, real is %s %v", item.ifName, item.exp, item.expOk, res, ok)
+		}
+	}
+}
+
+func TestStatefulSetOrdinal(t *testing.T) {
+	tests := []struct {
+		podName string
+		exp     int
+		expErr  bool
+	}{
+		{podName: "web-0", exp: 0},
+		{podName: "web-12", exp: 12},
+		{podName: "web-x", expErr: true},
+		{podName: "web--1", expErr: true},
+		{podName: "db-1", expErr: true},
+	}
+	for _, item := range tests {
+		res, err := statefulSetOrdinal("web", item.podName)
+		if (err != nil) != item.expErr || res != item.exp {
+			t.Errorf("pod %s failed, expect is %d err %v, real is %d err %v", item.podName, item.exp, item.expErr, res, err)
+		}
+	}
+}
+
+func TestVirtualMachineOf(t *testing.T) {
+	isController := true
+	tests := []struct {
+		name string
+		ref  metav1.OwnerReference
+		exp  string
+	}{
+		{
+			name: "virt-launcher pod",
+			ref:  metav1.OwnerReference{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachineInstance", Name: "vm1", Controller: &isController},
+			exp:  "vm1",
+		},
+		{
+			name: "owner isn't controller",
+			ref:  metav1.OwnerReference{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachineInstance", Name: "vm1"},
+			exp:  "",
+		},
+		{
+			name: "other group",
+			ref:  metav1.OwnerReference{APIVersion: "example.io/v1", Kind: "VirtualMachineInstance", Name: "vm1", Controller: &isController},
+			exp:  "",
+		},
+		{
+			name: "other kind",
+			ref:  metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "rs1", Controller: &isController},
+			exp:  "",
+		},
+	}
+	for _, item := range tests {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{item.ref}}}
+		if res := virtualMachineOf(&pod); res != item.exp {
+			t.Errorf("test %s failed, expect is %s, real is %s", item.name, item.exp, res)
+		}
+	}
+}
+
+func TestCompleteByNamespace(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        NetConf
+		annotations map[string]string
+		expPool     string
+		expAllowed  []string
+		expErr      bool
+	}{
+		{
+			name:        "namespace default pool",
+			annotations: map[string]string{constants.IpamAnnotationPool: "pool1"},
+			expPool:     "pool1",
+		},
+		{
+			name:        "pod pool takes precedence",
+			conf:        NetConf{Pool: "pool2"},
+			annotations: map[string]string{constants.IpamAnnotationPool: "pool1"},
+			expPool:     "pool2",
+		},
+		{
+			name:        "pool is allowed",
+			conf:        NetConf{Pool: "pool1,pool2"},
+			annotations: map[string]string{constants.IpamAnnotationAllowedPools: "pool1, pool2"},
+			expPool:     "pool1,pool2",
+			expAllowed:  []string{"pool1", "pool2"},
+		},
+		{
+			name:        "pool isn't allowed",
+			conf:        NetConf{Pool: "pool1,pool3"},
+			annotations: map[string]string{constants.IpamAnnotationAllowedPools: "pool1,pool2"},
+			expErr:      true,
+		},
+		{
+			name:        "ipv6 pool isn't allowed",
+			conf:        NetConf{Pool: "pool1", DualStack: true, IPv6Pool: "pool6"},
+			annotations: map[string]string{constants.IpamAnnotationAllowedPools: "pool1"},
+			expErr:      true,
+		},
+		{
+			name:        "auto selection limited by allowed pools",
+			annotations: map[string]string{constants.IpamAnnotationAllowedPools: "pool1"},
+			expAllowed:  []string{"pool1"},
+		},
+	}
+	for _, item := range tests {
+		c := item.conf
+		namespace := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Annotations: item.annotations}}
+		err := c.completeByNamespace(&namespace)
+		if (err != nil) != item.expErr {
+			t.Errorf("test %s failed, expect err is %v, real is %v", item.name, item.expErr, err)
+			continue
+		}
+		if err == nil && (c.Pool != item.expPool || fmt.Sprint(c.AllowedPools) != fmt.Sprint(item.expAllowed)) {
+			t.Errorf("test %s failed, expect is %s %v, real is %s %v", item.name, item.expPool, item.expAllowed, c.Pool, c.AllowedPools)
+		}
+	}
+}
+
+func TestCompletePresetPoolQuota(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ipam", Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.10.0.0/28", Subnet: "10.10.0.0/16", Gateway: "10.10.0.1",
+			NamespaceQuotas: []v1alpha1.NamespaceQuota{
+				{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}, Max: 0},
+			},
+		},
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1", Labels: map[string]string{"tenant": "a"}}}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool, namespace).WithStatusSubresource(&v1alpha1.IPPool{}).Build()
+	ctx := context.Background()
+
+	// the pool is preset by the cni config, the pod isn't read
+	conf := NetConf{Pool: "pool", Type: v1alpha1.AllocateTypePod, K8sPodName: "pod1", K8sPodNs: "ns1", AllocateIdentify: "cid"}
+	if err := conf.Complete(ctx, k8sClient, "ipam"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.NamespaceLabels["tenant"] != "a" {
+		t.Fatalf("expect namespace labels completed for preset pool, real is %v", conf.NamespaceLabels)
+	}
+	if _, err := InitIpam(k8sClient, "ipam").ExecAdd(ctx, &conf); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expect ErrQuotaExceeded by namespace selector quota, real is %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package ipam
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+const (
+	PoolSelectPolicyFirst    = "first"
+	PoolSelectPolicyPriority = "priority"
+	PoolSelectPolicyWeight   = "weight"
+	PoolSelectPolicySpread   = "spread"
+)
+
+// PoolSelector chooses the ippool to allocate ip from when the request doesn't specify an ippool.
+// candidates are public and non-full ippools which match the request, it is never empty
+type PoolSelector interface {
+	Select(candidates []*v1alpha1.IPPool, conf *NetConf) *v1alpha1.IPPool
+}
+
+// NewPoolSelector returns the built-in PoolSelector of policy
+func NewPoolSelector(policy string) (PoolSelector, error) {
+	switch policy {
+	case "", PoolSelectPolicyFirst:
+		return &FirstPoolSelector{}, nil
+	case PoolSelectPolicyPriority:
+		return &PriorityPoolSelector{}, nil
+	case PoolSelectPolicyWeight:
+		return &WeightPoolSelector{}, nil
+	case PoolSelectPolicySpread:
+		return &SpreadPoolSelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown pool select policy %s", policy)
+}
+
+// FirstPoolSelector selects the first candidate in ippool list order, it is the default PoolSelector
+type FirstPoolSelector struct{}
+
+func (s *FirstPoolSelector) Select(candidates []*v1alpha1.IPPool, _ *NetConf) *v1alpha1.IPPool {
+	return candidates[0]
+}
+
+// PriorityPoolSelector selects the candidate with the highest spec.priority, the first one wins a tie
+type PriorityPoolSelector struct{}
+
+func (s *PriorityPoolSelector) Select(candidates []*v1alpha1.IPPool, _ *NetConf) *v1alpha1.IPPool {
+	res := candidates[0]
+	for _, item := range candidates[1:] {
+		if item.Spec.Priority > res.Spec.Priority {
+			res = item
+		}
+	}
+	return res
+}
+
+// WeightPoolSelector selects a candidate randomly in proportion to spec.weight, candidates with zero weight
+// are selected only when all weights are zero
+type WeightPoolSelector struct{}
+
+func (s *WeightPoolSelector) Select(candidates []*v1alpha1.IPPool, _ *NetConf) *v1alpha1.IPPool {
+	var total int64
+	for _, item := range candidates {
+		total += int64(item.Spec.Weight)
+	}
+	if total == 0 {
+		//nolint:gosec
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	//nolint:gosec
+	n := rand.Int63n(total)
+	for _, item := range candidates {
+		n -= int64(item.Spec.Weight)
+		if n < 0 {
+			return item
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// SpreadPoolSelector selects the least utilized candidate, the first one wins a tie
+type SpreadPoolSelector struct{}
+
+func (s *SpreadPoolSelector) Select(candidates []*v1alpha1.IPPool, _ *NetConf) *v1alpha1.IPPool {
+	res := candidates[0]
+	minUsage := usage(res)
+	for _, item := range candidates[1:] {
+		if u := usage(item); u < minUsage {
+			res, minUsage = item, u
+		}
+	}
+	return res
+}
+
+// usage returns allocated ip ratio of ipPool, the ip count of spec is used before status.total_count is calculated.
+// Allocated ips are counted from the loaded ipallocations, status.allocated_count is updated after the allocations
+func usage(ipPool *v1alpha1.IPPool) float64 {
+	total := ipPool.Status.TotalCount
+	if total <= 0 {
+		total = ipPool.Length()
+	}
+	if total <= 0 {
+		return 1
+	}
+	allocated := int64(len(ipPool.Status.AllocatedIPs)+len(ipPool.Status.UsedIps)) + ipPool.Status.BlockAllocatedCount
+	return float64(allocated) / float64(total)
+}
@@ -0,0 +1,95 @@
+package ipam
+
+import (
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func newSelectorPool(name string, priority, weight int32, allocated, total int64) *v1alpha1.IPPool {
+	allocatedIPs := make(map[string]v1alpha1.AllocateInfo, allocated)
+	for n := int64(0); n < allocated; n++ {
+		allocatedIPs[fmt.Sprintf("10.10.65.%d", n)] = v1alpha1.AllocateInfo{ID: fmt.Sprintf("ns/pod%d", n), Type: v1alpha1.AllocateTypePod}
+	}
+	return &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:     "10.10.65.0/24",
+			Subnet:   "10.10.64.0/20",
+			Gateway:  "10.10.64.1",
+			Priority: priority,
+			Weight:   weight,
+		},
+		Status: v1alpha1.IPPoolStatus{
+			AllocatedIPs: allocatedIPs,
+			TotalCount:   total,
+		},
+	}
+}
+
+func TestPoolSelector(t *testing.T) {
+	candidates := []*v1alpha1.IPPool{
+		newSelectorPool("pool1", 1, 0, 100, 200),
+		newSelectorPool("pool2", 5, 0, 10, 20),
+		newSelectorPool("pool3", 5, 0, 10, 100),
+		newSelectorPool("pool4", 2, 0, 30, 0),
+	}
+
+	tests := []struct {
+		policy string
+		exp    string
+	}{
+		{policy: "", exp: "pool1"},
+		{policy: PoolSelectPolicyFirst, exp: "pool1"},
+		{policy: PoolSelectPolicyPriority, exp: "pool2"},
+		{policy: PoolSelectPolicySpread, exp: "pool3"},
+	}
+	for _, item := range tests {
+		s, err := NewPoolSelector(item.policy)
+		if err != nil {
+			t.Fatalf("policy %s failed, err: %s", item.policy, err)
+		}
+		if res := s.Select(candidates, &NetConf{}); res.Name != item.exp {
+			t.Errorf("policy %s failed, expect is %s, real is %s", item.policy, item.exp, res.Name)
+		}
+	}
+
+	if _, err := NewPoolSelector("unknown"); err == nil {
+		t.Errorf("unknown policy should return error")
+	}
+}
+
+func TestWeightPoolSelector(t *testing.T) {
+	s := &WeightPoolSelector{}
+
+	candidates := []*v1alpha1.IPPool{
+		newSelectorPool("pool1", 0, 0, 0, 0),
+		newSelectorPool("pool2", 0, 3, 0, 0),
+		newSelectorPool("pool3", 0, 1, 0, 0),
+	}
+	count := make(map[string]int)
+	for n := 0; n < 4000; n++ {
+		count[s.Select(candidates, &NetConf{}).Name]++
+	}
+	if count["pool1"] != 0 {
+		t.Errorf("pool with zero weight shouldn't be selected, real is %d", count["pool1"])
+	}
+	if count["pool2"] < 2700 || count["pool2"] > 3300 {
+		t.Errorf("pool2 should be selected about 3000 times, real is %d", count["pool2"])
+	}
+
+	zeroWeight := []*v1alpha1.IPPool{
+		newSelectorPool("pool1", 0, 0, 0, 0),
+		newSelectorPool("pool2", 0, 0, 0, 0),
+	}
+	count = make(map[string]int)
+	for n := 0; n < 100; n++ {
+		count[s.Select(zeroWeight, &NetConf{}).Name]++
+	}
+	if count["pool1"]+count["pool2"] != 100 {
+		t.Errorf("unexpected select result %v for zero weight pools", count)
+	}
+}
@@ -0,0 +1,27 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+// checkQuota returns ErrQuotaExceeded when the namespace of conf holds its quota of ips in ipPool,
+// requests without namespace, e.g. type cniused, aren't limited
+func checkQuota(ipPool *v1alpha1.IPPool, conf *NetConf) error {
+	if len(ipPool.Spec.NamespaceQuotas) == 0 {
+		return nil
+	}
+	ns := conf.genAllocateInfo().Namespace()
+	if ns == "" {
+		return nil
+	}
+	limit, ok := ipPool.NamespaceQuota(ns, conf.NamespaceLabels)
+	if !ok {
+		return nil
+	}
+	if cnt := ipPool.NamespaceIPCount(ns); cnt >= limit {
+		return fmt.Errorf("%w: namespace %s holds %d ips in ippool %s, quota is %d", ErrQuotaExceeded, ns, cnt, ipPool.Name, limit)
+	}
+	return nil
+}
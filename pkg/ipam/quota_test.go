@@ -0,0 +1,63 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+func TestCheckQuota(t *testing.T) {
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			NamespaceQuotas: []v1alpha1.NamespaceQuota{
+				{Namespaces: []string{"ns1"}, Max: 1},
+				{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}, Max: 0},
+			},
+		},
+		Status: v1alpha1.IPPoolStatus{
+			AllocatedIPs: map[string]v1alpha1.AllocateInfo{
+				"10.10.0.2": {Type: v1alpha1.AllocateTypePod, ID: "ns1/pod1", CID: "cid"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		conf     NetConf
+		exceeded bool
+	}{
+		{
+			name:     "namespace exceeds quota",
+			conf:     NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ns1", K8sPodName: "pod2", AllocateIdentify: "cid"},
+			exceeded: true,
+		},
+		{
+			name:     "owner in namespace exceeds quota",
+			conf:     NetConf{Type: v1alpha1.AllocateTypeStatefulSet, K8sPodNs: "ns1", K8sPodName: "sts-0", Owner: "ns1/sts"},
+			exceeded: true,
+		},
+		{
+			name:     "namespace selector with zero quota",
+			conf:     NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ns2", K8sPodName: "pod1", NamespaceLabels: map[string]string{"tenant": "a"}},
+			exceeded: true,
+		},
+		{
+			name: "namespace without quota",
+			conf: NetConf{Type: v1alpha1.AllocateTypePod, K8sPodNs: "ns2", K8sPodName: "pod1", NamespaceLabels: map[string]string{"tenant": "b"}},
+		},
+		{
+			name: "type cniused",
+			conf: NetConf{Type: v1alpha1.AllocateTypeCNIUsed, AllocateIdentify: "cid"},
+		},
+	}
+	for _, item := range tests {
+		err := checkQuota(pool, &item.conf)
+		if errors.Is(err, ErrQuotaExceeded) != item.exceeded {
+			t.Errorf("test %s failed, expect exceeded %v, err: %v", item.name, item.exceeded, err)
+		}
+	}
+}
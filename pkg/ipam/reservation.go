@@ -0,0 +1,83 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+)
+
+// listReservations lists unexpired IPReservations of pool, they are read from the cache of WithCache
+func (i *Ipam) listReservations(ctx context.Context, pool string) ([]v1alpha1.IPReservation, error) {
+	reservations := v1alpha1.IPReservationList{}
+	if err := i.reader.List(ctx, &reservations, client.InNamespace(i.namespace)); err != nil {
+		klog.Errorf("list ipreservations of ippool %s error, err: %s", pool, err)
+		return nil, err
+	}
+	now := time.Now()
+	res := []v1alpha1.IPReservation{}
+	for index := range reservations.Items {
+		r := reservations.Items[index]
+		if r.Spec.Pool != pool || r.Expired(now) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// checkReservation returns error when static ip conf.IP is reserved for others
+func (i *Ipam) checkReservation(ctx context.Context, conf *NetConf, ipPool *v1alpha1.IPPool) error {
+	reservations, err := i.listReservations(ctx, ipPool.Name)
+	if err != nil {
+		return err
+	}
+	return checkReservationIn(reservations, conf)
+}
+
+func checkReservationIn(reservations []v1alpha1.IPReservation, conf *NetConf) error {
+	ip := net.ParseIP(conf.IP)
+	for index := range reservations {
+		r := &reservations[index]
+		cidrs, err := r.CIDRs()
+		if err != nil {
+			klog.Errorf("Invalid ipreservation %s, err: %s", r.Name, err)
+			continue
+		}
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) && !r.MatchOwner(conf.getAllocateID(), conf.Owner) {
+				return fmt.Errorf("%w: static ip %s is reserved by ipreservation %s", ErrIPInUse, conf.IP, r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// excludeReservations marks ips reserved by IPReservations of ipPool as used in index
+func (i *Ipam) excludeReservations(ctx context.Context, ipPool *v1alpha1.IPPool, index freeIndex) error {
+	reservations, err := i.listReservations(ctx, ipPool.Name)
+	if err != nil {
+		return err
+	}
+	excludeNets(index, ipPool, reservedNets(reservations))
+	return nil
+}
+
+// reservedNets returns ip nets reserved by reservations, invalid reservations are skipped
+func reservedNets(reservations []v1alpha1.IPReservation) []*net.IPNet {
+	var res []*net.IPNet
+	for index := range reservations {
+		cidrs, err := reservations[index].CIDRs()
+		if err != nil {
+			klog.Errorf("Invalid ipreservation %s, err: %s", reservations[index].Name, err)
+			continue
+		}
+		res = append(res, cidrs...)
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+package ipam
+
+import (
+	"math/rand"
+
+	"k8s.io/klog"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+)
+
+// allocationStrategy chooses the free ip to allocate dynamically in an ippool of length
+type allocationStrategy interface {
+	// Next returns the offset of the chosen free ip in index, offset is status.offset of the ippool
+	Next(index freeIndex, length, offset int64) (int64, bool)
+	// NextOffset returns status.offset after the ip at off is allocated,
+	// constants.IPPoolOffsetIgnore means status.offset isn't used by the strategy
+	NextOffset(off, length int64) int64
+}
+
+func newAllocationStrategy(strategy v1alpha1.AllocationStrategy) allocationStrategy {
+	switch strategy {
+	case "", v1alpha1.AllocationStrategySequential:
+		return &sequentialStrategy{}
+	case v1alpha1.AllocationStrategyLowestFirst:
+		return &lowestFirstStrategy{}
+	case v1alpha1.AllocationStrategyRandom:
+		return &randomStrategy{}
+	case v1alpha1.AllocationStrategyHighestFirst:
+		return &highestFirstStrategy{}
+	}
+	klog.Errorf("Unknown allocation strategy %s, use %s", strategy, v1alpha1.AllocationStrategySequential)
+	return &sequentialStrategy{}
+}
+
+// sequentialStrategy allocates ip round-robin from status.offset, so a released ip isn't reused soon
+type sequentialStrategy struct{}
+
+func (s *sequentialStrategy) Next(index freeIndex, _, offset int64) (int64, bool) {
+	return index.NextFree(offset)
+}
+
+func (s *sequentialStrategy) NextOffset(off, length int64) int64 {
+	return (off + 1) % length
+}
+
+// lowestFirstStrategy allocates the lowest free ip
+type lowestFirstStrategy struct{}
+
+func (s *lowestFirstStrategy) Next(index freeIndex, _, _ int64) (int64, bool) {
+	return index.NextFree(0)
+}
+
+func (s *lowestFirstStrategy) NextOffset(_, _ int64) int64 {
+	return constants.IPPoolOffsetIgnore
+}
+
+// highestFirstStrategy allocates the highest free ip
+type highestFirstStrategy struct{}
+
+func (s *highestFirstStrategy) Next(index freeIndex, length, _ int64) (int64, bool) {
+	return index.PrevFree(length - 1)
+}
+
+func (s *highestFirstStrategy) NextOffset(_, _ int64) int64 {
+	return constants.IPPoolOffsetIgnore
+}
+
+// randomStrategy allocates the first free ip from a random offset, it reduces conflicts of concurrent allocations
+type randomStrategy struct{}
+
+func (s *randomStrategy) Next(index freeIndex, length, _ int64) (int64, bool) {
+	//nolint:gosec
+	return index.NextFree(rand.Int63n(length))
+}
+
+func (s *randomStrategy) NextOffset(_, _ int64) int64 {
+	return constants.IPPoolOffsetIgnore
+}
@@ -0,0 +1,61 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/everoute/ipam/api/ipam/v1alpha1"
+	"github.com/everoute/ipam/pkg/constants"
+)
+
+func TestAllocationStrategy(t *testing.T) {
+	newPool := func(strategy v1alpha1.AllocationStrategy) *v1alpha1.IPPool {
+		return &v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:               "12.10.64.0/28",
+				Subnet:             "12.10.64.0/28",
+				Gateway:            "12.10.64.1",
+				AllocationStrategy: strategy,
+			},
+			Status: v1alpha1.IPPoolStatus{
+				AllocatedIPs: makeAllocateStatus("12.10.64.2", "ns/pod", "pod", "cid", "12.10.64.14", "ns/pod2", "pod", "cid"),
+				Offset:       8,
+			},
+		}
+	}
+
+	tests := []struct {
+		strategy  v1alpha1.AllocationStrategy
+		expIP     string
+		expOffset int64
+	}{
+		{strategy: "", expIP: "12.10.64.8", expOffset: 9},
+		{strategy: v1alpha1.AllocationStrategySequential, expIP: "12.10.64.8", expOffset: 9},
+		{strategy: v1alpha1.AllocationStrategyLowestFirst, expIP: "12.10.64.3", expOffset: constants.IPPoolOffsetIgnore},
+		{strategy: v1alpha1.AllocationStrategyHighestFirst, expIP: "12.10.64.13", expOffset: constants.IPPoolOffsetIgnore},
+	}
+	for _, item := range tests {
+		ip, offset := (&Ipam{}).FindNext(newPool(item.strategy))
+		if !ip.Equal(net.ParseIP(item.expIP)) || offset != item.expOffset {
+			t.Errorf("strategy %s expect %s %d, real is %s %d", item.strategy, item.expIP, item.expOffset, ip, offset)
+		}
+	}
+
+	pool := newPool(v1alpha1.AllocationStrategyRandom)
+	for n := 0; n < 100; n++ {
+		ip, offset := (&Ipam{}).FindNext(pool)
+		if offset != constants.IPPoolOffsetIgnore || !pool.Contains(ip) {
+			t.Fatalf("strategy random returns invalid ip %s and offset %d", ip, offset)
+		}
+		if _, ok := pool.Status.AllocatedIPs[ip.String()]; ok || ip.Equal(net.ParseIP("12.10.64.1")) {
+			t.Fatalf("strategy random returns used ip %s", ip)
+		}
+	}
+
+	full := newPool(v1alpha1.AllocationStrategyHighestFirst)
+	full.Spec.CIDR, full.Spec.Subnet = "12.10.64.0/30", "12.10.64.0/30"
+	full.Status.Offset = 0
+	if _, offset := (&Ipam{}).FindNext(full); offset != constants.IPPoolOffsetFull {
+		t.Errorf("full pool expect offset %d, real is %d", constants.IPPoolOffsetFull, offset)
+	}
+}
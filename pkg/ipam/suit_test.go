@@ -14,6 +14,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/scheme"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 
@@ -110,3 +111,9 @@ func makeCNIIPconfig(ip, mask, gateway string) *cniv1.IPConfig {
 		Gateway: net.ParseIP(gateway),
 	}
 }
+
+// getIPPool gets the ippool with its ipallocations
+func getIPPool(key types.NamespacedName, pool *v1alpha1.IPPool) error {
+	_, err := v1alpha1.GetIPPool(ctx, k8sClient, key, pool)
+	return err
+}
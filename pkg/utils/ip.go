@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/binary"
 	"math"
+	"math/big"
 	"net"
 )
 
@@ -16,17 +18,98 @@ func Uint32ToIpv4(ip uint32) net.IP {
 	return net.IPv4(b[0], b[1], b[2], b[3])
 }
 
+// IsIPv4 returns true when ip is an ipv4 address, ipv4-mapped ipv6 address is treated as ipv4
+func IsIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// IPToBigInt converts ip to a 32-bit (ipv4) or 128-bit (ipv6) integer
+func IPToBigInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// BigIntToIP converts n to an ip of the given family, higher bits that overflow the family are dropped
+func BigIntToIP(n *big.Int, ipv4 bool) net.IP {
+	size := net.IPv6len
+	if ipv4 {
+		size = net.IPv4len
+	}
+	b := n.Bytes()
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	if ipv4 {
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	}
+	return ip
+}
+
+// IPAddOffset returns ip + offset in the family of ip
+func IPAddOffset(ip net.IP, offset int64) net.IP {
+	n := IPToBigInt(ip)
+	n.Add(n, big.NewInt(offset))
+	return BigIntToIP(n, IsIPv4(ip))
+}
+
+// IPOffset returns ip - start, ok is false when ip is smaller than start, in another family
+// or the offset overflows int64
+func IPOffset(start, ip net.IP) (int64, bool) {
+	if IsIPv4(start) != IsIPv4(ip) || start.To16() == nil || ip.To16() == nil {
+		return 0, false
+	}
+	// fast path without big.Int, offsets in an ippool never exceed the low 64 bits
+	if s4, i4 := start.To4(), ip.To4(); s4 != nil {
+		off := int64(Ipv4ToUint32(i4)) - int64(Ipv4ToUint32(s4))
+		return off, off >= 0
+	}
+	if s16, i16 := start.To16(), ip.To16(); bytes.Equal(s16[:8], i16[:8]) {
+		lo, base := binary.BigEndian.Uint64(i16[8:]), binary.BigEndian.Uint64(s16[8:])
+		if lo < base || lo-base > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(lo - base), true
+	}
+	n := IPToBigInt(ip)
+	n.Sub(n, IPToBigInt(start))
+	if n.Sign() < 0 || !n.IsInt64() {
+		return 0, false
+	}
+	return n.Int64(), true
+}
+
+// SaturatedInt64 returns n as int64, values out of int64 range are clamped to the range
+func SaturatedInt64(n *big.Int) int64 {
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	if n.Sign() < 0 {
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
+
 func FirstIP(ipNet *net.IPNet) net.IP {
 	return ipNet.IP
 }
 
 func LastIP(ipNet *net.IPNet) net.IP {
 	ones, bits := ipNet.Mask.Size()
-	uintIP := Ipv4ToUint32(ipNet.IP)
-	add := uint32(math.Pow(2, float64(bits-ones))) - 1
-	return Uint32ToIpv4(uintIP + add)
+	n := IPToBigInt(ipNet.IP)
+	add := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	n.Add(n, add.Sub(add, big.NewInt(1)))
+	return BigIntToIP(n, IsIPv4(ipNet.IP))
+}
+
+// CompareIP compares a and b in 16-byte form, the result is 0 if a == b, -1 if a < b, and +1 if a > b
+func CompareIP(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
 }
 
 func IPBiggerThan(big net.IP, small net.IP) bool {
-	return Ipv4ToUint32(big) > Ipv4ToUint32(small)
+	return CompareIP(big, small) > 0
 }
@@ -1,15 +1,36 @@
 package utils
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func GenOwner(ownerNs, ownerName string) string {
 	return ownerNs + "/" + ownerName
 }
 
+// GenOwnerKind returns apiVersion/kind of an owner, e.g. apps/v1/Deployment
+func GenOwnerKind(apiVersion, kind string) string {
+	return apiVersion + "/" + kind
+}
+
+// GetGVKByOwnerKind returns GroupVersionKind of ownerKind generated by GenOwnerKind, the kind is empty for invalid ownerKind
+func GetGVKByOwnerKind(ownerKind string) schema.GroupVersionKind {
+	index := strings.LastIndex(ownerKind, "/")
+	if index <= 0 {
+		return schema.GroupVersionKind{}
+	}
+	return schema.FromAPIVersionAndKind(ownerKind[:index], ownerKind[index+1:])
+}
+
 func GenAllocateIDFromPod(podNs, podName string) string {
 	return podNs + "/" + podName
 }
@@ -37,3 +58,68 @@ func GetNsNameByAllocateOwner(owner string) types.NamespacedName {
 
 	return types.NamespacedName{}
 }
+
+// GenBlockName returns the IPBlock name of ipNet in pool, e.g. pool-10-0-0-16-28, the same block always has the same name,
+// so that create the IPBlock is the claim of the block
+func GenBlockName(pool string, ipNet *net.IPNet) string {
+	ones, _ := ipNet.Mask.Size()
+	ip := strings.NewReplacer(".", "-", ":", "-").Replace(ipNet.IP.String())
+	return boundName(pool, fmt.Sprintf("-%s-%d", ip, ones))
+}
+
+// GenAllocationName returns the IPAllocation name of ip in pool, e.g. pool-10-0-0-5, ipv6 is in hex without colons,
+// e.g. pool-fd000000000000000000000000000005, the same ip always has the same name, so that create the IPAllocation
+// is the claim of the ip
+func GenAllocationName(pool string, ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return boundName(pool, "-"+ip)
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return boundName(pool, "-"+strings.ReplaceAll(v4.String(), ".", "-"))
+	}
+	return boundName(pool, fmt.Sprintf("-%x", []byte(parsed.To16())))
+}
+
+// GenLabelValue returns name as a label value, when name is longer than the max length of label values, it is
+// truncated and followed by its hash, so that values of different names are still different
+func GenLabelValue(name string) string {
+	return boundLength(name, "", validation.LabelValueMaxLength)
+}
+
+// boundName returns pool+suffix, when it is longer than the max length of object names, pool is truncated and
+// followed by its hash, so that names of different pools are still different. When suffix alone is too long, it
+// returns the hash of the whole name
+func boundName(pool string, suffix string) string {
+	return boundLength(pool, suffix, validation.DNS1123SubdomainMaxLength)
+}
+
+func boundLength(pool string, suffix string, max int) string {
+	if len(pool)+len(suffix) <= max {
+		return pool + suffix
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(pool))
+	hash := fmt.Sprintf("-%08x", h.Sum32())
+	n := max - len(suffix) - len(hash)
+	if n <= 0 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(pool + suffix))
+		return fmt.Sprintf("%016x", h.Sum64())
+	}
+	return strings.TrimRight(pool[:n], ".-") + hash + suffix
+}
+
+// StatusPatch returns a json patch replaces the whole status of obj with status, the patch is preconditioned
+// on the resourceVersion of obj, so it fails with a conflict error when obj has been changed by others
+func StatusPatch(obj client.Object, status interface{}) (client.Patch, error) {
+	ops := []map[string]interface{}{{"op": "add", "path": "/status", "value": status}}
+	if rv := obj.GetResourceVersion(); rv != "" {
+		ops = append([]map[string]interface{}{{"op": "replace", "path": "/metadata/resourceVersion", "value": rv}}, ops...)
+	}
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	return client.RawPatch(types.JSONPatchType, data), nil
+}